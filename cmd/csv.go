@@ -9,41 +9,61 @@ import (
 )
 
 var (
-	mappingFlag string
-	inpCSVFile  string
+	mappingFlag    string
+	inpCSVFiles    []string
+	learnFromFiles []string
 )
 
 func init() {
-	csvCmd.Flags().StringVar(&mappingFlag, "mapping", "", "Name of the CSV account settings key (required)")
-	csvCmd.Flags().StringVarP(&inpCSVFile, "csv-input", "i", "", "CSV file to parse (required)")
-	csvCmd.MarkFlagRequired("mapping")
-	csvCmd.MarkFlagRequired("csv-input")
+	csvCmd.Flags().StringVar(&mappingFlag, "mapping", "", "Name of the CSV account settings key (default is to select one using the 'file_patterns' of each mapping)")
+	csvCmd.Flags().StringArrayVarP(&inpCSVFiles, "csv-input", "i", []string{}, "CSV file, glob, or directory to parse, or - for stdin (can be repeated)")
+	csvCmd.Flags().StringArrayVar(&learnFromFiles, "learn-from", []string{}, "Ledger journal (or glob) to learn the accounts of unmatched records from (can be repeated)")
+	csvCmd.Flags().BoolVar(&interactive, "interactive", false, "Prompt for the account of each record that does not match the lookup list (needs a terminal)")
 	rootCmd.AddCommand(csvCmd)
 }
 
 var csvCmd = &cobra.Command{
-	Use:     "csv",
-	Short:   "Create Ledger entries from your CSV files (bank, credit card, etc)",
-	Example: `slc csv -o transactions.ledger --mapping "amro-mastercard" -i amro.csv`,
-	Args:    cobra.NoArgs,
-	RunE:    runCSVCmd,
+	Use:   "csv [files...]",
+	Short: "Create Ledger entries from your CSV files (bank, credit card, etc)",
+	Example: `slc csv -o transactions.ledger --mapping "amro-mastercard" -i amro.csv
+slc csv -o transactions.ledger statements/*.csv
+cat amro.csv | slc csv -o transactions.ledger --mapping "amro-mastercard" -i -`,
+	Args: cobra.ArbitraryArgs,
+	RunE: runCSVCmd,
 }
 
 func runCSVCmd(cmd *cobra.Command, args []string) error {
-	csvData, err := os.Open(inpCSVFile)
+	paths := append(append([]string{}, inpCSVFiles...), args...)
+	if len(paths) == 0 {
+		return fmt.Errorf("At least one CSV file needs to be specified")
+	}
+
+	if cmd.Flags().Changed("mapping") && mappingFlag == "" {
+		return fmt.Errorf("The --mapping argument cannot be empty")
+	}
+
+	inputs, err := slc.ExpandCSVInputs(paths, mappingFlag)
 	if err != nil {
-		logger.WithError(err).Errorf("Unable to open CSV file %s", inpCSVFile)
+		logger.WithError(err).Error("Unable to find your CSV files")
 		return err
 	}
-	defer csvData.Close()
 
-	if mappingFlag == "" {
-		return fmt.Errorf("The --mapping argument cannot be empty")
+	state, err := openRunState()
+	if err != nil {
+		logger.WithError(err).Error("Unable to open the state file")
+		return err
 	}
+	defer state.Close()
 
 	r := slc.NewCSVRunner(ledgerOutputDest, viper, logger, progressBar)
-	if err := r.GenerateLedgerEntries(csvData, mappingFlag); err != nil {
-		logger.WithError(err).Error("Unable to process your CSV file for ledger entries")
+	r.SetRunState(state)
+	r.SetLearningJournals(learnFromFiles)
+	if err := setupLookupPrompter(cmd, r, inputs); err != nil {
+		logger.WithError(err).Error("Unable to enable interactive mode")
+		return err
+	}
+	if err := r.ImportCSVFiles(inputs, os.Stdin); err != nil {
+		logger.WithError(err).Error("Unable to process your CSV files for ledger entries")
 		return err
 	}
 
@@ -0,0 +1,60 @@
+package cmd
+
+import (
+	"fmt"
+	"os"
+
+	slc "github.com/marvinpinto/slc/lib"
+	cobra "github.com/spf13/cobra"
+)
+
+var (
+	detectMappingFlag string
+	detectCSVFile     string
+)
+
+func init() {
+	csvDetectCmd.Flags().StringVar(&detectMappingFlag, "mapping", "", "Name of the CSV account settings key to create (required)")
+	csvDetectCmd.Flags().StringVarP(&detectCSVFile, "csv-input", "i", "", "Sample CSV file to inspect (required)")
+	csvDetectCmd.MarkFlagRequired("mapping")
+	csvDetectCmd.MarkFlagRequired("csv-input")
+	csvCmd.AddCommand(csvDetectCmd)
+}
+
+var csvDetectCmd = &cobra.Command{
+	Use:     "detect",
+	Short:   "Infer a CSV account mapping from a sample file",
+	Example: `slc csv detect --mapping "amro-mastercard" -i amro.csv`,
+	Args:    cobra.NoArgs,
+	RunE:    runCSVDetectCmd,
+}
+
+func runCSVDetectCmd(cmd *cobra.Command, args []string) error {
+	csvData, err := os.Open(detectCSVFile)
+	if err != nil {
+		logger.WithError(err).Errorf("Unable to open CSV file %s", detectCSVFile)
+		return err
+	}
+	defer csvData.Close()
+
+	if detectMappingFlag == "" {
+		return fmt.Errorf("The --mapping argument cannot be empty")
+	}
+
+	state, err := openRunState()
+	if err != nil {
+		logger.WithError(err).Error("Unable to open the state file")
+		return err
+	}
+	defer state.Close()
+
+	r := slc.NewCSVRunner(ledgerOutputDest, viper, logger, progressBar)
+	r.SetRunState(state)
+	if err := r.DetectMapping(csvData, detectMappingFlag); err != nil {
+		logger.WithError(err).Error("Unable to infer a mapping from your CSV file")
+		return err
+	}
+
+	logger.Debug("CSV mapping successfully inferred")
+	return nil
+}
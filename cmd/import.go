@@ -0,0 +1,52 @@
+package cmd
+
+import (
+	"os"
+
+	slc "github.com/marvinpinto/slc/lib"
+	cobra "github.com/spf13/cobra"
+)
+
+func init() {
+	importCmd.Flags().StringArrayVar(&learnFromFiles, "learn-from", []string{}, "Ledger journal (or glob) to learn the accounts of unmatched records from (can be repeated)")
+	importCmd.Flags().BoolVar(&interactive, "interactive", false, "Prompt for the account of each record that does not match the lookup list (needs a terminal)")
+	rootCmd.AddCommand(importCmd)
+}
+
+var importCmd = &cobra.Command{
+	Use:     "import <manifest>",
+	Short:   "Create Ledger entries from the CSV files listed in a batch manifest",
+	Example: `slc import -o transactions.ledger monthly-close.yml`,
+	Args:    cobra.ExactArgs(1),
+	RunE:    runImportCmd,
+}
+
+func runImportCmd(cmd *cobra.Command, args []string) error {
+	inputs, err := slc.LoadCSVManifest(args[0])
+	if err != nil {
+		logger.WithError(err).Errorf("Unable to load the manifest %s", args[0])
+		return err
+	}
+
+	state, err := openRunState()
+	if err != nil {
+		logger.WithError(err).Error("Unable to open the state file")
+		return err
+	}
+	defer state.Close()
+
+	r := slc.NewCSVRunner(ledgerOutputDest, viper, logger, progressBar)
+	r.SetRunState(state)
+	r.SetLearningJournals(learnFromFiles)
+	if err := setupLookupPrompter(cmd, r, inputs); err != nil {
+		logger.WithError(err).Error("Unable to enable interactive mode")
+		return err
+	}
+	if err := r.ImportCSVFiles(inputs, os.Stdin); err != nil {
+		logger.WithError(err).Error("Unable to process your CSV files for ledger entries")
+		return err
+	}
+
+	logger.Debug("Ledger CLI ledger entries successfully generated")
+	return nil
+}
@@ -0,0 +1,75 @@
+package cmd
+
+import (
+	"fmt"
+	"os"
+	"sync/atomic"
+	"time"
+
+	slc "github.com/marvinpinto/slc/lib"
+	cobra "github.com/spf13/cobra"
+	mpb "github.com/vbauerster/mpb/v6"
+	cwriter "github.com/vbauerster/mpb/v6/cwriter"
+)
+
+var interactive bool
+
+// suspendableBar stops the progress bar from being redrawn while the user is
+// being prompted for input. It is used along with mpb.WithManualRefresh.
+type suspendableBar struct {
+	*mpb.Bar
+	suspended int32
+}
+
+func (b *suspendableBar) Suspend() {
+	atomic.StoreInt32(&b.suspended, 1)
+}
+
+func (b *suspendableBar) Resume() {
+	atomic.StoreInt32(&b.suspended, 0)
+}
+
+func (b *suspendableBar) refresh(refreshCh chan<- interface{}, shutdownCh <-chan struct{}, rate time.Duration) {
+	ticker := time.NewTicker(rate)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case t := <-ticker.C:
+			if atomic.LoadInt32(&b.suspended) == 1 {
+				continue
+			}
+			select {
+			case refreshCh <- t:
+			case <-shutdownCh:
+				return
+			}
+		case <-shutdownCh:
+			return
+		}
+	}
+}
+
+// setupLookupPrompter enables the interactive mode of the CSV runner, if it
+// was asked for
+func setupLookupPrompter(cmd *cobra.Command, r *slc.CSVRunner, inputs []slc.CSVInput) error {
+	if !interactive {
+		return nil
+	}
+
+	if cmd.Flags().Changed("non-interactive") {
+		return fmt.Errorf("The --interactive and --non-interactive flags cannot be used together")
+	}
+	for _, inp := range inputs {
+		if inp.Path == slc.CSV_STDIN_PATH {
+			return fmt.Errorf("The --interactive flag cannot be used when reading CSV data from stdin")
+		}
+	}
+	if !cwriter.IsTerminal(int(os.Stdin.Fd())) {
+		return fmt.Errorf("The --interactive flag needs stdin to be a terminal")
+	}
+
+	// Prompts are written to stderr, as stdout may well be the ledger output
+	r.SetLookupPrompter(slc.NewLookupPrompter(os.Stdin, os.Stderr, progressBar))
+	return nil
+}
@@ -23,6 +23,7 @@ var (
 	outputFile       string
 	viper            *viperlib.Viper
 	nonInteractive   bool
+	dryRun           bool
 	ledgerOutputDest io.Writer
 	progress         *mpb.Progress
 	progressBar      slc.ProgressBar
@@ -50,11 +51,19 @@ func init() {
 	rootCmd.PersistentFlags().BoolVarP(&verbose, "verbose", "v", false, "enable verbose output")
 	rootCmd.PersistentFlags().StringVarP(&outputFile, "output-file", "o", "", "where to write the ledger output (default is stdout)")
 	rootCmd.PersistentFlags().BoolVar(&nonInteractive, "non-interactive", false, "enable non-interactive mode (no colors, progress bars, etc)")
+	rootCmd.PersistentFlags().BoolVar(&dryRun, "dry-run", false, "write the ledger output and a diff of the state changes to stdout, without writing to any files")
 }
 
 func appSetup(cmd *cobra.Command, args []string) {
 	viper = viperlib.New()
 
+	// Dry runs never write to the output file
+	dryRunOutputFile := ""
+	if dryRun && outputFile != "" {
+		dryRunOutputFile = outputFile
+		outputFile = ""
+	}
+
 	if outputFile == "" || verbose {
 		nonInteractive = true
 	}
@@ -83,6 +92,9 @@ func appSetup(cmd *cobra.Command, args []string) {
 	viper.SetEnvPrefix("SLC")
 	viper.ReadInConfig()
 	logger.Debugf("Using config file: %s", viper.ConfigFileUsed())
+	if dryRunOutputFile != "" {
+		logger.Infof("Dry run: writing the ledger output to stdout instead of %s", dryRunOutputFile)
+	}
 
 	ledgerOutputDest = os.Stdout
 	if outputFile != "" {
@@ -96,9 +108,16 @@ func appSetup(cmd *cobra.Command, args []string) {
 	if nonInteractive {
 		progressBar = &slc.StubProgressBar{}
 	} else {
+		// The progress bar is refreshed manually in interactive mode, so that
+		// it can be suspended while prompting for input
+		refreshRate := 180 * time.Millisecond
+		refreshCh := make(chan interface{})
+		shutdownCh := make(chan struct{})
 		progress = mpb.New(
 			mpb.WithWidth(60),
-			mpb.WithRefreshRate(180*time.Millisecond),
+			mpb.WithRefreshRate(refreshRate),
+			mpb.ContainerOptional(mpb.WithManualRefresh(refreshCh), interactive),
+			mpb.WithShutdownNotifier(shutdownCh),
 		)
 
 		var decorName decor.Decorator
@@ -106,15 +125,21 @@ func appSetup(cmd *cobra.Command, args []string) {
 		if cmd.Name() == "stripe" {
 			decorName = decor.Name("Processing stripe payouts:", decor.WCSyncSpaceR)
 			decorCtr = decor.OnComplete(decor.Current(0, "# %d", decor.WCSyncWidth), "complete!")
-		} else if cmd.Name() == "csv" {
+		} else if cmd.Name() == "csv" || cmd.Name() == "detect" || cmd.Name() == "import" {
 			decorName = decor.Name("Processing CSV records:", decor.WCSyncSpaceR)
 			decorCtr = decor.OnComplete(decor.Current(0, "# %d", decor.WCSyncWidth), "complete!")
 		}
 
-		progressBar = progress.AddSpinner(100,
+		bar := progress.AddSpinner(100,
 			mpb.SpinnerOnLeft,
 			mpb.PrependDecorators(decorName, decorCtr),
 		)
+		progressBar = bar
+		if interactive {
+			sbar := &suspendableBar{Bar: bar}
+			go sbar.refresh(refreshCh, shutdownCh, refreshRate)
+			progressBar = sbar
+		}
 	}
 }
 
@@ -0,0 +1,52 @@
+package cmd
+
+import (
+	"path/filepath"
+
+	slc "github.com/marvinpinto/slc/lib"
+	homedir "github.com/mitchellh/go-homedir"
+	"github.com/spf13/afero"
+)
+
+var (
+	stateFile     string
+	proposalsFile string
+)
+
+func init() {
+	rootCmd.PersistentFlags().StringVar(&stateFile, "state-file", "", "where to keep the import history, imported Stripe payouts, and learned lookups (default is .slc.state.yaml next to the config file)")
+	rootCmd.PersistentFlags().StringVar(&proposalsFile, "proposals-file", "", "where to write proposed config values for review (default is .slc.proposals.yaml next to the config file)")
+}
+
+// openRunState locks and reads the state file (or only reads it, in dry run
+// mode). The flags take precedence over the "state_file" and "proposals_file"
+// config keys. Callers need to Close the state once they are done with it, to
+// release the lock.
+func openRunState() (*slc.RunState, error) {
+	statePath, err := runStatePath(stateFile, "state_file", ".slc.state.yaml")
+	if err != nil {
+		return nil, err
+	}
+	proposalsPath, err := runStatePath(proposalsFile, "proposals_file", ".slc.proposals.yaml")
+	if err != nil {
+		return nil, err
+	}
+
+	logger.Debugf("Using state file: %s", statePath)
+	if dryRun {
+		// Changes to the state are shown along with the ledger output instead
+		return slc.OpenDryRunState(afero.NewOsFs(), statePath, proposalsPath, ledgerOutputDest)
+	}
+	return slc.OpenRunState(afero.NewOsFs(), statePath, proposalsPath)
+}
+
+func runStatePath(flagVal string, key string, defaultName string) (string, error) {
+	path := flagVal
+	if path == "" {
+		path = viper.GetString(key)
+	}
+	if path == "" {
+		return filepath.Join(filepath.Dir(viper.ConfigFileUsed()), defaultName), nil
+	}
+	return homedir.Expand(path)
+}
@@ -53,7 +53,15 @@ func runStripeCmd(cmd *cobra.Command, args []string) error {
 		API: stripe.GetBackendWithConfig(stripe.APIBackend, config),
 	})
 
+	state, err := openRunState()
+	if err != nil {
+		logger.WithError(err).Error("Unable to open the state file")
+		return err
+	}
+	defer state.Close()
+
 	r := slc.NewStripeRunner(sc, ledgerOutputDest, viper, logger, progressBar)
+	r.SetRunState(state)
 	if err := r.GenerateStripeLedgerEntries(); err != nil {
 		logger.WithError(err).Error("Unable to download & process your Stripe payouts")
 		return err
@@ -13,4 +13,6 @@ require (
 	github.com/stretchr/testify v1.7.0
 	github.com/stripe/stripe-go/v72 v72.52.0
 	github.com/vbauerster/mpb/v6 v6.0.4
+	golang.org/x/text v0.3.5
+	gopkg.in/yaml.v2 v2.4.0
 )
@@ -0,0 +1,281 @@
+package lib
+
+import (
+	"fmt"
+	"math"
+	"math/big"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"unicode"
+
+	homedir "github.com/mitchellh/go-homedir"
+	log "github.com/sirupsen/logrus"
+	viperlib "github.com/spf13/viper"
+)
+
+const GUESS_COMMENT_KEY = "Guess"
+const DEFAULT_LEARNING_MIN_CONFIDENCE = 0.6
+
+type learningCfg struct {
+	Journals      []string `mapstructure:"journals"`
+	MinConfidence float64  `mapstructure:"min_confidence"`
+}
+
+// accountClassifier is a naive Bayes classifier that guesses the account of a
+// record from the transactions in existing Ledger journals. It looks at the
+// words in the description, the payee, and the sign and size of the amount.
+type accountClassifier struct {
+	minConfidence float64
+
+	// Accounts that records are imported into (e.g. Assets:Bank) are not
+	// used as guesses
+	excluded map[string]bool
+
+	numDocs       int
+	classDocs     map[string]int
+	classFeatures map[string]map[string]int
+	classTotals   map[string]int
+	vocabulary    map[string]bool
+}
+
+// accountGuess is the account guessed for a record, along with the
+// probability of it being correct
+type accountGuess struct {
+	account    string
+	confidence float64
+}
+
+func (g *accountGuess) String() string {
+	return fmt.Sprintf("%s (%.0f%% confidence)", g.account, g.confidence*100)
+}
+
+// initializeAccountClassifier trains a classifier using the journals listed in
+// the "learning.journals" config key, as well as any extra journals. It returns
+// nil if there aren't any journals to learn from.
+func initializeAccountClassifier(l *log.Entry, v *viperlib.Viper, extraJournals []string) (*accountClassifier, error) {
+	var cfg learningCfg
+	if err := v.UnmarshalKey("learning", &cfg); err != nil {
+		l.WithError(err).Errorf("Unable to decode configuration key %s", "learning")
+		return nil, err
+	}
+
+	patterns := append(append([]string{}, cfg.Journals...), extraJournals...)
+	if len(patterns) == 0 {
+		return nil, nil
+	}
+
+	minConfidence := DEFAULT_LEARNING_MIN_CONFIDENCE
+	if v.IsSet("learning.min_confidence") {
+		minConfidence = cfg.MinConfidence
+	}
+	if minConfidence < 0 || minConfidence > 1 {
+		return nil, fmt.Errorf("The learning.min_confidence value %v must be between 0 and 1", minConfidence)
+	}
+
+	classifier := newAccountClassifier(minConfidence, csvPrimaryAccounts(v))
+
+	var numJournals int
+	for _, pattern := range patterns {
+		expanded, err := homedir.Expand(pattern)
+		if err != nil {
+			return nil, err
+		}
+		paths, err := filepath.Glob(expanded)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid journal pattern '%s': %v", pattern, err)
+		}
+		if len(paths) == 0 {
+			return nil, fmt.Errorf("No journal files found matching '%s'", pattern)
+		}
+
+		for _, path := range paths {
+			f, err := os.Open(path)
+			if err != nil {
+				return nil, err
+			}
+			transactions, err := parseLedgerJournal(f)
+			f.Close()
+			if err != nil {
+				return nil, fmt.Errorf("Unable to read the journal %s: %v", path, err)
+			}
+			for _, tr := range transactions {
+				classifier.train(tr)
+			}
+			numJournals++
+		}
+	}
+
+	l.Infof("Learned from %d transactions in %d journal(s)", classifier.numDocs, numJournals)
+	return classifier, nil
+}
+
+func newAccountClassifier(minConfidence float64, excluded []string) *accountClassifier {
+	c := &accountClassifier{
+		minConfidence: minConfidence,
+		excluded:      make(map[string]bool),
+		classDocs:     make(map[string]int),
+		classFeatures: make(map[string]map[string]int),
+		classTotals:   make(map[string]int),
+		vocabulary:    make(map[string]bool),
+	}
+	for _, acct := range excluded {
+		c.excluded[acct] = true
+	}
+	return c
+}
+
+// csvPrimaryAccounts returns the ledger account names of all the CSV mappings
+func csvPrimaryAccounts(v *viperlib.Viper) []string {
+	var mappings map[string]csvMappedAcctCfg
+	if err := v.UnmarshalKey("csv.account", &mappings); err != nil {
+		return nil
+	}
+
+	var res []string
+	for _, cfg := range mappings {
+		if cfg.LedgerAcctName != "" {
+			res = append(res, cfg.LedgerAcctName)
+		}
+	}
+	return res
+}
+
+func (c *accountClassifier) train(tr journalTransaction) {
+	payee := tr.payee
+	if val, ok := tr.metadata[strings.ToLower(PAYEE_COMMENT_KEY)]; ok && val != "" {
+		payee = val
+	}
+
+	for _, posting := range tr.postings {
+		if c.excluded[posting.account] {
+			continue
+		}
+
+		// Amounts are seen from the point of view of the imported account,
+		// i.e. money spent on Expenses:Coffee is a negative amount
+		var amount *big.Float
+		if posting.amount != nil {
+			amount = Zero().Neg(posting.amount)
+		}
+
+		features := classifierFeatures(tr.payee, payee, amount)
+		if len(features) == 0 {
+			continue
+		}
+
+		c.numDocs++
+		c.classDocs[posting.account]++
+		if _, ok := c.classFeatures[posting.account]; !ok {
+			c.classFeatures[posting.account] = make(map[string]int)
+		}
+		for _, feature := range features {
+			c.classFeatures[posting.account][feature]++
+			c.classTotals[posting.account]++
+			c.vocabulary[feature] = true
+		}
+	}
+}
+
+// classify returns the most likely account for the record, or nil if there
+// is nothing to go on, the guess is below the minimum confidence, or the guess
+// is the default account anyway
+func (c *accountClassifier) classify(searchStr string, rec lookupRecord, defaultAcctName string) *accountGuess {
+	if c == nil || c.numDocs == 0 {
+		return nil
+	}
+
+	var features []string
+	for _, feature := range classifierFeatures(searchStr, searchStr, rec.amount) {
+		// Features that were never seen during training say nothing
+		if c.vocabulary[feature] {
+			features = append(features, feature)
+		}
+	}
+	if len(features) == 0 {
+		return nil
+	}
+
+	var classes []string
+	for class := range c.classDocs {
+		classes = append(classes, class)
+	}
+	sort.Strings(classes)
+
+	// Log probabilities with Laplace smoothing
+	vocabSize := float64(len(c.vocabulary))
+	scores := make([]float64, len(classes))
+	maxScore := math.Inf(-1)
+	for idx, class := range classes {
+		score := math.Log(float64(c.classDocs[class]) / float64(c.numDocs))
+		for _, feature := range features {
+			count := float64(c.classFeatures[class][feature])
+			score += math.Log((count + 1) / (float64(c.classTotals[class]) + vocabSize))
+		}
+		scores[idx] = score
+		if score > maxScore {
+			maxScore = score
+		}
+	}
+
+	// Normalize into probabilities, picking the first class on ties
+	var total float64
+	best := -1
+	for idx, score := range scores {
+		total += math.Exp(score - maxScore)
+		if best < 0 && score == maxScore {
+			best = idx
+		}
+	}
+	guess := &accountGuess{
+		account:    classes[best],
+		confidence: 1 / total,
+	}
+	if guess.confidence < c.minConfidence || guess.account == defaultAcctName {
+		return nil
+	}
+	return guess
+}
+
+// classifierFeatures turns a description, payee, and amount into features,
+// e.g. "word:coffee", "payee:coffee bar", "sign:-", and "size:1"
+func classifierFeatures(description string, payee string, amount *big.Float) []string {
+	var features []string
+	seen := make(map[string]bool)
+	for _, word := range append(classifierWords(description), classifierWords(payee)...) {
+		if !seen[word] {
+			seen[word] = true
+			features = append(features, fmt.Sprintf("word:%s", word))
+		}
+	}
+	if words := classifierWords(payee); len(words) > 0 {
+		features = append(features, fmt.Sprintf("payee:%s", strings.Join(words, " ")))
+	}
+
+	if amount != nil && amount.Sign() != 0 {
+		sign := "+"
+		if amount.Sign() < 0 {
+			sign = "-"
+		}
+		val, _ := Zero().Abs(amount).Float64()
+		features = append(features, fmt.Sprintf("sign:%s", sign))
+		features = append(features, fmt.Sprintf("size:%d", int(math.Floor(math.Log10(val)))))
+	}
+	return features
+}
+
+// classifierWords splits a value into lowercased words, leaving out numbers
+// (e.g. store numbers or references) and single letters
+func classifierWords(val string) []string {
+	var res []string
+	for _, word := range strings.FieldsFunc(strings.ToLower(val), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	}) {
+		if len(word) < 2 || strings.IndexFunc(word, unicode.IsLetter) < 0 {
+			continue
+		}
+		res = append(res, word)
+	}
+	return res
+}
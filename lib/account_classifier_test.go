@@ -0,0 +1,150 @@
+package lib
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/spf13/afero"
+	"github.com/stretchr/testify/assert"
+	"io/ioutil"
+	"os"
+	"testing"
+
+	log "github.com/sirupsen/logrus"
+	viperlib "github.com/spf13/viper"
+)
+
+func TestLedgerJournalParsing(t *testing.T) {
+	f, err := os.Open("testdata/csv/learning/history.ledger")
+	if err != nil {
+		t.Fatalf("Unable to read fixtures file %s", "testdata/csv/learning/history.ledger")
+	}
+	defer f.Close()
+
+	transactions, err := parseLedgerJournal(f)
+	assert.Nil(t, err)
+
+	var summary []string
+	for _, tr := range transactions {
+		for _, posting := range tr.postings {
+			summary = append(summary, fmt.Sprintf("%s|%s|%s|%v", tr.date.Format("2006-01-02"), tr.payee, posting.account, posting.amount))
+		}
+	}
+	assert.Equal(t, []string{
+		"2020-01-03|ALBERT HEIJN 1234 AMSTERDAM|Assets:Bank|-23.15",
+		"2020-01-03|ALBERT HEIJN 1234 AMSTERDAM|Expenses:Groceries|23.15",
+		"2020-01-10|ALBERT HEIJN 5678 UTRECHT|Assets:Bank|-41.2",
+		"2020-01-10|ALBERT HEIJN 5678 UTRECHT|Expenses:Groceries|41.2",
+		"2020-01-12|JUMBO SUPERMARKT 0042|Expenses:Groceries|18.9",
+		"2020-01-12|JUMBO SUPERMARKT 0042|Assets:Bank|-18.9",
+		"2020-01-15|NS GROEP TRAIN TICKET|Expenses:Transit|12.4",
+		"2020-01-15|NS GROEP TRAIN TICKET|Assets:Bank|-12.4",
+		"2020-01-17|NS GROEP OV-CHIPKAART|Expenses:Transit|20",
+		"2020-01-17|NS GROEP OV-CHIPKAART|Assets:Bank|-20",
+		"2020-01-20|Bakery|Expenses:Food:Bakery|4.5",
+		"2020-01-20|Bakery|Assets:Bank|-4.5",
+		"2020-01-25|SALARY ACME BV|Assets:Bank|2500",
+		"2020-01-25|SALARY ACME BV|Income:Salary|-2500",
+	}, summary)
+	assert.Equal(t, "BAKKERIJ DE ZON", transactions[5].metadata["payee"])
+}
+
+func TestAccountClassifier(t *testing.T) {
+	type test struct {
+		name           string
+		skipTest       bool
+		inpLearningCfg map[string]interface{}
+		inpJournals    []string
+		inpCSVData     string
+		expOutput      string
+		expError       error
+	}
+
+	tests := []test{
+		{
+			name:     "guesses the accounts of unmatched records",
+			skipTest: false,
+			inpLearningCfg: map[string]interface{}{
+				"journals": []string{"testdata/csv/learning/history*.ledger"},
+			},
+			inpCSVData: "testdata/csv/learning/unmatched.csv",
+			expOutput:  "testdata/csv/learning/unmatched.ledger",
+			expError:   nil,
+		},
+		{
+			name:     "leaves guesses below the minimum confidence out",
+			skipTest: false,
+			inpLearningCfg: map[string]interface{}{
+				"min_confidence": 0.99,
+			},
+			inpJournals: []string{"testdata/csv/learning/history.ledger"},
+			inpCSVData:  "testdata/csv/learning/unmatched.csv",
+			expOutput:   "testdata/csv/learning/unmatched-confident.ledger",
+			expError:    nil,
+		},
+		{
+			name:     "errors out on missing journals",
+			skipTest: false,
+			inpLearningCfg: map[string]interface{}{
+				"journals": []string{"testdata/csv/learning/missing-*.ledger"},
+			},
+			inpCSVData: "testdata/csv/learning/unmatched.csv",
+			expOutput:  "testdata/stripe/empty-response.ledger",
+			expError:   fmt.Errorf("expect an error here"),
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			if tc.skipTest {
+				t.Skip(fmt.Sprintf("Skipping test: %s", tc.name))
+			}
+
+			csvFixture, err := os.Open(tc.inpCSVData)
+			if err != nil {
+				t.Fatalf("Unable to read fixtures file %s", tc.inpCSVData)
+			}
+			defer csvFixture.Close()
+
+			appFs := afero.NewMemMapFs()
+			v := viperlib.New()
+			v.SetFs(appFs)
+			v.SetDefault("date_format_string", "2006-01-02")
+			v.SetConfigName("slcconfig")
+			v.AddConfigPath("/")
+			afero.WriteFile(appFs, "/slcconfig.yml", []byte("---"), 0644)
+			v.ReadInConfig()
+			v.Set("csv.account.bank", &csvMappedAcctCfg{
+				LedgerAcctName: "Assets:Bank",
+				CsvDateFormat:  "2006-01-02",
+				DateCol:        1,
+				DescCol:        2,
+				MoneyCols:      []int{3},
+				NoteCols:       []int{},
+				HeaderRow:      1,
+			})
+			v.Set("ledger_account_lookups", []lookupItem{
+				{Search: "^COFFEE COMPANY$", AcctName: "Expenses:Coffee", Description: "Coffee Company"},
+			})
+			v.Set("learning", tc.inpLearningCfg)
+
+			var logger = log.WithFields(log.Fields{"name": "slc-testing"})
+			var output bytes.Buffer
+			bar := &StubProgressBar{}
+			runner := NewCSVRunner(&output, v, logger, bar)
+			runner.SetLearningJournals(tc.inpJournals)
+
+			expOutput, err := ioutil.ReadFile(tc.expOutput)
+			if err != nil {
+				t.Fatalf("Unable to read expected output file %s", tc.expOutput)
+			}
+
+			result := runner.GenerateLedgerEntries(csvFixture, "bank")
+			if tc.expError != nil {
+				assert.NotNil(t, result)
+			} else {
+				assert.Nil(t, result)
+			}
+			assert.Equal(t, string(expOutput), output.String())
+		})
+	}
+}
@@ -1,7 +1,10 @@
 package lib
 
 import (
+	"fmt"
 	"regexp"
+	"regexp/syntax"
+	"strings"
 
 	mapstructure "github.com/mitchellh/mapstructure"
 	log "github.com/sirupsen/logrus"
@@ -13,16 +16,68 @@ type lookupItem struct {
 	AcctName           string `mapstructure:"account_name"`
 	Description        string `mapstructure:"description"`
 	DiscardTransaction bool   `mapstructure:"discard_transaction"`
+
+	// Optional conditions, see account_lookup_conditions.go
+	Conditions lookupConditions   `mapstructure:",squash"`
+	Any        []lookupConditions `mapstructure:"any,omitempty"`
+
+	// Optional target postings, see account_lookup_splits.go
+	Splits []lookupSplit `mapstructure:"splits,omitempty"`
+
+	// Optional payee, tags, and "Key: value" metadata, see
+	// account_lookup_metadata.go
+	Payee           string   `mapstructure:"payee,omitempty"`
+	Tags            []string `mapstructure:"tags,omitempty"`
+	Metadata        []string `mapstructure:"metadata,omitempty"`
+	PostingTags     []string `mapstructure:"posting_tags,omitempty"`
+	PostingMetadata []string `mapstructure:"posting_metadata,omitempty"`
+
+	// Set on entries that were guessed by the account classifier, which are
+	// not added to the lookup list
+	guess *accountGuess
 }
 
 type ledgerAccountLookup struct {
 	list   []lookupItem
-	viper  *viperlib.Viper
+	state  *RunState
 	logger *log.Entry
+
+	// The entries from the config file come first in the list, followed by
+	// the ones learned in previous runs (and this one)
+	numConfigured int
+
+	// Rules that match a search string exactly (e.g. "^Coffee Bar$") are
+	// looked up by their literal value, and are not part of the scanned rules.
+	// The entries whose search pattern matches a search string are cached, as
+	// the same descriptions tend to show up over and over again.
+	rules     []lookupRule
+	exact     map[string][]int
+	cached    map[string][]int
+	matchers  []*lookupMatcher
+	templates []*lookupTemplates
+
+	// Optional, used to ask for (or guess) the account of unmatched search
+	// strings
+	prompter   *LookupPrompter
+	classifier *accountClassifier
+}
+
+// lookupRule is a precompiled "search" pattern. Patterns that are plain
+// literals are matched without the regexp engine, and patterns that start
+// with a literal prefix are only evaluated against search strings that
+// contain that prefix.
+type lookupRule struct {
+	index    int
+	rgx      *regexp.Regexp
+	literal  string
+	isRegexp bool
+	prefix   string
+	anchored bool
 }
 
-func initializeLookupList(l *log.Entry, v *viperlib.Viper) (*ledgerAccountLookup, error) {
+func initializeLookupList(l *log.Entry, v *viperlib.Viper, state *RunState) (*ledgerAccountLookup, error) {
 	var list []lookupItem
+	var learned []lookupItem
 
 	if err := v.UnmarshalKey("ledger_account_lookups", &list); err != nil {
 		l.WithError(err).Errorf("Unable to decode configuration key %s", "ledger_account_lookups")
@@ -30,45 +85,301 @@ func initializeLookupList(l *log.Entry, v *viperlib.Viper) (*ledgerAccountLookup
 	}
 	l.Debugf("Decoded lookup list key %s to val: %#v", "ledger_account_lookups", list)
 
-	return &ledgerAccountLookup{
-		list:   list,
-		viper:  v,
+	if err := state.values.UnmarshalKey(LOOKUPS_STATE_KEY, &learned); err != nil {
+		l.WithError(err).Errorf("Unable to decode state key %s", LOOKUPS_STATE_KEY)
+		return nil, err
+	}
+	l.Debugf("Decoded learned lookup list key %s with %d entries", LOOKUPS_STATE_KEY, len(learned))
+
+	lookup := &ledgerAccountLookup{
+		state:  state,
 		logger: l,
-	}, nil
+		exact:  make(map[string][]int),
+		cached: make(map[string][]int),
+	}
+	configured := make(map[string]bool)
+	for _, item := range list {
+		if err := lookup.addItem(item); err != nil {
+			l.WithError(err).Errorf("Unable to compile configuration key %s", "ledger_account_lookups")
+			return nil, err
+		}
+		configured[item.Search] = true
+	}
+	lookup.numConfigured = len(lookup.list)
+
+	for idx, item := range learned {
+		// Learned entries that have since been copied over to the config
+		// file are no longer needed
+		if configured[item.Search] {
+			continue
+		}
+		migrateLearnedItem(l, &item, idx)
+		if configured[item.Search] {
+			continue
+		}
+		if err := lookup.addItem(item); err != nil {
+			l.WithError(err).Errorf("Unable to compile state key %s", LOOKUPS_STATE_KEY)
+			return nil, fmt.Errorf("State key %s: %v", LOOKUPS_STATE_KEY, err)
+		}
+	}
+
+	return lookup, nil
 }
 
-func (l *ledgerAccountLookup) getOrAddItem(searchStr string, defaultAcctName string) (*lookupItem, error) {
-	for _, val := range l.list {
-		matches, err := regexp.MatchString(val.Search, searchStr)
-		if err != nil {
-			return nil, err
+// migrateLearnedItem updates entries that were learned by earlier versions,
+// which saved the search string itself as the search pattern. Those entries
+// either fail to compile (e.g. "*PAYPAL"), or never match the search string
+// they were learned from (e.g. "AMAZON (EU)"), so they are changed to match
+// that search string exactly.
+func migrateLearnedItem(l *log.Entry, item *lookupItem, idx int) {
+	if strings.HasPrefix(item.Search, "^") && strings.HasSuffix(item.Search, "$") {
+		return
+	}
+
+	rgx, err := regexp.Compile(item.Search)
+	if err == nil && rgx.MatchString(item.Search) {
+		return
+	}
+
+	exactSearch := fmt.Sprintf("^%s$", regexp.QuoteMeta(item.Search))
+	if err == nil && item.Search != item.Description {
+		// This might also be a pattern that was edited by hand
+		l.Warnf("The search pattern '%s' of entry #%d in state key %s does not match that text. If it was learned by an earlier version of slc, change it to '%s'", item.Search, idx+1, LOOKUPS_STATE_KEY, exactSearch)
+		return
+	}
+
+	l.Warnf("Changed the search pattern '%s' of entry #%d in state key %s to '%s', so that it matches that text exactly", item.Search, idx+1, LOOKUPS_STATE_KEY, exactSearch)
+	if item.Search == item.Description {
+		item.Description = escapeLookupTemplate(item.Description)
+	}
+	item.Search = exactSearch
+}
+
+func (l *ledgerAccountLookup) addItem(item lookupItem) error {
+	index := len(l.list)
+
+	// Learned entries are numbered from the start of the state key, as that
+	// is where they need to be fixed
+	number := index - l.numConfigured
+	rule, isExact, err := compileLookupRule(item.Search, number)
+	if err != nil {
+		return err
+	}
+	rule.index = index
+
+	matcher, err := compileLookupMatcher(item, number)
+	if err != nil {
+		return err
+	}
+
+	if err := validateLookupSplits(item.Splits, number); err != nil {
+		return err
+	}
+
+	templates, err := compileLookupTemplates(item, number)
+	if err != nil {
+		return err
+	}
+
+	if err := validateLookupMetadata(item, number); err != nil {
+		return err
+	}
+
+	l.list = append(l.list, item)
+	l.matchers = append(l.matchers, matcher)
+	l.templates = append(l.templates, templates)
+	if isExact {
+		l.exact[rule.literal] = append(l.exact[rule.literal], index)
+		return nil
+	}
+	l.rules = append(l.rules, rule)
+	return nil
+}
+
+// compileLookupRule compiles a "search" pattern, and works out whether it can
+// be matched using plain string comparisons. The index is only used in error
+// messages, the caller sets the index of the returned rule.
+func compileLookupRule(pattern string, index int) (lookupRule, bool, error) {
+	rgx, err := regexp.Compile(pattern)
+	if err != nil {
+		return lookupRule{}, false, fmt.Errorf("Invalid search pattern '%s' in entry #%d: %v", pattern, index+1, err)
+	}
+	rule := lookupRule{rgx: rgx, isRegexp: true}
+
+	re, err := syntax.Parse(pattern, syntax.Perl)
+	if err != nil {
+		return rule, false, nil
+	}
+	re = re.Simplify()
+
+	switch {
+	case isCaseSensitiveLiteral(re):
+		// e.g. "COFFEE BAR"
+		rule.literal = string(re.Rune)
+		rule.isRegexp = false
+		return rule, false, nil
+
+	case re.Op == syntax.OpConcat && len(re.Sub) == 3 && re.Sub[0].Op == syntax.OpBeginText &&
+		isCaseSensitiveLiteral(re.Sub[1]) && re.Sub[2].Op == syntax.OpEndText:
+		// e.g. "^COFFEE BAR$"
+		rule.literal = string(re.Sub[1].Rune)
+		rule.isRegexp = false
+		return rule, true, nil
+
+	case re.Op == syntax.OpConcat && len(re.Sub) > 1 && re.Sub[0].Op == syntax.OpBeginText &&
+		isCaseSensitiveLiteral(re.Sub[1]):
+		// e.g. "^COFFEE.*"
+		rule.prefix = string(re.Sub[1].Rune)
+		rule.anchored = true
+
+	default:
+		rule.prefix, _ = rgx.LiteralPrefix()
+	}
+	return rule, false, nil
+}
+
+func isCaseSensitiveLiteral(re *syntax.Regexp) bool {
+	return re.Op == syntax.OpLiteral && re.Flags&syntax.FoldCase == 0
+}
+
+func (r lookupRule) matches(searchStr string) bool {
+	if !r.isRegexp {
+		return strings.Contains(searchStr, r.literal)
+	}
+	if r.anchored && !strings.HasPrefix(searchStr, r.prefix) {
+		return false
+	}
+	if !r.anchored && r.prefix != "" && !strings.Contains(searchStr, r.prefix) {
+		return false
+	}
+	return r.rgx.MatchString(searchStr)
+}
+
+// candidates returns the indexes of all the lookup list entries whose search
+// pattern matches the search string, in order
+func (l *ledgerAccountLookup) candidates(searchStr string) []int {
+	if res, ok := l.cached[searchStr]; ok {
+		return res
+	}
+
+	exact := l.exact[searchStr]
+	var res []int
+	for _, rule := range l.rules {
+		for len(exact) > 0 && exact[0] < rule.index {
+			res = append(res, exact[0])
+			exact = exact[1:]
 		}
+		if rule.matches(searchStr) {
+			res = append(res, rule.index)
+		}
+	}
+	res = append(res, exact...)
+
+	l.cached[searchStr] = res
+	return res
+}
+
+// find returns the index of the first lookup list entry that matches the
+// record, or -1 if none of them match
+func (l *ledgerAccountLookup) find(searchStr string, rec lookupRecord) int {
+	for _, index := range l.candidates(searchStr) {
+		if l.matchers[index].matches(rec) {
+			return index
+		}
+	}
+	return -1
+}
 
-		if matches {
-			return &val, nil
+// getOrAddItem returns the first lookup list entry that matches the search
+// string and record, adding a new entry if there aren't any
+func (l *ledgerAccountLookup) getOrAddItem(searchStr string, rec lookupRecord, defaultAcctName string) (*lookupItem, error) {
+	if index := l.find(searchStr, rec); index >= 0 {
+		item := l.list[index]
+		if err := l.templates[index].render(&item, searchStr, rec); err != nil {
+			return nil, err
 		}
+		return &item, nil
 	}
 
+	// New entries match the search string exactly, so that descriptions
+	// containing characters such as "(" or "+" are not treated as patterns
+	exactSearch := fmt.Sprintf("^%s$", regexp.QuoteMeta(searchStr))
 	newItem := &lookupItem{
-		Search:             searchStr,
+		Search:             exactSearch,
 		AcctName:           defaultAcctName,
-		Description:        searchStr,
+		Description:        escapeLookupTemplate(searchStr),
 		DiscardTransaction: false,
 	}
+	// Guesses are only used as a fallback after the lookup list entries
+	guess := l.classifier.classify(searchStr, rec, defaultAcctName)
+	if l.prompter != nil {
+		var err error
+		if newItem, err = l.prompter.promptItem(searchStr, rec, defaultAcctName, guess, l.list); err != nil {
+			return nil, err
+		}
+	} else if guess != nil {
+		l.logger.Debugf("Guessed account %s for '%s'", guess, searchStr)
+		return &lookupItem{
+			Search:      exactSearch,
+			AcctName:    guess.account,
+			Description: searchStr,
+			guess:       guess,
+		}, nil
+	}
 	l.logger.Debugf("Updating lookup list '%s' with new entry %#v", "ledger_account_lookups", newItem)
-	l.list = append(l.list, *newItem)
+	if err := l.addItem(*newItem); err != nil {
+		return nil, err
+	}
+	index := len(l.list) - 1
+	if newItem.Search != exactSearch {
+		// Generalised patterns may also match previously seen search strings
+		l.cached = make(map[string][]int)
+	} else if res, ok := l.cached[searchStr]; ok {
+		l.cached[searchStr] = append(res, index)
+	}
 
+	if err := l.templates[index].render(newItem, searchStr, rec); err != nil {
+		return nil, err
+	}
 	return newItem, nil
 }
 
+// persistData saves the learned entries to the state, and proposes them as
+// config file entries
 func (l *ledgerAccountLookup) persistData() error {
 	var cfg []map[string]interface{}
+	learned := l.list[l.numConfigured:]
 
-	if err := mapstructure.Decode(l.list, &cfg); err != nil {
+	if err := mapstructure.Decode(learned, &cfg); err != nil {
 		l.logger.WithError(err).Errorf("Unable to encode mapped configuration key %s", "ledger_account_lookups")
 		return err
 	}
 
-	l.viper.Set("ledger_account_lookups", cfg)
+	// Nested lists of structs are left as-is by the above, so the "any"
+	// conditions and splits need to be encoded separately
+	for idx, item := range learned {
+		if len(item.Any) > 0 {
+			var anyCfg []map[string]interface{}
+			if err := mapstructure.Decode(item.Any, &anyCfg); err != nil {
+				l.logger.WithError(err).Errorf("Unable to encode mapped configuration key %s", "ledger_account_lookups")
+				return err
+			}
+			cfg[idx]["any"] = anyCfg
+		}
+
+		if len(item.Splits) > 0 {
+			var splitsCfg []map[string]interface{}
+			if err := mapstructure.Decode(item.Splits, &splitsCfg); err != nil {
+				l.logger.WithError(err).Errorf("Unable to encode mapped configuration key %s", "ledger_account_lookups")
+				return err
+			}
+			cfg[idx]["splits"] = splitsCfg
+		}
+	}
+
+	l.state.set(LOOKUPS_STATE_KEY, cfg)
+	if len(cfg) > 0 || l.state.proposals.IsSet(LOOKUPS_STATE_KEY) {
+		l.state.propose(LOOKUPS_STATE_KEY, cfg)
+	}
 	return nil
 }
@@ -0,0 +1,209 @@
+package lib
+
+import (
+	"fmt"
+	"math/big"
+	"regexp"
+	"strings"
+	"time"
+)
+
+const LOOKUP_SIGN_POSITIVE = "positive"
+const LOOKUP_SIGN_NEGATIVE = "negative"
+
+// lookupConditions are the (optional) conditions a record needs to satisfy, in
+// addition to its "search" pattern, in order to match a lookup list entry.
+// All the specified conditions need to be satisfied.
+type lookupConditions struct {
+	MinAmount string `mapstructure:"min_amount,omitempty"`
+	MaxAmount string `mapstructure:"max_amount,omitempty"`
+	Sign      string `mapstructure:"sign,omitempty"`
+	DateFrom  string `mapstructure:"date_from,omitempty"`
+	DateTo    string `mapstructure:"date_to,omitempty"`
+	Note      string `mapstructure:"note,omitempty"`
+	Source    string `mapstructure:"source,omitempty"`
+}
+
+// lookupRecord describes the record a lookup is made for
+type lookupRecord struct {
+	amount *big.Float
+	date   time.Time
+	notes  []string
+	source string
+
+	// The ISO code of the amount's currency, which determines the number of
+	// decimals it is rendered with in templates (two if it is not known)
+	currency string
+
+	// The raw record, shown when prompting for an account
+	row []string
+}
+
+type compiledLookupConditions struct {
+	minAmount *big.Float
+	maxAmount *big.Float
+	sign      string
+	dateFrom  time.Time
+	dateTo    time.Time
+	noteRgx   *regexp.Regexp
+	sourceRgx *regexp.Regexp
+}
+
+// lookupMatcher is the compiled form of all the conditions of a lookup list
+// entry. The "any" conditions are satisfied if at least one of them is.
+type lookupMatcher struct {
+	all compiledLookupConditions
+	any []compiledLookupConditions
+}
+
+func (c lookupConditions) isEmpty() bool {
+	return c.MinAmount == "" && c.MaxAmount == "" && c.Sign == "" && c.DateFrom == "" &&
+		c.DateTo == "" && c.Note == "" && c.Source == ""
+}
+
+func compileLookupMatcher(item lookupItem, index int) (*lookupMatcher, error) {
+	if item.Conditions.isEmpty() && len(item.Any) == 0 {
+		return nil, nil
+	}
+
+	all, err := item.Conditions.compile()
+	if err != nil {
+		return nil, fmt.Errorf("Invalid conditions in entry #%d: %v", index+1, err)
+	}
+
+	matcher := &lookupMatcher{all: all}
+	for _, cond := range item.Any {
+		compiled, err := cond.compile()
+		if err != nil {
+			return nil, fmt.Errorf("Invalid 'any' conditions in entry #%d: %v", index+1, err)
+		}
+		matcher.any = append(matcher.any, compiled)
+	}
+	return matcher, nil
+}
+
+func (c lookupConditions) compile() (compiledLookupConditions, error) {
+	var res compiledLookupConditions
+	var err error
+
+	// The amounts are decoded as strings and parsed as decimals, so that they
+	// compare exactly against the record amounts (e.g. 20.10)
+	if c.MinAmount != "" {
+		var ok bool
+		if res.minAmount, ok = Zero().SetString(strings.TrimSpace(c.MinAmount)); !ok {
+			return res, fmt.Errorf("min_amount '%s' must be a number", c.MinAmount)
+		}
+	}
+	if c.MaxAmount != "" {
+		var ok bool
+		if res.maxAmount, ok = Zero().SetString(strings.TrimSpace(c.MaxAmount)); !ok {
+			return res, fmt.Errorf("max_amount '%s' must be a number", c.MaxAmount)
+		}
+	}
+	if res.minAmount != nil && res.maxAmount != nil && res.minAmount.Cmp(res.maxAmount) >= 0 {
+		return res, fmt.Errorf("min_amount %s must be less than max_amount %s", c.MinAmount, c.MaxAmount)
+	}
+
+	res.sign = strings.ToLower(c.Sign)
+	switch res.sign {
+	case "", LOOKUP_SIGN_POSITIVE, LOOKUP_SIGN_NEGATIVE:
+	default:
+		return res, fmt.Errorf("sign '%s' must be one of '%s' or '%s'", c.Sign, LOOKUP_SIGN_POSITIVE, LOOKUP_SIGN_NEGATIVE)
+	}
+
+	if c.DateFrom != "" {
+		if res.dateFrom, err = time.Parse("2006-01-02", c.DateFrom); err != nil {
+			return res, fmt.Errorf("date_from '%s' must look like 2006-01-02", c.DateFrom)
+		}
+	}
+	if c.DateTo != "" {
+		if res.dateTo, err = time.Parse("2006-01-02", c.DateTo); err != nil {
+			return res, fmt.Errorf("date_to '%s' must look like 2006-01-02", c.DateTo)
+		}
+	}
+
+	if c.Note != "" {
+		if res.noteRgx, err = regexp.Compile(c.Note); err != nil {
+			return res, fmt.Errorf("note pattern '%s': %v", c.Note, err)
+		}
+	}
+	if c.Source != "" {
+		if res.sourceRgx, err = regexp.Compile(c.Source); err != nil {
+			return res, fmt.Errorf("source pattern '%s': %v", c.Source, err)
+		}
+	}
+	return res, nil
+}
+
+func (m *lookupMatcher) matches(rec lookupRecord) bool {
+	if m == nil {
+		return true
+	}
+	if !m.all.matches(rec) {
+		return false
+	}
+	if len(m.any) == 0 {
+		return true
+	}
+	for _, cond := range m.any {
+		if cond.matches(rec) {
+			return true
+		}
+	}
+	return false
+}
+
+func (c compiledLookupConditions) matches(rec lookupRecord) bool {
+	if c.minAmount != nil || c.maxAmount != nil || c.sign != "" {
+		if rec.amount == nil {
+			return false
+		}
+
+		// Amount ranges are compared against the absolute value, so that
+		// "under 20 EUR" works the same way for debits and credits
+		absAmount := Zero().Abs(rec.amount)
+		if c.minAmount != nil && absAmount.Cmp(c.minAmount) < 0 {
+			return false
+		}
+		if c.maxAmount != nil && absAmount.Cmp(c.maxAmount) >= 0 {
+			return false
+		}
+		if c.sign == LOOKUP_SIGN_POSITIVE && rec.amount.Sign() <= 0 {
+			return false
+		}
+		if c.sign == LOOKUP_SIGN_NEGATIVE && rec.amount.Sign() >= 0 {
+			return false
+		}
+	}
+
+	if !c.dateFrom.IsZero() || !c.dateTo.IsZero() {
+		if rec.date.IsZero() {
+			return false
+		}
+		day := time.Date(rec.date.Year(), rec.date.Month(), rec.date.Day(), 0, 0, 0, 0, time.UTC)
+		if !c.dateFrom.IsZero() && day.Before(c.dateFrom) {
+			return false
+		}
+		if !c.dateTo.IsZero() && day.After(c.dateTo) {
+			return false
+		}
+	}
+
+	if c.noteRgx != nil {
+		var isMatch bool = false
+		for _, note := range rec.notes {
+			if c.noteRgx.MatchString(note) {
+				isMatch = true
+				break
+			}
+		}
+		if !isMatch {
+			return false
+		}
+	}
+
+	if c.sourceRgx != nil && !c.sourceRgx.MatchString(rec.source) {
+		return false
+	}
+	return true
+}
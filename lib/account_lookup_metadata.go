@@ -0,0 +1,78 @@
+package lib
+
+import (
+	"fmt"
+	"strings"
+	"unicode"
+)
+
+const PAYEE_COMMENT_KEY = "Payee"
+
+// lookupMetadata is a single "Key: value" metadata entry of a lookup list
+// entry. These are kept as plain strings in the config file, as map keys would
+// otherwise be lowercased.
+type lookupMetadata struct {
+	key string
+	val string
+}
+
+func parseLookupMetadata(entry string) (lookupMetadata, error) {
+	parts := strings.SplitN(entry, ":", 2)
+	if len(parts) != 2 {
+		return lookupMetadata{}, fmt.Errorf("metadata '%s' must look like 'Key: value'", entry)
+	}
+
+	md := lookupMetadata{key: strings.TrimSpace(parts[0]), val: strings.TrimSpace(parts[1])}
+	if md.key == "" || md.val == "" || strings.IndexFunc(md.key, unicode.IsSpace) >= 0 {
+		return lookupMetadata{}, fmt.Errorf("metadata '%s' must look like 'Key: value'", entry)
+	}
+	return md, nil
+}
+
+func validateLookupTag(tag string) error {
+	if tag == "" || strings.ContainsRune(tag, ':') || strings.IndexFunc(tag, unicode.IsSpace) >= 0 {
+		return fmt.Errorf("tag '%s' cannot be empty or contain spaces or colons", tag)
+	}
+	return nil
+}
+
+func validateLookupMetadata(item lookupItem, index int) error {
+	for _, tags := range [][]string{item.Tags, item.PostingTags} {
+		for _, tag := range tags {
+			if err := validateLookupTag(tag); err != nil {
+				return fmt.Errorf("Invalid tags in entry #%d: %v", index+1, err)
+			}
+		}
+	}
+
+	for _, entries := range [][]string{item.Metadata, item.PostingMetadata} {
+		for _, entry := range entries {
+			if _, err := parseLookupMetadata(entry); err != nil {
+				return fmt.Errorf("Invalid metadata in entry #%d: %v", index+1, err)
+			}
+		}
+	}
+	return nil
+}
+
+// annotateTransaction adds the payee, tags, and metadata of the lookup list
+// entry to the transaction
+func (item *lookupItem) annotateTransaction(tr *LedgerTransaction) {
+	tr.AddKeyValComment(PAYEE_COMMENT_KEY, item.Payee)
+	tr.AddTags(item.Tags)
+	for _, entry := range item.Metadata {
+		// Entries are validated when the lookup list is initialized
+		md, _ := parseLookupMetadata(entry)
+		tr.AddKeyValComment(md.key, md.val)
+	}
+}
+
+// annotatePosting adds the posting level tags and metadata of the lookup list
+// entry to the posting
+func (item *lookupItem) annotatePosting(posting *TransactionPosting) {
+	posting.AddTags(item.PostingTags)
+	for _, entry := range item.PostingMetadata {
+		md, _ := parseLookupMetadata(entry)
+		posting.AddKeyValComment(md.key, md.val)
+	}
+}
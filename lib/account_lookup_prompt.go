@@ -0,0 +1,365 @@
+package lib
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+const LOOKUP_PROMPT_NUM_SUGGESTIONS = 5
+const LOOKUP_PROMPT_NUM_MATCHES = 10
+
+// SuspendableProgressBar is a progress bar that can stop drawing itself while
+// the user is being prompted for input
+type SuspendableProgressBar interface {
+	ProgressBar
+	Suspend()
+	Resume()
+}
+
+// LookupPrompter asks the user for the account (and search pattern) of
+// records that don't match any of the lookup list entries, instead of booking
+// them to the default account.
+type LookupPrompter struct {
+	in          *bufio.Reader
+	out         io.Writer
+	progressBar ProgressBar
+}
+
+func NewLookupPrompter(in io.Reader, out io.Writer, pb ProgressBar) *LookupPrompter {
+	return &LookupPrompter{
+		in:          bufio.NewReader(in),
+		out:         out,
+		progressBar: pb,
+	}
+}
+
+// promptItem returns the new lookup list entry for the unmatched search
+// string, as chosen by the user
+func (p *LookupPrompter) promptItem(searchStr string, rec lookupRecord, defaultAcctName string, guess *accountGuess, list []lookupItem) (*lookupItem, error) {
+	if pb, ok := p.progressBar.(SuspendableProgressBar); ok {
+		pb.Suspend()
+		defer pb.Resume()
+	}
+
+	fmt.Fprintf(p.out, "\nUnmatched transaction: %s\n", searchStr)
+	if !rec.date.IsZero() {
+		fmt.Fprintf(p.out, "  Date:   %s\n", rec.date.Format("2006-01-02"))
+	}
+	if rec.amount != nil {
+		fmt.Fprintf(p.out, "  Amount: %.2f\n", rec.amount)
+	}
+	if rec.source != "" {
+		fmt.Fprintf(p.out, "  Source: %s\n", rec.source)
+	}
+	if len(rec.row) > 0 {
+		fmt.Fprintf(p.out, "  Row:    %s\n", strings.Join(rec.row, ", "))
+	}
+	if guess != nil {
+		fmt.Fprintf(p.out, "  Guess:  %s\n", guess)
+		defaultAcctName = guess.account
+	}
+
+	accounts := lookupAccountNames(list)
+	acctName, err := p.promptAccount(searchStr, defaultAcctName, accounts, list)
+	if err != nil {
+		return nil, err
+	}
+
+	search, err := p.promptSearchPattern(searchStr)
+	if err != nil {
+		return nil, err
+	}
+
+	item := &lookupItem{
+		Search:             fmt.Sprintf("^%s$", regexp.QuoteMeta(searchStr)),
+		AcctName:           acctName,
+		Description:        escapeLookupTemplate(searchStr),
+		DiscardTransaction: false,
+	}
+	if search != "" {
+		// Generalised patterns match other descriptions too, which should
+		// be left as they are
+		item.Search = search
+		item.Description = fmt.Sprintf("{{.%s}}", LOOKUP_TEMPLATE_DESCRIPTION_KEY)
+	}
+	return item, nil
+}
+
+func (p *LookupPrompter) promptAccount(searchStr string, defaultAcctName string, accounts []string, list []lookupItem) (string, error) {
+	suggestions := suggestLookupAccounts(searchStr, list, defaultAcctName)
+	if len(suggestions) > 0 {
+		fmt.Fprintln(p.out, "Suggested accounts:")
+		for idx, acct := range suggestions {
+			fmt.Fprintf(p.out, "  %d) %s\n", idx+1, acct)
+		}
+	}
+
+	for {
+		answer, err := p.ask(fmt.Sprintf("Account (number, name, or blank for %s): ", defaultAcctName))
+		if err != nil {
+			return "", err
+		}
+
+		if answer == "" {
+			return defaultAcctName, nil
+		}
+		if num, err := strconv.Atoi(answer); err == nil {
+			if num >= 1 && num <= len(suggestions) {
+				return suggestions[num-1], nil
+			}
+			fmt.Fprintf(p.out, "There is no suggestion #%d\n", num)
+			continue
+		}
+		if strings.Contains(answer, "  ") || strings.ContainsRune(answer, '\t') {
+			fmt.Fprintln(p.out, "Account names cannot contain tabs or consecutive spaces")
+			continue
+		}
+
+		matches := fuzzyMatchAccounts(answer, accounts)
+		switch {
+		case len(matches) == 0:
+			fmt.Fprintf(p.out, "Using new account %s\n", answer)
+			return answer, nil
+		case strings.EqualFold(matches[0], answer) || len(matches) == 1:
+			fmt.Fprintf(p.out, "Using account %s\n", matches[0])
+			return matches[0], nil
+		}
+
+		acct, err := p.chooseAccount(answer, matches)
+		if err != nil {
+			return "", err
+		}
+		if acct != "" {
+			return acct, nil
+		}
+	}
+}
+
+// chooseAccount asks the user to pick one of several fuzzy matches, returning
+// an empty string if they would rather try again
+func (p *LookupPrompter) chooseAccount(answer string, matches []string) (string, error) {
+	if len(matches) > LOOKUP_PROMPT_NUM_MATCHES {
+		matches = matches[:LOOKUP_PROMPT_NUM_MATCHES]
+	}
+	fmt.Fprintf(p.out, "Accounts matching '%s':\n", answer)
+	fmt.Fprintf(p.out, "  0) %s (new account)\n", answer)
+	for idx, acct := range matches {
+		fmt.Fprintf(p.out, "  %d) %s\n", idx+1, acct)
+	}
+
+	choice, err := p.ask("Choose an account (or blank to try again): ")
+	if err != nil {
+		return "", err
+	}
+	if choice == "" {
+		return "", nil
+	}
+	num, err := strconv.Atoi(choice)
+	if err != nil || num < 0 || num > len(matches) {
+		fmt.Fprintf(p.out, "Invalid choice '%s'\n", choice)
+		return "", nil
+	}
+	if num == 0 {
+		return answer, nil
+	}
+	return matches[num-1], nil
+}
+
+// promptSearchPattern returns the search pattern for the new entry, or an
+// empty string to match the search string exactly
+func (p *LookupPrompter) promptSearchPattern(searchStr string) (string, error) {
+	generalized := generalizeSearchPattern(searchStr)
+	question := fmt.Sprintf("Search pattern (blank to match '%s' exactly, or a regular expression): ", searchStr)
+	if generalized != "" {
+		question = fmt.Sprintf("Search pattern (blank to match '%s' exactly, 'g' for '%s', or a regular expression): ", searchStr, generalized)
+	}
+
+	for {
+		answer, err := p.ask(question)
+		if err != nil {
+			return "", err
+		}
+
+		if answer == "" {
+			return "", nil
+		}
+		if answer == "g" && generalized != "" {
+			return generalized, nil
+		}
+
+		rgx, err := regexp.Compile(answer)
+		if err != nil {
+			fmt.Fprintf(p.out, "Invalid regular expression: %v\n", err)
+			continue
+		}
+		if !rgx.MatchString(searchStr) {
+			fmt.Fprintf(p.out, "The pattern '%s' does not match '%s'\n", answer, searchStr)
+			continue
+		}
+		return answer, nil
+	}
+}
+
+func (p *LookupPrompter) ask(question string) (string, error) {
+	fmt.Fprint(p.out, question)
+	answer, err := p.in.ReadString('\n')
+	if err != nil && !(err == io.EOF && answer != "") {
+		fmt.Fprintln(p.out)
+		return "", fmt.Errorf("Unable to read the interactive input: %v", err)
+	}
+	return strings.TrimSpace(answer), nil
+}
+
+// lookupAccountNames returns the (sorted) account names used by the lookup
+// list entries, leaving out templated ones
+func lookupAccountNames(list []lookupItem) []string {
+	seen := make(map[string]bool)
+	var res []string
+	add := func(acct string) {
+		if acct != "" && !isLookupTemplate(acct) && !seen[acct] {
+			seen[acct] = true
+			res = append(res, acct)
+		}
+	}
+
+	for _, item := range list {
+		add(item.AcctName)
+		for _, split := range item.Splits {
+			add(split.AcctName)
+		}
+	}
+	sort.Strings(res)
+	return res
+}
+
+// suggestLookupAccounts ranks the accounts of the existing lookup list entries
+// by the number of words their descriptions and search patterns have in
+// common with the search string, falling back to the most used accounts
+func suggestLookupAccounts(searchStr string, list []lookupItem, defaultAcctName string) []string {
+	words := make(map[string]bool)
+	for _, word := range lookupWords(searchStr) {
+		words[word] = true
+	}
+
+	scores := make(map[string]int)
+	counts := make(map[string]int)
+	for _, item := range list {
+		if item.AcctName == "" || item.AcctName == defaultAcctName || isLookupTemplate(item.AcctName) {
+			continue
+		}
+		counts[item.AcctName]++
+		for _, word := range lookupWords(item.Search + " " + item.Description) {
+			if words[word] {
+				scores[item.AcctName]++
+			}
+		}
+	}
+
+	var accounts []string
+	for acct := range counts {
+		accounts = append(accounts, acct)
+	}
+	sort.Slice(accounts, func(i, j int) bool {
+		a, b := accounts[i], accounts[j]
+		if scores[a] != scores[b] {
+			return scores[a] > scores[b]
+		}
+		if counts[a] != counts[b] {
+			return counts[a] > counts[b]
+		}
+		return a < b
+	})
+
+	if len(accounts) > LOOKUP_PROMPT_NUM_SUGGESTIONS {
+		accounts = accounts[:LOOKUP_PROMPT_NUM_SUGGESTIONS]
+	}
+	return accounts
+}
+
+// lookupWords splits a description (or search pattern) into lowercased words
+// of at least 3 letters
+func lookupWords(val string) []string {
+	var res []string
+	for _, word := range strings.FieldsFunc(strings.ToLower(val), func(r rune) bool {
+		return !unicode.IsLetter(r)
+	}) {
+		if len(word) >= 3 {
+			res = append(res, word)
+		}
+	}
+	return res
+}
+
+// fuzzyMatchAccounts returns the accounts that contain all the characters of
+// the query in order (case-insensitive), e.g. "exgro" matches
+// "Expenses:Groceries". Exact matches come first, followed by accounts that
+// contain the query as-is, and then the shortest ones.
+func fuzzyMatchAccounts(query string, accounts []string) []string {
+	query = strings.ToLower(query)
+	rank := func(acct string) int {
+		acct = strings.ToLower(acct)
+		switch {
+		case acct == query:
+			return 0
+		case strings.Contains(acct, query):
+			return 1
+		}
+		return 2
+	}
+
+	var res []string
+	for _, acct := range accounts {
+		if isFuzzyMatch(query, strings.ToLower(acct)) {
+			res = append(res, acct)
+		}
+	}
+	sort.SliceStable(res, func(i, j int) bool {
+		if rank(res[i]) != rank(res[j]) {
+			return rank(res[i]) < rank(res[j])
+		}
+		return len(res[i]) < len(res[j])
+	})
+	return res
+}
+
+func isFuzzyMatch(query string, val string) bool {
+	for _, r := range query {
+		idx := strings.IndexRune(val, r)
+		if idx < 0 {
+			return false
+		}
+		val = val[idx+len(string(r)):]
+	}
+	return true
+}
+
+// generalizeSearchPattern suggests a pattern that matches the leading words of
+// the search string, leaving out anything from the first word that contains a
+// digit (e.g. store numbers or references) onwards. An empty string is
+// returned if there is nothing to leave out.
+func generalizeSearchPattern(searchStr string) string {
+	fields := strings.Fields(searchStr)
+	var words []string
+	for _, field := range fields {
+		if strings.IndexFunc(field, unicode.IsDigit) >= 0 {
+			break
+		}
+		words = append(words, field)
+	}
+	if len(words) == 0 || len(words) == len(fields) {
+		return ""
+	}
+
+	pattern := fmt.Sprintf("^%s", regexp.QuoteMeta(strings.Join(words, " ")))
+	if !regexp.MustCompile(pattern).MatchString(searchStr) {
+		// e.g. words separated by more than one space
+		return ""
+	}
+	return pattern
+}
@@ -0,0 +1,125 @@
+package lib
+
+import (
+	"fmt"
+	"math"
+	"math/big"
+)
+
+// lookupSplit is one of the target postings of a lookup list entry that
+// spreads a record over several accounts. Each split takes either a
+// percentage of the record amount, a fixed amount, or whatever remains after
+// all the other splits.
+type lookupSplit struct {
+	AcctName  string   `mapstructure:"account_name"`
+	Percent   *float64 `mapstructure:"percent,omitempty"`
+	Amount    *float64 `mapstructure:"amount,omitempty"`
+	Remainder bool     `mapstructure:"remainder,omitempty"`
+}
+
+func validateLookupSplits(splits []lookupSplit, index int) error {
+	if len(splits) == 0 {
+		return nil
+	}
+
+	var numRemainders int
+	var hasFixedAmounts bool
+	var totalPercent float64
+	for idx, split := range splits {
+		if split.AcctName == "" {
+			return fmt.Errorf("Invalid splits in entry #%d: split #%d needs an 'account_name'", index+1, idx+1)
+		}
+
+		var numKinds int
+		if split.Percent != nil {
+			numKinds++
+			if *split.Percent <= 0 {
+				return fmt.Errorf("Invalid splits in entry #%d: split #%d has a non-positive percent '%v'", index+1, idx+1, *split.Percent)
+			}
+			totalPercent += *split.Percent
+		}
+		if split.Amount != nil {
+			numKinds++
+			hasFixedAmounts = true
+			if *split.Amount <= 0 {
+				return fmt.Errorf("Invalid splits in entry #%d: split #%d has a non-positive amount '%v'", index+1, idx+1, *split.Amount)
+			}
+		}
+		if split.Remainder {
+			numKinds++
+			numRemainders++
+		}
+		if numKinds != 1 {
+			return fmt.Errorf("Invalid splits in entry #%d: split #%d needs exactly one of 'percent', 'amount', or 'remainder'", index+1, idx+1)
+		}
+	}
+
+	if numRemainders > 1 {
+		return fmt.Errorf("Invalid splits in entry #%d: only one split can take the remainder", index+1)
+	}
+	if hasFixedAmounts && numRemainders == 0 {
+		return fmt.Errorf("Invalid splits in entry #%d: a 'remainder' split is needed when a fixed 'amount' is used", index+1)
+	}
+	// Allow for floating point noise, e.g. 33.3 + 33.3 + 33.4
+	if totalPercent > 100+1e-9 {
+		return fmt.Errorf("Invalid splits in entry #%d: the percentages add up to %v, which is more than 100", index+1, totalPercent)
+	}
+	if numRemainders == 0 && math.Abs(totalPercent-100) > 1e-9 {
+		return fmt.Errorf("Invalid splits in entry #%d: the percentages add up to %v instead of 100, and there is no 'remainder' split", index+1, totalPercent)
+	}
+	return nil
+}
+
+// splitPostings spreads the total amount over the split accounts. Fixed
+// amounts take the sign of the total, and cannot add up to more than the total.
+// Amounts are rounded to the supplied number of decimals (the minor unit of the
+// currency, e.g. the cent), and any rounding leftover is assigned to the
+// remainder split, or to the first percentage split if there isn't one. The result is not otherwise checked
+// here, NewLedgerTransaction takes care of making sure it balances.
+func splitPostings(splits []lookupSplit, total *big.Float, currency string, exponent int) ([]TransactionPosting, error) {
+	var postings []TransactionPosting
+	remainderIdx := -1
+	firstPercentIdx := -1
+	allocated := Zero()
+	fixed := Zero()
+
+	for idx, split := range splits {
+		amount := Zero()
+		switch {
+		case split.Percent != nil:
+			pct := Zero().SetFloat64(*split.Percent)
+			amount = roundToMinorUnit(Zero().Quo(Zero().Mul(total, pct), Zero().SetInt64(100)), exponent)
+			if firstPercentIdx < 0 {
+				firstPercentIdx = idx
+			}
+		case split.Amount != nil:
+			amount = roundToMinorUnit(Zero().SetFloat64(*split.Amount), exponent)
+			fixed.Add(fixed, amount)
+			if total.Sign() < 0 {
+				amount.Neg(amount)
+			}
+		case split.Remainder:
+			remainderIdx = idx
+		}
+		allocated.Add(allocated, amount)
+
+		postings = append(postings, TransactionPosting{
+			Account:  split.AcctName,
+			Amount:   amount,
+			Currency: currency,
+		})
+	}
+
+	if fixed.Cmp(Zero().Abs(total)) > 0 {
+		return nil, fmt.Errorf("The fixed split amounts add up to %s, which is more than the record amount %s", fixed.Text('f', -1), Zero().Abs(total).Text('f', -1))
+	}
+
+	leftover := Zero().Sub(total, allocated)
+	if remainderIdx < 0 {
+		remainderIdx = firstPercentIdx
+	}
+	if remainderIdx >= 0 {
+		postings[remainderIdx].Amount.Add(postings[remainderIdx].Amount, leftover)
+	}
+	return postings, nil
+}
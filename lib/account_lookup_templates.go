@@ -0,0 +1,106 @@
+package lib
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+	"text/template"
+)
+
+const LOOKUP_TEMPLATE_DESCRIPTION_KEY = "Description"
+const LOOKUP_TEMPLATE_NOTES_KEY = "Notes"
+const LOOKUP_TEMPLATE_AMOUNT_KEY = "Amount"
+
+// lookupTemplates are the compiled "account_name" and "description" templates
+// of a lookup list entry. Templates can reference the named capture groups of
+// the "search" pattern (e.g. {{.acct}}), as well as the original description,
+// notes, and amount of the record.
+type lookupTemplates struct {
+	rgx         *regexp.Regexp
+	acctName    *template.Template
+	description *template.Template
+}
+
+func isLookupTemplate(val string) bool {
+	return strings.Contains(val, "{{")
+}
+
+func compileLookupTemplates(item lookupItem, index int) (*lookupTemplates, error) {
+	if !isLookupTemplate(item.AcctName) && !isLookupTemplate(item.Description) {
+		return nil, nil
+	}
+
+	// The search pattern has already been validated at this point
+	tmpl := &lookupTemplates{rgx: regexp.MustCompile(item.Search)}
+	for _, name := range tmpl.rgx.SubexpNames() {
+		switch name {
+		case LOOKUP_TEMPLATE_DESCRIPTION_KEY, LOOKUP_TEMPLATE_NOTES_KEY, LOOKUP_TEMPLATE_AMOUNT_KEY:
+			return nil, fmt.Errorf("Invalid search pattern '%s' in entry #%d: the capture group name '%s' is reserved", item.Search, index+1, name)
+		}
+	}
+
+	var err error
+	if isLookupTemplate(item.AcctName) {
+		tmpl.acctName, err = template.New("account_name").Option("missingkey=error").Parse(item.AcctName)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid account_name template '%s' in entry #%d: %v", item.AcctName, index+1, err)
+		}
+	}
+	if isLookupTemplate(item.Description) {
+		tmpl.description, err = template.New("description").Option("missingkey=error").Parse(item.Description)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid description template '%s' in entry #%d: %v", item.Description, index+1, err)
+		}
+	}
+	return tmpl, nil
+}
+
+// render fills in the templated fields of the lookup list entry
+func (t *lookupTemplates) render(item *lookupItem, searchStr string, rec lookupRecord) error {
+	if t == nil {
+		return nil
+	}
+
+	data := map[string]interface{}{
+		LOOKUP_TEMPLATE_DESCRIPTION_KEY: searchStr,
+		LOOKUP_TEMPLATE_NOTES_KEY:       rec.notes,
+		LOOKUP_TEMPLATE_AMOUNT_KEY:      "",
+	}
+	if rec.amount != nil {
+		data[LOOKUP_TEMPLATE_AMOUNT_KEY] = fmt.Sprintf("%.*f", currencyExponent(rec.currency), rec.amount)
+	}
+
+	// Capture groups that did not participate in the match are left empty
+	if match := t.rgx.FindStringSubmatch(searchStr); match != nil {
+		for idx, name := range t.rgx.SubexpNames() {
+			if name != "" {
+				data[name] = match[idx]
+			}
+		}
+	}
+
+	if t.acctName != nil {
+		var res strings.Builder
+		if err := t.acctName.Execute(&res, data); err != nil {
+			return fmt.Errorf("Unable to render the account_name template '%s' for '%s': %v", item.AcctName, searchStr, err)
+		}
+		item.AcctName = res.String()
+	}
+	if t.description != nil {
+		var res strings.Builder
+		if err := t.description.Execute(&res, data); err != nil {
+			return fmt.Errorf("Unable to render the description template '%s' for '%s': %v", item.Description, searchStr, err)
+		}
+		item.Description = res.String()
+	}
+	return nil
+}
+
+// escapeLookupTemplate makes sure that a literal value is not treated as a
+// template, e.g. for descriptions that happen to contain "{{"
+func escapeLookupTemplate(val string) string {
+	if !isLookupTemplate(val) {
+		return val
+	}
+	return fmt.Sprintf("{{%q}}", val)
+}
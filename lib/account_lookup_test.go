@@ -0,0 +1,469 @@
+package lib
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/stretchr/testify/assert"
+	"math/big"
+	"strings"
+	"testing"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	viperlib "github.com/spf13/viper"
+)
+
+func TestLedgerAccountLookup(t *testing.T) {
+	amount := func(val string) *big.Float {
+		amt, _ := Zero().SetString(val)
+		return amt
+	}
+	date := func(val string) time.Time {
+		d, _ := time.Parse("2006-01-02", val)
+		return d
+	}
+
+	type test struct {
+		name           string
+		skipTest       bool
+		inpLookupList  []lookupItem
+		inpLearnedList []lookupItem
+		inpSearchStrs  []string
+		inpRecords     []lookupRecord
+		expAcctNames   []string
+		expDescs       []string
+		expLookupList  []lookupItem
+		expError       error
+	}
+
+	tests := []test{
+		{
+			name:     "returns the first matching entry",
+			skipTest: false,
+			inpLookupList: []lookupItem{
+				{Search: "(?i)^albert heijn", AcctName: "Expenses:Groceries"},
+				{Search: "^COFFEE BAR$", AcctName: "Expenses:Coffee"},
+				{Search: "COFFEE", AcctName: "Expenses:Drinks"},
+				{Search: "^TRAIN.*NS", AcctName: "Expenses:Transit"},
+				{Search: "^COFFEE BAR BAKERY$", AcctName: "Expenses:Bakery"},
+			},
+			inpSearchStrs: []string{
+				"ALBERT HEIJN 1234",
+				"COFFEE BAR",
+				"COFFEE BAR BAKERY",
+				"TRAIN TICKET NS",
+				"TICKET TRAIN NS",
+				"COFFEE BAR",
+			},
+			expAcctNames: []string{
+				"Expenses:Groceries",
+				"Expenses:Coffee",
+				"Expenses:Drinks",
+				"Expenses:Transit",
+				"Expenses:Unknown",
+				"Expenses:Coffee",
+			},
+			expLookupList: []lookupItem{
+				{Search: "(?i)^albert heijn", AcctName: "Expenses:Groceries"},
+				{Search: "^COFFEE BAR$", AcctName: "Expenses:Coffee"},
+				{Search: "COFFEE", AcctName: "Expenses:Drinks"},
+				{Search: "^TRAIN.*NS", AcctName: "Expenses:Transit"},
+				{Search: "^COFFEE BAR BAKERY$", AcctName: "Expenses:Bakery"},
+				{Search: "^TICKET TRAIN NS$", AcctName: "Expenses:Unknown", Description: "TICKET TRAIN NS"},
+			},
+			expError: nil,
+		},
+		{
+			name:          "escapes and anchors new entries",
+			skipTest:      false,
+			inpLookupList: []lookupItem{},
+			inpSearchStrs: []string{
+				"BAKERY (AMSTERDAM) +31*",
+				"BAKERY (AMSTERDAM) +31* #2",
+				"BAKERY (AMSTERDAM) +31*",
+			},
+			expAcctNames: []string{
+				"Expenses:Unknown",
+				"Expenses:Unknown",
+				"Expenses:Unknown",
+			},
+			expLookupList: []lookupItem{
+				{Search: `^BAKERY \(AMSTERDAM\) \+31\*$`, AcctName: "Expenses:Unknown", Description: "BAKERY (AMSTERDAM) +31*"},
+				{Search: `^BAKERY \(AMSTERDAM\) \+31\* #2$`, AcctName: "Expenses:Unknown", Description: "BAKERY (AMSTERDAM) +31* #2"},
+			},
+			expError: nil,
+		},
+		{
+			name:     "matches entries on amount ranges and sign",
+			skipTest: false,
+			inpLookupList: []lookupItem{
+				{Search: "AMAZON", AcctName: "Expenses:Refunds", Conditions: lookupConditions{Sign: "positive"}},
+				{Search: "AMAZON", AcctName: "Expenses:Books", Conditions: lookupConditions{MaxAmount: "20.10"}},
+				{Search: "AMAZON", AcctName: "Expenses:Household", Conditions: lookupConditions{MinAmount: "20.10"}},
+			},
+			inpSearchStrs: []string{"AMAZON EU", "AMAZON EU", "AMAZON EU", "AMAZON EU"},
+			inpRecords: []lookupRecord{
+				{amount: amount("-12.99")},
+				{amount: amount("-20.10")},
+				{amount: amount("-149.95")},
+				{amount: amount("12.99")},
+			},
+			expAcctNames: []string{
+				"Expenses:Books",
+				"Expenses:Household",
+				"Expenses:Household",
+				"Expenses:Refunds",
+			},
+			expLookupList: []lookupItem{
+				{Search: "AMAZON", AcctName: "Expenses:Refunds", Conditions: lookupConditions{Sign: "positive"}},
+				{Search: "AMAZON", AcctName: "Expenses:Books", Conditions: lookupConditions{MaxAmount: "20.10"}},
+				{Search: "AMAZON", AcctName: "Expenses:Household", Conditions: lookupConditions{MinAmount: "20.10"}},
+			},
+			expError: nil,
+		},
+		{
+			name:     "matches entries on dates, notes, sources, and any of several conditions",
+			skipTest: false,
+			inpLookupList: []lookupItem{
+				{Search: "RENT", AcctName: "Expenses:Rent:Old", Conditions: lookupConditions{DateTo: "2021-03-31"}},
+				{Search: "RENT", AcctName: "Expenses:Rent:New", Conditions: lookupConditions{DateFrom: "2021-04-01", Source: "^bank$"}},
+				{Search: "TRANSFER", AcctName: "Assets:Savings", Conditions: lookupConditions{Note: "(?i)savings"}},
+				{Search: "TRANSFER", AcctName: "Expenses:Gifts", Any: []lookupConditions{{Note: "(?i)birthday"}, {DateFrom: "2021-12-20", DateTo: "2021-12-26"}}},
+			},
+			inpSearchStrs: []string{"RENT", "RENT", "RENT", "TRANSFER", "TRANSFER", "TRANSFER", "TRANSFER"},
+			inpRecords: []lookupRecord{
+				{date: date("2021-03-31"), source: "bank"},
+				{date: date("2021-04-01"), source: "bank"},
+				{date: date("2021-04-01"), source: "visa"},
+				{date: date("2021-06-01"), notes: []string{"Ref 1234", "Monthly SAVINGS"}},
+				{date: date("2021-06-01"), notes: []string{"Happy birthday!"}},
+				{date: date("2021-12-24")},
+				{date: date("2021-12-27")},
+			},
+			expAcctNames: []string{
+				"Expenses:Rent:Old",
+				"Expenses:Rent:New",
+				"Expenses:Unknown",
+				"Assets:Savings",
+				"Expenses:Gifts",
+				"Expenses:Gifts",
+				"Expenses:Unknown",
+			},
+			expLookupList: []lookupItem{
+				{Search: "RENT", AcctName: "Expenses:Rent:Old", Conditions: lookupConditions{DateTo: "2021-03-31"}},
+				{Search: "RENT", AcctName: "Expenses:Rent:New", Conditions: lookupConditions{DateFrom: "2021-04-01", Source: "^bank$"}},
+				{Search: "TRANSFER", AcctName: "Assets:Savings", Conditions: lookupConditions{Note: "(?i)savings"}},
+				{Search: "TRANSFER", AcctName: "Expenses:Gifts", Any: []lookupConditions{{Note: "(?i)birthday"}, {DateFrom: "2021-12-20", DateTo: "2021-12-26"}}},
+				{Search: "^RENT$", AcctName: "Expenses:Unknown", Description: "RENT"},
+				{Search: "^TRANSFER$", AcctName: "Expenses:Unknown", Description: "TRANSFER"},
+			},
+			expError: nil,
+		},
+		{
+			name:     "reports invalid conditions along with their position",
+			skipTest: false,
+			inpLookupList: []lookupItem{
+				{Search: "AMAZON", AcctName: "Expenses:Books", Conditions: lookupConditions{MinAmount: "20", MaxAmount: "10"}},
+			},
+			expError: fmt.Errorf("Invalid conditions in entry #1: min_amount 20 must be less than max_amount 10"),
+		},
+		{
+			name:     "reports amounts that are not numbers",
+			skipTest: false,
+			inpLookupList: []lookupItem{
+				{Search: "AMAZON", AcctName: "Expenses:Books", Conditions: lookupConditions{MaxAmount: "twenty"}},
+			},
+			expError: fmt.Errorf("Invalid conditions in entry #1: max_amount 'twenty' must be a number"),
+		},
+		{
+			name:     "reports invalid any conditions along with their position",
+			skipTest: false,
+			inpLookupList: []lookupItem{
+				{Search: "AMAZON", AcctName: "Expenses:Books"},
+				{Search: "AMAZON", AcctName: "Expenses:Books", Any: []lookupConditions{{DateFrom: "01/02/2021"}}},
+			},
+			expError: fmt.Errorf("Invalid 'any' conditions in entry #2: date_from '01/02/2021' must look like 2006-01-02"),
+		},
+		{
+			name:     "migrates entries learned by earlier versions to exact matches",
+			skipTest: false,
+			inpLookupList: []lookupItem{
+				{Search: "COFFEE", AcctName: "Expenses:Coffee"},
+			},
+			inpLearnedList: []lookupItem{
+				{Search: "*PAYPAL", AcctName: "Expenses:Online", Description: "*PAYPAL"},
+				{Search: "AMAZON (EU)", AcctName: "Expenses:Books", Description: "AMAZON (EU)"},
+				{Search: "BAKERY (AMSTERDAM)", AcctName: "Expenses:Bakery", Description: "Bakery"},
+				{Search: "^RENT$", AcctName: "Expenses:Rent", Description: "RENT"},
+			},
+			inpSearchStrs: []string{"*PAYPAL", "AMAZON (EU)", "BAKERY (AMSTERDAM)", "RENT"},
+			expAcctNames:  []string{"Expenses:Online", "Expenses:Books", "Expenses:Unknown", "Expenses:Rent"},
+			expLookupList: []lookupItem{
+				{Search: "COFFEE", AcctName: "Expenses:Coffee"},
+				{Search: `^\*PAYPAL$`, AcctName: "Expenses:Online", Description: "*PAYPAL"},
+				{Search: `^AMAZON \(EU\)$`, AcctName: "Expenses:Books", Description: "AMAZON (EU)"},
+				{Search: "BAKERY (AMSTERDAM)", AcctName: "Expenses:Bakery", Description: "Bakery"},
+				{Search: "^RENT$", AcctName: "Expenses:Rent", Description: "RENT"},
+				{Search: `^BAKERY \(AMSTERDAM\)$`, AcctName: "Expenses:Unknown", Description: "BAKERY (AMSTERDAM)"},
+			},
+			expError: nil,
+		},
+		{
+			name:     "reports invalid learned entries along with their position in the state",
+			skipTest: false,
+			inpLookupList: []lookupItem{
+				{Search: "COFFEE", AcctName: "Expenses:Coffee"},
+				{Search: "AMAZON", AcctName: "Expenses:Books"},
+			},
+			inpLearnedList: []lookupItem{
+				{Search: "^RENT$", AcctName: "Expenses:Rent", Description: "RENT"},
+				{Search: "^BAKERY$", AcctName: "Expenses:Bakery", Description: "BAKERY", Conditions: lookupConditions{MaxAmount: "twenty"}},
+			},
+			expError: fmt.Errorf("State key ledger_account_lookups: Invalid conditions in entry #2: max_amount 'twenty' must be a number"),
+		},
+		{
+			name:     "renders templates using capture groups and record values",
+			skipTest: false,
+			inpLookupList: []lookupItem{
+				{Search: `^TFR TO (?P<acct>\d+)`, AcctName: "Assets:Savings:{{.acct}}", Description: "Transfer {{.acct}}"},
+				{Search: `^(?P<merchant>\w+) REFUND`, AcctName: "Expenses:Refunds", Description: "{{.merchant}} refund of {{.Amount}} ({{index .Notes 0}})"},
+			},
+			inpSearchStrs: []string{"TFR TO 1234 REF 99", "TFR TO 5678", "AMAZON REFUND", "BAKERY {{ .Amount }}"},
+			inpRecords: []lookupRecord{
+				{amount: amount("-100.00")},
+				{amount: amount("-50.00")},
+				{amount: amount("12.5"), notes: []string{"Order 42"}},
+				{amount: amount("-3.00")},
+			},
+			expAcctNames: []string{
+				"Assets:Savings:1234",
+				"Assets:Savings:5678",
+				"Expenses:Refunds",
+				"Expenses:Unknown",
+			},
+			expDescs: []string{
+				"Transfer 1234",
+				"Transfer 5678",
+				"AMAZON refund of 12.50 (Order 42)",
+				"BAKERY {{ .Amount }}",
+			},
+			expLookupList: []lookupItem{
+				{Search: `^TFR TO (?P<acct>\d+)`, AcctName: "Assets:Savings:{{.acct}}", Description: "Transfer {{.acct}}"},
+				{Search: `^(?P<merchant>\w+) REFUND`, AcctName: "Expenses:Refunds", Description: "{{.merchant}} refund of {{.Amount}} ({{index .Notes 0}})"},
+				{Search: `^BAKERY \{\{ \.Amount \}\}$`, AcctName: "Expenses:Unknown", Description: `{{"BAKERY {{ .Amount }}"}}`},
+			},
+			expError: nil,
+		},
+		{
+			name:     "renders amounts with the decimals of their currency",
+			skipTest: false,
+			inpLookupList: []lookupItem{
+				{Search: `^(?P<merchant>\w+) REFUND`, AcctName: "Expenses:Refunds", Description: "{{.merchant}} refund of {{.Amount}}"},
+			},
+			inpSearchStrs: []string{"AMAZON REFUND", "RAKUTEN REFUND", "TALABAT REFUND"},
+			inpRecords: []lookupRecord{
+				{amount: amount("12.5"), currency: "USD"},
+				{amount: amount("3100"), currency: "JPY"},
+				{amount: amount("7.512"), currency: "KWD"},
+			},
+			expAcctNames: []string{"Expenses:Refunds", "Expenses:Refunds", "Expenses:Refunds"},
+			expDescs:     []string{"AMAZON refund of 12.50", "RAKUTEN refund of 3100", "TALABAT refund of 7.512"},
+			expLookupList: []lookupItem{
+				{Search: `^(?P<merchant>\w+) REFUND`, AcctName: "Expenses:Refunds", Description: "{{.merchant}} refund of {{.Amount}}"},
+			},
+			expError: nil,
+		},
+		{
+			name:     "reports templates that reference unknown capture groups",
+			skipTest: false,
+			inpLookupList: []lookupItem{
+				{Search: `^TFR TO (?P<acct>\d+)`, AcctName: "Assets:Savings:{{.account}}"},
+			},
+			inpSearchStrs: []string{"TFR TO 1234"},
+			expError:      fmt.Errorf("Unable to render the account_name template 'Assets:Savings:{{.account}}' for 'TFR TO 1234': template: account_name:1:17: executing \"account_name\" at <.account>: map has no entry for key \"account\""),
+		},
+		{
+			name:     "rejects reserved capture group names",
+			skipTest: false,
+			inpLookupList: []lookupItem{
+				{Search: `^(?P<Amount>\d+)`, AcctName: "Expenses:{{.Amount}}"},
+			},
+			expError: fmt.Errorf("Invalid search pattern '^(?P<Amount>\\d+)' in entry #1: the capture group name 'Amount' is reserved"),
+		},
+		{
+			name:     "reports invalid patterns along with their position",
+			skipTest: false,
+			inpLookupList: []lookupItem{
+				{Search: "COFFEE", AcctName: "Expenses:Coffee"},
+				{Search: "BAKERY (AMSTERDAM", AcctName: "Expenses:Bakery"},
+			},
+			expError: fmt.Errorf("Invalid search pattern 'BAKERY (AMSTERDAM' in entry #2: error parsing regexp: missing closing ): `BAKERY (AMSTERDAM`"),
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			if tc.skipTest {
+				t.Skip(fmt.Sprintf("Skipping test: %s", tc.name))
+			}
+
+			v := viperlib.New()
+			v.Set("ledger_account_lookups", tc.inpLookupList)
+			var logger = log.WithFields(log.Fields{"name": "slc-testing"})
+
+			state := NewRunState()
+			if tc.inpLearnedList != nil {
+				state.values.Set(LOOKUPS_STATE_KEY, tc.inpLearnedList)
+			}
+			lookupList, err := initializeLookupList(logger, v, state)
+			if tc.expError != nil && len(tc.inpSearchStrs) == 0 {
+				assert.Equal(t, tc.expError, err)
+				return
+			}
+			assert.Nil(t, err)
+
+			var acctNames []string
+			var descs []string
+			for i, searchStr := range tc.inpSearchStrs {
+				var rec lookupRecord
+				if i < len(tc.inpRecords) {
+					rec = tc.inpRecords[i]
+				}
+				item, err := lookupList.getOrAddItem(searchStr, rec, "Expenses:Unknown")
+				if tc.expError != nil {
+					assert.Equal(t, tc.expError, err)
+					return
+				}
+				assert.Nil(t, err)
+				acctNames = append(acctNames, item.AcctName)
+				descs = append(descs, item.Description)
+			}
+			assert.Equal(t, tc.expAcctNames, acctNames)
+			if tc.expDescs != nil {
+				assert.Equal(t, tc.expDescs, descs)
+			}
+			assert.Equal(t, tc.expLookupList, lookupList.list)
+		})
+	}
+}
+
+func TestLedgerAccountLookupPrompt(t *testing.T) {
+	type test struct {
+		name          string
+		skipTest      bool
+		inpLookupList []lookupItem
+		inpAnswers    string
+		inpSearchStrs []string
+		expAcctNames  []string
+		expLookupList []lookupItem
+		expError      error
+	}
+
+	tests := []test{
+		{
+			name:     "books to the default account on blank answers",
+			skipTest: false,
+			inpLookupList: []lookupItem{
+				{Search: "^ALBERT HEIJN", AcctName: "Expenses:Groceries"},
+			},
+			inpAnswers:    "\n\n",
+			inpSearchStrs: []string{"COFFEE BAR 12"},
+			expAcctNames:  []string{"Expenses:Unknown"},
+			expLookupList: []lookupItem{
+				{Search: "^ALBERT HEIJN", AcctName: "Expenses:Groceries"},
+				{Search: "^COFFEE BAR 12$", AcctName: "Expenses:Unknown", Description: "COFFEE BAR 12"},
+			},
+			expError: nil,
+		},
+		{
+			name:     "uses suggestions, fuzzy matches, and generalised patterns",
+			skipTest: false,
+			inpLookupList: []lookupItem{
+				{Search: "^ALBERT HEIJN", AcctName: "Expenses:Groceries", Description: "Albert Heijn"},
+				{Search: "^JUMBO", AcctName: "Expenses:Groceries"},
+				{Search: "^COFFEE BAR$", AcctName: "Expenses:Coffee"},
+				{Search: "^TRAIN", AcctName: "Expenses:Transit"},
+			},
+			inpAnswers: strings.Join([]string{
+				"1", "g", // AH TO GO 1234
+				"excof", "", // BAKERY 7
+				"exp", "", "Expenses:Fun", "CINEMA [", "^CINEMA$", "(?i)^cinema", // CINEMA CITY
+			}, "\n") + "\n",
+			inpSearchStrs: []string{
+				"AH TO GO 1234",
+				"AH TO GO 5678",
+				"BAKERY 7",
+				"CINEMA CITY",
+			},
+			expAcctNames: []string{
+				"Expenses:Groceries",
+				"Expenses:Groceries",
+				"Expenses:Coffee",
+				"Expenses:Fun",
+			},
+			expLookupList: []lookupItem{
+				{Search: "^ALBERT HEIJN", AcctName: "Expenses:Groceries", Description: "Albert Heijn"},
+				{Search: "^JUMBO", AcctName: "Expenses:Groceries"},
+				{Search: "^COFFEE BAR$", AcctName: "Expenses:Coffee"},
+				{Search: "^TRAIN", AcctName: "Expenses:Transit"},
+				{Search: "^AH TO GO", AcctName: "Expenses:Groceries", Description: "{{.Description}}"},
+				{Search: "^BAKERY 7$", AcctName: "Expenses:Coffee", Description: "BAKERY 7"},
+				{Search: "(?i)^cinema", AcctName: "Expenses:Fun", Description: "{{.Description}}"},
+			},
+			expError: nil,
+		},
+		{
+			name:     "re-uses generalised patterns for later records",
+			skipTest: false,
+			inpLookupList: []lookupItem{
+				{Search: "^TRAIN", AcctName: "Expenses:Transit"},
+			},
+			inpAnswers:    "Expenses:Groceries\ng\n",
+			inpSearchStrs: []string{"JUMBO MARKET 0042", "JUMBO MARKET 0042", "JUMBO MARKET 0043"},
+			expAcctNames:  []string{"Expenses:Groceries", "Expenses:Groceries", "Expenses:Groceries"},
+			expLookupList: []lookupItem{
+				{Search: "^TRAIN", AcctName: "Expenses:Transit"},
+				{Search: "^JUMBO MARKET", AcctName: "Expenses:Groceries", Description: "{{.Description}}"},
+			},
+			expError: nil,
+		},
+		{
+			name:          "errors out when the input ends",
+			skipTest:      false,
+			inpLookupList: []lookupItem{},
+			inpAnswers:    "Expenses:Groceries\n",
+			inpSearchStrs: []string{"JUMBO MARKET 0042"},
+			expError:      fmt.Errorf("Unable to read the interactive input: EOF"),
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			if tc.skipTest {
+				t.Skip(fmt.Sprintf("Skipping test: %s", tc.name))
+			}
+
+			v := viperlib.New()
+			v.Set("ledger_account_lookups", tc.inpLookupList)
+			var logger = log.WithFields(log.Fields{"name": "slc-testing"})
+
+			lookupList, err := initializeLookupList(logger, v, NewRunState())
+			assert.Nil(t, err)
+			var output bytes.Buffer
+			lookupList.prompter = NewLookupPrompter(strings.NewReader(tc.inpAnswers), &output, &StubProgressBar{})
+
+			var acctNames []string
+			for _, searchStr := range tc.inpSearchStrs {
+				item, err := lookupList.getOrAddItem(searchStr, lookupRecord{}, "Expenses:Unknown")
+				if tc.expError != nil {
+					assert.Equal(t, tc.expError, err)
+					return
+				}
+				assert.Nil(t, err)
+				acctNames = append(acctNames, item.AcctName)
+			}
+			assert.Equal(t, tc.expAcctNames, acctNames)
+			assert.Equal(t, tc.expLookupList, lookupList.list)
+		})
+	}
+}
@@ -1,15 +1,16 @@
 package lib
 
 import (
-	"encoding/csv"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"math/big"
+	"regexp"
+	"strings"
 	"time"
 	"unicode"
 	"unicode/utf8"
 
-	mapstructure "github.com/mitchellh/mapstructure"
 	log "github.com/sirupsen/logrus"
 	viperlib "github.com/spf13/viper"
 )
@@ -19,6 +20,35 @@ type CSVRunner struct {
 	viper        *viperlib.Viper
 	logger       *log.Entry
 	progressBar  ProgressBar
+	summary      csvRunSummary
+	state        *RunState
+
+	// Optional, used to ask for the accounts of unmatched records
+	prompter *LookupPrompter
+
+	// Extra journals to learn the accounts of unmatched records from
+	learningJournals []string
+}
+
+// csvImport holds the state associated with importing a single CSV file
+type csvImport struct {
+	mappedAcct    string
+	mappedKey     string
+	cfg           *csvMappedAcctCfg
+	lookupList    *ledgerAccountLookup
+	history       *importHistory
+	fingerprinter *transactionFingerprinter
+	balances      *dailyBalances
+	entries       []csvEntry
+	skipPatterns  []*regexp.Regexp
+}
+
+type csvRunSummary struct {
+	numFiles        int
+	numRecords      int
+	numTransactions int
+	numDuplicates   int
+	numSkipped      int
 }
 
 func NewCSVRunner(ow io.Writer, v *viperlib.Viper, l *log.Entry, pb ProgressBar) *CSVRunner {
@@ -27,9 +57,29 @@ func NewCSVRunner(ow io.Writer, v *viperlib.Viper, l *log.Entry, pb ProgressBar)
 		viper:        v,
 		logger:       l,
 		progressBar:  pb,
+		state:        NewRunState(),
 	}
 }
 
+// SetRunState sets where the import history and learned lookup entries are
+// kept between runs, as the config file is never written to
+func (r *CSVRunner) SetRunState(s *RunState) {
+	r.state = s
+}
+
+// SetLearningJournals adds to the Ledger journals listed in the
+// "learning.journals" config key, which are used to guess the account of
+// records that do not match any of the lookup list entries
+func (r *CSVRunner) SetLearningJournals(journals []string) {
+	r.learningJournals = journals
+}
+
+// SetLookupPrompter enables interactive mode, where the user is asked for the
+// account of each record that does not match any of the lookup list entries
+func (r *CSVRunner) SetLookupPrompter(p *LookupPrompter) {
+	r.prompter = p
+}
+
 type csvMappedAcctCfg struct {
 	LedgerAcctName string `mapstructure:"ledger_account_name"`
 	CsvDateFormat  string `mapstructure:"csv_date_format"`
@@ -40,24 +90,200 @@ type csvMappedAcctCfg struct {
 	NoteCols       []int  `mapstructure:"note_cols"`
 	Currency       string `mapstructure:"currency"`
 	HeaderRow      int    `mapstructure:"header_row"`
+
+	// Number format settings used when parsing the money columns
+	DecimalSep     string `mapstructure:"decimal_separator,omitempty"`
+	GroupingSep    string `mapstructure:"grouping_separator,omitempty"`
+	ParensNegative bool   `mapstructure:"parentheses_negative,omitempty"`
+	TrailingSign   bool   `mapstructure:"trailing_sign,omitempty"`
+	CreditDebitSfx bool   `mapstructure:"credit_debit_suffix,omitempty"`
+
+	// CSV dialect settings, see csv_dialect.go
+	Delimiter      string `mapstructure:"delimiter,omitempty"`
+	Comment        string `mapstructure:"comment,omitempty"`
+	LazyQuotes     bool   `mapstructure:"lazy_quotes,omitempty"`
+	VariableFields bool   `mapstructure:"variable_fields,omitempty"`
+	Encoding       string `mapstructure:"encoding,omitempty"`
+
+	// Debit/credit indicator column settings
+	DirectionCol int      `mapstructure:"direction_col,omitempty"`
+	DebitValues  []string `mapstructure:"debit_values,omitempty"`
+	CreditValues []string `mapstructure:"credit_values,omitempty"`
+
+	// Running balance column settings, see csv_balance.go
+	BalanceCol       int    `mapstructure:"balance_col,omitempty"`
+	BalanceAssertion string `mapstructure:"balance_assertion,omitempty"`
+
+	// Columns referenced by their header names, see csv_columns.go
+	DateColName      string   `mapstructure:"date_col_name,omitempty"`
+	DescColName      string   `mapstructure:"desc_col_name,omitempty"`
+	MoneyColNames    []string `mapstructure:"money_col_names,omitempty"`
+	NoteColNames     []string `mapstructure:"note_col_names,omitempty"`
+	DirectionColName string   `mapstructure:"direction_col_name,omitempty"`
+	BalanceColName   string   `mapstructure:"balance_col_name,omitempty"`
+
+	// Preamble, footer, and junk row settings, see csv_skip.go
+	SkipRowsBefore int              `mapstructure:"skip_rows_before,omitempty"`
+	SkipRowsAfter  int              `mapstructure:"skip_rows_after,omitempty"`
+	SkipPatterns   []csvSkipPattern `mapstructure:"skip_patterns,omitempty"`
+
+	// Per-record currency settings, see csv_currency.go
+	CurrencyCol     int               `mapstructure:"currency_col,omitempty"`
+	CurrencyColName string            `mapstructure:"currency_col_name,omitempty"`
+	CurrencyMap     map[string]string `mapstructure:"currency_map,omitempty"`
+
+	// Foreign amount settings, see csv_foreign.go
+	ForeignAmountCol       int    `mapstructure:"foreign_amount_col,omitempty"`
+	ForeignAmountColName   string `mapstructure:"foreign_amount_col_name,omitempty"`
+	ForeignCurrencyCol     int    `mapstructure:"foreign_currency_col,omitempty"`
+	ForeignCurrencyColName string `mapstructure:"foreign_currency_col_name,omitempty"`
+	RateCol                int    `mapstructure:"rate_col,omitempty"`
+	RateColName            string `mapstructure:"rate_col_name,omitempty"`
+
+	// File name patterns used to select this mapping, see csv_batch.go
+	FilePatterns []string `mapstructure:"file_patterns,omitempty"`
+
+	// How long fingerprints are kept in the import history, see
+	// import_history.go
+	ImportHistoryDays int `mapstructure:"import_history_days,omitempty"`
+}
+
+func (c *csvMappedAcctCfg) primaryAccount() string {
+	if c.LedgerAcctName == "" {
+		return "Assets:Bank"
+	}
+	return c.LedgerAcctName
+}
+
+func (c *csvMappedAcctCfg) importHistoryDays() int {
+	if c.ImportHistoryDays == 0 {
+		return CSV_IMPORT_HISTORY_DAYS
+	}
+	return c.ImportHistoryDays
+}
+
+func (c *csvMappedAcctCfg) currency() string {
+	if c.Currency == "" {
+		return "eur"
+	}
+	return c.Currency
+}
+
+func (c *csvMappedAcctCfg) decimalSeparator() rune {
+	if c.DecimalSep == "" {
+		return '.'
+	}
+	ru, _ := utf8.DecodeRuneInString(c.DecimalSep)
+	return ru
+}
+
+func (c *csvMappedAcctCfg) groupingSeparator() rune {
+	if c.GroupingSep == "" {
+		// Default to whichever of "," or "." isn't used as the decimal separator
+		if c.decimalSeparator() == ',' {
+			return '.'
+		}
+		return ','
+	}
+	ru, _ := utf8.DecodeRuneInString(c.GroupingSep)
+	return ru
+}
+
+func (c *csvMappedAcctCfg) validateNumberFormat() error {
+	if utf8.RuneCountInString(c.DecimalSep) > 1 {
+		return fmt.Errorf("The decimal_separator '%s' must be a single character", c.DecimalSep)
+	}
+	if utf8.RuneCountInString(c.GroupingSep) > 1 {
+		return fmt.Errorf("The grouping_separator '%s' must be a single character", c.GroupingSep)
+	}
+
+	dec := c.decimalSeparator()
+	grp := c.groupingSeparator()
+	if dec == grp {
+		return fmt.Errorf("The decimal_separator and grouping_separator cannot both be '%c'", dec)
+	}
+	if unicode.IsDigit(dec) || unicode.IsDigit(grp) || dec == '-' || dec == '+' || grp == '-' || grp == '+' {
+		return fmt.Errorf("Invalid decimal_separator '%c' or grouping_separator '%c'", dec, grp)
+	}
+	return nil
 }
 
 func (r *CSVRunner) GenerateLedgerEntries(csvStream io.Reader, mappedAcct string) error {
-	var lineCtr int = 0
+	return r.GenerateBatchLedgerEntries([]CSVImportJob{{Input: csvStream, Mapping: mappedAcct}})
+}
+
+// GenerateBatchLedgerEntries imports several CSV streams in a single run. The
+// account lookup list is only loaded once, and the state file is only written
+// back once all the streams have been processed.
+func (r *CSVRunner) GenerateBatchLedgerEntries(jobs []CSVImportJob) error {
+	r.summary = csvRunSummary{}
+	batch := &csvBatch{
+		histories: make(map[string]*importHistory),
+		stubbed:   make(map[string]bool),
+	}
 
 	defer func() {
-		if err := r.viper.WriteConfig(); err != nil {
-			r.logger.WithError(err).Warn("Unable to update config file. This may result in duplicate transactions in the next run.")
+		// Persist the import history (and lookup list) even if processing
+		// failed part way through, so that already emitted transactions are
+		// not repeated and interactive answers are not lost
+		if batch.lookupList != nil {
+			if err := batch.lookupList.persistData(); err != nil {
+				r.logger.WithError(err).Errorf("Unable to persist account lookup data key %s", "ledger_account_lookups")
+			}
+		}
+		for _, history := range batch.histories {
+			if err := history.persistData(); err != nil {
+				r.logger.WithError(err).Errorf("Unable to persist import history key %s", history.key)
+			}
+		}
+		if err := r.state.Save(); err != nil {
+			r.logger.WithError(err).Warn("Unable to update the state file. This may result in duplicate transactions in the next run.")
 		}
-		r.progressBar.SetTotal(int64(lineCtr), true)
+		r.progressBar.SetTotal(int64(r.summary.numRecords), true)
 	}()
 
+	lookupList, err := initializeLookupList(r.logger, r.viper, r.state)
+	if err != nil {
+		return err
+	}
+	lookupList.prompter = r.prompter
+	if lookupList.classifier, err = initializeAccountClassifier(r.logger, r.viper, r.learningJournals); err != nil {
+		r.logger.WithError(err).Error("Unable to learn from your existing ledger journals")
+		return err
+	}
+	batch.lookupList = lookupList
+
+	for _, job := range jobs {
+		if err := r.importCSVJob(job, batch); err != nil {
+			if job.Name != "" {
+				r.logger.WithError(err).Errorf("Unable to import CSV file %s", job.Name)
+			}
+			return err
+		}
+	}
+
+	r.logger.Infof("Successfully generated %d ledger transactions from %d CSV file(s) (%d previously imported records skipped, %d rows ignored)", r.summary.numTransactions, r.summary.numFiles, r.summary.numDuplicates, r.summary.numSkipped)
+	return nil
+}
+
+// importCSV imports a single CSV stream as part of a batch
+func (r *CSVRunner) importCSV(job CSVImportJob, batch *csvBatch) error {
+	var lineCtr int = 0
+	csvStream := job.Input
+	mappedAcct := job.Mapping
+	r.logger.Debugf("Importing CSV file %s using the '%s' mapping", job.Name, mappedAcct)
+
 	var mappedCfg csvMappedAcctCfg
 	csvMappedActKey := fmt.Sprintf("csv.account.%s", mappedAcct)
 
-	// generate a stub if the "csv.account.<mappedAct>" value isn't set
+	if batch.stubbed[mappedAcct] {
+		r.logger.Warnf("Skipping CSV file %s until the proposed '%s' configuration key has been added to your config file", job.Name, csvMappedActKey)
+		return nil
+	}
+
+	// propose a stub if the "csv.account.<mappedAct>" value isn't set
 	if !r.viper.IsSet(csvMappedActKey) {
-		r.logger.Warnf("The '%s' configuration key for this CSV file has not been created, so I went ahead and created a generic configuration for you. Look through your config file to make sure it is correct and re-run this program again.", csvMappedActKey)
+		r.logger.Warnf("The '%s' configuration key for this CSV file has not been created, so I went ahead and proposed a configuration for you based on the contents of this file. Look through the proposals file %s, copy the mapping over to your config file, and re-run this program again.", csvMappedActKey, r.state.ProposalsPath())
 		mappedCfg := &csvMappedAcctCfg{
 			LedgerAcctName: "Assets:Bank",
 			CsvDateFormat:  "2-Jan-2006",
@@ -70,13 +296,23 @@ func (r *CSVRunner) GenerateLedgerEntries(csvStream io.Reader, mappedAcct string
 			HeaderRow:      0,
 		}
 
-		var cfg map[string]interface{}
-		err := mapstructure.Decode(mappedCfg, &cfg)
+		// Fall back to the generic configuration above if a mapping cannot be
+		// inferred from the CSV file
+		if rawData, err := ioutil.ReadAll(csvStream); err == nil {
+			if detectedCfg, err := r.detectCSVMapping(rawData); err == nil {
+				mappedCfg = detectedCfg
+			} else {
+				r.logger.WithError(err).Debug("Unable to infer a mapping from this CSV file")
+			}
+		}
+
+		cfg, err := encodeCSVMapping(mappedCfg)
 		if err != nil {
 			r.logger.WithError(err).Errorf("Unable to decode mapped configuration key %s", csvMappedActKey)
 			return nil
 		}
-		r.viper.Set(csvMappedActKey, cfg)
+		r.state.propose(csvMappedActKey, cfg)
+		batch.stubbed[mappedAcct] = true
 		return nil
 	}
 
@@ -86,12 +322,74 @@ func (r *CSVRunner) GenerateLedgerEntries(csvStream io.Reader, mappedAcct string
 	}
 	r.logger.Debugf("Decoded config key %s to val: %#v", csvMappedActKey, mappedCfg)
 
-	lookupList, err := initializeLookupList(r.logger, r.viper)
+	if err := mappedCfg.validateNumberFormat(); err != nil {
+		r.logger.WithError(err).Errorf("Invalid number format in configuration key %s", csvMappedActKey)
+		return err
+	}
+
+	if err := mappedCfg.validateBalanceAssertion(); err != nil {
+		r.logger.WithError(err).Errorf("Invalid balance settings in configuration key %s", csvMappedActKey)
+		return err
+	}
+
+	if err := mappedCfg.validateColumnNames(); err != nil {
+		r.logger.WithError(err).Errorf("Invalid column names in configuration key %s", csvMappedActKey)
+		return err
+	}
+
+	if err := mappedCfg.validateForeignAmount(); err != nil {
+		r.logger.WithError(err).Errorf("Invalid foreign amount settings in configuration key %s", csvMappedActKey)
+		return err
+	}
+
+	skipPatterns, err := mappedCfg.compileSkipPatterns()
+	if err != nil {
+		r.logger.WithError(err).Errorf("Invalid skip settings in configuration key %s", csvMappedActKey)
+		return err
+	}
+
+	if mappedCfg.ImportHistoryDays < 0 {
+		err := fmt.Errorf("Invalid import_history_days value '%d'", mappedCfg.ImportHistoryDays)
+		r.logger.WithError(err).Errorf("Invalid import history settings in configuration key %s", csvMappedActKey)
+		return err
+	}
+
+	// Files imported with the same mapping share their import history, so
+	// that records in overlapping statements are only imported once
+	history, ok := batch.histories[mappedAcct]
+	if !ok {
+		history, err = initializeImportHistory(r.logger, r.viper, r.state, mappedAcct, mappedCfg.importHistoryDays())
+		if err != nil {
+			return err
+		}
+		batch.histories[mappedAcct] = history
+	}
+
+	imp := &csvImport{
+		mappedAcct:    mappedAcct,
+		mappedKey:     csvMappedActKey,
+		cfg:           &mappedCfg,
+		lookupList:    batch.lookupList,
+		history:       history,
+		fingerprinter: newTransactionFingerprinter(mappedAcct),
+		balances:      newDailyBalances(),
+		skipPatterns:  skipPatterns,
+	}
+
+	data, err := mappedCfg.newCSVReader(csvStream)
 	if err != nil {
+		r.logger.WithError(err).Errorf("Invalid CSV dialect in configuration key %s", csvMappedActKey)
 		return err
 	}
 
-	data := csv.NewReader(csvStream)
+	// Records are held back until it is certain that they are not part of the
+	// footer (i.e. the last "skip_rows_after" rows of the file)
+	type pendingRecord struct {
+		record     []string
+		lineNumber int
+	}
+	var pending []pendingRecord
+
 	for {
 		lineCtr++
 		r.progressBar.Increment()
@@ -103,36 +401,72 @@ func (r *CSVRunner) GenerateLedgerEntries(csvStream io.Reader, mappedAcct string
 			r.logger.WithError(err).Error("Unable to process CSV file")
 			return err
 		}
+		r.summary.numRecords++
+
+		pending = append(pending, pendingRecord{record: record, lineNumber: lineCtr})
+		if len(pending) <= mappedCfg.SkipRowsAfter {
+			continue
+		}
 
-		if err := r.processCSVRecord(record, lineCtr, csvMappedActKey, &mappedCfg, lookupList); err != nil {
+		next := pending[0]
+		pending = pending[1:]
+		if err := r.processCSVRecord(next.record, next.lineNumber, imp); err != nil {
 			return err
 		}
 	}
 
-	// Write back the lookup list with any new found values
-	if err := lookupList.persistData(); err != nil {
-		r.logger.WithError(err).Errorf("Unable to persist account lookup data key %s", "ledger_account_lookups")
+	for _, footer := range pending {
+		r.logger.Debugf("Skipping footer record: %#v", footer.record)
+		r.summary.numSkipped++
+	}
+
+	if err := r.writeBalancedCSVEntries(imp); err != nil {
 		return err
 	}
 
-	r.logger.Debug("CSV processing successful")
+	r.summary.numFiles++
 	return nil
 }
 
-func (r *CSVRunner) processCSVRecord(record []string, lineNumber int, mappedKey string, cfg *csvMappedAcctCfg, lookupList *ledgerAccountLookup) error {
+func (r *CSVRunner) processCSVRecord(record []string, lineNumber int, imp *csvImport) error {
+	cfg := imp.cfg
 	r.logger.Debugf("Processing CSV record: %#v Supplied config: %#v", record, cfg)
 
 	if cfg.HeaderRow > 0 && lineNumber == cfg.HeaderRow {
+		if cfg.hasColumnNames() {
+			if err := cfg.resolveColumnNames(record); err != nil {
+				return fmt.Errorf("%s. Verify the column names in the config key '%s'", err, imp.mappedKey)
+			}
+			r.logger.Debugf("Resolved column names using header row: %#v", record)
+		}
 		r.logger.Debugf("Skipping record marked as header row: %#v", record)
 		return nil
 	}
 
+	if cfg.hasColumnNames() && lineNumber < cfg.HeaderRow {
+		// Records above the header row cannot be mapped by column name
+		r.logger.Debugf("Skipping record above the header row: %#v", record)
+		r.summary.numSkipped++
+		return nil
+	}
+
+	if imp.shouldSkipRecord(record, lineNumber) {
+		r.logger.Debugf("Skipping record matching the configured skip rules: %#v", record)
+		r.summary.numSkipped++
+		return nil
+	}
+
 	// Cursory out of bounds checking
 	oobs := []int{cfg.DateCol, cfg.DescCol}
-	oobs = append(oobs, cfg.NoteCols...)
 	oobs = append(oobs, cfg.MoneyCols...)
+	oobs = append(oobs, cfg.DirectionCol, cfg.BalanceCol, cfg.CurrencyCol)
+	oobs = append(oobs, cfg.ForeignAmountCol, cfg.ForeignCurrencyCol, cfg.RateCol)
+	if !cfg.VariableFields {
+		// Records with a variable number of fields may omit trailing note columns
+		oobs = append(oobs, cfg.NoteCols...)
+	}
 	if !doesBasicOOBCheckPass(oobs, len(record)) {
-		return fmt.Errorf("There are currently %d columns in the CSV record '%v'. One of more of the columns specified in the config key '%s' are out of range.", len(record), record, mappedKey)
+		return fmt.Errorf("There are currently %d columns in the CSV record '%v'. One of more of the columns specified in the config key '%s' are out of range.", len(record), record, imp.mappedKey)
 	}
 
 	if cfg.DateCol < 1 {
@@ -144,29 +478,66 @@ func (r *CSVRunner) processCSVRecord(record []string, lineNumber int, mappedKey
 		return err
 	}
 
-	moneyValue, err := r.coerceMoneyValue(record, cfg.MoneyCols)
+	moneyValue, err := r.coerceMoneyValue(record, cfg)
 	if err != nil {
 		r.logger.WithError(err).Errorf("Unable to parse the money value from columns %v. Full CSV record: %v", cfg.MoneyCols, record)
 		return err
 	}
 	r.logger.Debugf("Money coercion result: %v Full CSV record: %#v", moneyValue, record)
 
-	primaryAcctName := cfg.LedgerAcctName
-	if primaryAcctName == "" {
-		primaryAcctName = "Assets:Bank"
-	}
+	primaryAcctName := cfg.primaryAccount()
 
 	if cfg.DescCol < 1 {
 		return fmt.Errorf("Invalid description column '%v'", cfg.DescCol)
 	}
 	description := record[cfg.DescCol-1]
 
-	currency := cfg.Currency
-	if currency == "" {
-		currency = "eur"
+	currency, err := cfg.rowCurrency(record)
+	if err != nil {
+		r.logger.WithError(err).Errorf("Unable to determine the currency. Full CSV record: %v", record)
+		return err
+	}
+
+	var notes []string
+	for _, noteCol := range cfg.NoteCols {
+		if noteCol > 0 && noteCol <= len(record) {
+			notes = append(notes, record[noteCol-1])
+		}
+	}
+
+	var balance *big.Float
+	if cfg.BalanceCol > 0 {
+		balance, err = r.parseRawMoneyValue(record[cfg.BalanceCol-1], false, cfg)
+		if err != nil {
+			r.logger.WithError(err).Errorf("Unable to parse the balance value from column %d. Full CSV record: %v", cfg.BalanceCol, record)
+			return err
+		}
+		if cfg.NegateAmt {
+			balance.Neg(balance)
+		}
+		imp.balances.add(date, currency, balance)
 	}
 
-	acctLookupItem, err := lookupList.getOrAddItem(description, "Expenses:Unknown")
+	fingerprint := imp.fingerprinter.fingerprint(date, moneyValue, cfg.fingerprintCurrency(currency), description, notes)
+	imp.history.track(date)
+	if imp.history.contains(fingerprint) {
+		r.logger.Debugf("Skipping record %#v as it was already imported (fingerprint %s)", record, fingerprint)
+		r.summary.numDuplicates++
+		return nil
+	}
+
+	primaryAmount := moneyValue
+	if cfg.NegateAmt {
+		primaryAmount = Zero().Neg(moneyValue)
+	}
+	acctLookupItem, err := imp.lookupList.getOrAddItem(description, lookupRecord{
+		amount:   primaryAmount,
+		date:     date,
+		notes:    notes,
+		source:   imp.mappedAcct,
+		currency: cfg.isoCurrency(currency),
+		row:      record,
+	}, "Expenses:Unknown")
 	if err != nil {
 		return err
 	}
@@ -204,19 +575,42 @@ func (r *CSVRunner) processCSVRecord(record []string, lineNumber int, mappedKey
 		}
 	}
 
+	if len(acctLookupItem.Splits) > 0 {
+		// Split postings are always booked in the record currency
+		splits, err := splitPostings(acctLookupItem.Splits, transactionLines[1].Amount, currency, cfg.currencyExponent(currency))
+		if err != nil {
+			r.logger.WithError(err).Errorf("Unable to split the record over several accounts. Full CSV record: %v", record)
+			return err
+		}
+		transactionLines = append(transactionLines[:1], splits...)
+	} else if err := r.applyForeignAmount(record, cfg, &transactionLines[1]); err != nil {
+		r.logger.WithError(err).Errorf("Unable to determine the foreign amount. Full CSV record: %v", record)
+		return err
+	}
+
+	for idx := range transactionLines[1:] {
+		acctLookupItem.annotatePosting(&transactionLines[idx+1])
+	}
+
+	if balance != nil && cfg.BalanceAssertion != BALANCE_ASSERTION_DAILY {
+		transactionLines[0].BalanceAssertion = balance
+	}
+
 	tr, err := NewLedgerTransaction(date, acctLookupItem.Description, transactionLines)
 	if err != nil {
 		return err
 	}
 
-	for _, noteCol := range cfg.NoteCols {
-		if noteCol > 0 {
-			tr.AddComment(record[noteCol-1])
-		}
+	for _, note := range notes {
+		tr.AddComment(note)
 	}
-
-	tr.SetDateFormat(r.viper.GetString("date_format_string"))
-	fmt.Fprintln(r.outputWriter, tr.String())
+	acctLookupItem.annotateTransaction(tr)
+	if acctLookupItem.guess != nil {
+		tr.AddKeyValComment(GUESS_COMMENT_KEY, acctLookupItem.guess.String())
+	}
+	tr.AddKeyValComment(FINGERPRINT_COMMENT_KEY, fingerprint)
+	r.writeCSVEntry(imp, date, fingerprint, tr)
+	r.summary.numTransactions++
 
 	return nil
 }
@@ -230,7 +624,8 @@ func doesBasicOOBCheckPass(values []int, recordLength int) bool {
 	return true
 }
 
-func (r *CSVRunner) coerceMoneyValue(record []string, moneyCols []int) (*big.Float, error) {
+func (r *CSVRunner) coerceMoneyValue(record []string, cfg *csvMappedAcctCfg) (*big.Float, error) {
+	moneyCols := cfg.MoneyCols
 	if len(moneyCols) < 1 || len(moneyCols) > 2 {
 		return nil, fmt.Errorf("You should have only 1 or 2 designated 'money_cols'")
 	}
@@ -251,9 +646,9 @@ func (r *CSVRunner) coerceMoneyValue(record []string, moneyCols []int) (*big.Flo
 	var err error
 	if len(moneyCols) == 1 {
 		// Do not automatically negate values in single money column scenarios
-		debit, err = r.parseRawMoneyValue(rawDebitVal, false)
+		debit, err = r.parseRawMoneyValue(rawDebitVal, false, cfg)
 	} else {
-		debit, err = r.parseRawMoneyValue(rawDebitVal, true)
+		debit, err = r.parseRawMoneyValue(rawDebitVal, true, cfg)
 	}
 	if err != nil {
 		return nil, err
@@ -267,7 +662,7 @@ func (r *CSVRunner) coerceMoneyValue(record []string, moneyCols []int) (*big.Flo
 		}
 		rawCreditVal := record[moneyCols[1]-1]
 		r.logger.Debugf("Raw credit value: %v", rawCreditVal)
-		credit, err = r.parseRawMoneyValue(rawCreditVal, false)
+		credit, err = r.parseRawMoneyValue(rawCreditVal, false, cfg)
 		r.logger.Debugf("Parsed credit value: %v", credit)
 		if err != nil {
 			return nil, err
@@ -275,49 +670,173 @@ func (r *CSVRunner) coerceMoneyValue(record []string, moneyCols []int) (*big.Flo
 	}
 
 	// Return the sum of debit & credit
-	return Zero().Add(debit, credit), nil
+	sum := Zero().Add(debit, credit)
+	if cfg.DirectionCol > 0 {
+		return r.applyDirectionIndicator(record, sum, cfg)
+	}
+	return sum, nil
 }
 
-func (r *CSVRunner) parseRawMoneyValue(rawval string, isDebit bool) (*big.Float, error) {
+// applyDirectionIndicator signs the (unsigned) money value based on a
+// debit/credit indicator column, e.g. "D"/"C" or "Af"/"Bij".
+func (r *CSVRunner) applyDirectionIndicator(record []string, value *big.Float, cfg *csvMappedAcctCfg) (*big.Float, error) {
+	debitValues := cfg.DebitValues
+	if len(debitValues) == 0 {
+		debitValues = []string{"D", "DR", "Debit"}
+	}
+	creditValues := cfg.CreditValues
+	if len(creditValues) == 0 {
+		creditValues = []string{"C", "CR", "Credit"}
+	}
+
+	indicator := strings.TrimSpace(record[cfg.DirectionCol-1])
+	r.logger.Debugf("Raw direction indicator: %v", indicator)
+
+	for _, v := range debitValues {
+		if strings.EqualFold(indicator, strings.TrimSpace(v)) {
+			return Zero().Neg(Zero().Abs(value)), nil
+		}
+	}
+	for _, v := range creditValues {
+		if strings.EqualFold(indicator, strings.TrimSpace(v)) {
+			return Zero().Abs(value), nil
+		}
+	}
+
+	return nil, fmt.Errorf("Unrecognized value '%s' in direction column %d. Expected one of the debit_values %v or credit_values %v", indicator, cfg.DirectionCol, debitValues, creditValues)
+}
+
+func (r *CSVRunner) parseRawMoneyValue(rawval string, isDebit bool, cfg *csvMappedAcctCfg) (*big.Float, error) {
+	origVal := rawval
+	rawval = strings.TrimSpace(rawval)
+
 	// Treat empty strings as a 0
 	if len(rawval) < 1 {
 		return Zero(), nil
 	}
 
 	if !utf8.ValidString(rawval) {
-		return nil, fmt.Errorf("Value '%v' does not appear to be a valid money representation", rawval)
+		return nil, fmt.Errorf("Value '%v' does not appear to be a valid money representation", origVal)
 	}
 
-	// Tease out a leading - or + sign (implying positive or negative), if the
-	// string begins with such a value
+	decimalSep := cfg.decimalSeparator()
+	groupingSep := cfg.groupingSeparator()
+
+	// Keep track of every sign indicator in the value. More than one of these
+	// (e.g. "-45.00 DR") is considered ambiguous.
+	var numSigns int = 0
 	var isNegated bool = false
-	var negSign rune = '-'
-	var posSign rune = '+'
-	ru, size := utf8.DecodeRuneInString(rawval)
-	if ru == negSign || ru == posSign {
-		rawval = rawval[size:]
-		if ru == negSign {
-			isNegated = true
+
+	// Split the value into the numeric part (everything between the first and
+	// the last digit) as well as the leading & trailing bits. The leading and
+	// trailing bits contain things like currency symbols and signs.
+	runes := []rune(rawval)
+	start, end := -1, -1
+	for idx, v := range runes {
+		if unicode.IsDigit(v) {
+			if start < 0 {
+				start = idx
+			}
+			end = idx + 1
+		}
+	}
+	if start < 0 {
+		return nil, fmt.Errorf("Value '%v' does not appear to be a valid money representation", origVal)
+	}
+	if start > 0 && runes[start-1] == decimalSep {
+		// Values such as ".50"
+		start--
+	}
+	prefix := runes[:start]
+	numeric := runes[start:end]
+	suffix := runes[end:]
+
+	// Tease out a leading - or + sign (implying positive or negative), as well
+	// as an opening parenthesis. Apart from those, only whitespace and
+	// currency symbols or codes are allowed around the number.
+	var hasOpenParen bool = false
+	for idx := 0; idx < len(prefix); idx++ {
+		v := prefix[idx]
+		switch {
+		case v == '-' || v == '+':
+			numSigns++
+			isNegated = v == '-'
+		case v == '(':
+			hasOpenParen = true
+		case unicode.IsSpace(v) || unicode.Is(unicode.Sc, v):
+		case unicode.IsLetter(v):
+			word := moneyAffixWord(prefix[idx:])
+			idx += len(word) - 1
+			if !cfg.isCurrencyWord(string(word)) {
+				return nil, fmt.Errorf("Value '%v' contains unexpected text '%s'", origVal, string(word))
+			}
+		default:
+			return nil, fmt.Errorf("Value '%v' contains an unexpected character '%c'", origVal, v)
 		}
 	}
 
-	// Debit columns, i.e. on the left, are negated by default
-	if isDebit {
-		isNegated = true
+	// Tease out a trailing - or + sign, a closing parenthesis, as well as a
+	// "CR" or "DR" suffix (e.g. "45.00 DR" or "45.00DR")
+	var hasCloseParen bool = false
+	for idx := 0; idx < len(suffix); idx++ {
+		v := suffix[idx]
+		switch {
+		case v == '-' || v == '+':
+			if !cfg.TrailingSign {
+				return nil, fmt.Errorf("Value '%v' contains a trailing sign, set 'trailing_sign' if this is expected", origVal)
+			}
+			numSigns++
+			isNegated = v == '-'
+		case v == ')':
+			hasCloseParen = true
+		case unicode.IsSpace(v) || unicode.Is(unicode.Sc, v):
+		case unicode.IsLetter(v):
+			word := moneyAffixWord(suffix[idx:])
+			idx += len(word) - 1
+			upper := strings.ToUpper(string(word))
+			switch {
+			case upper == "CR" || upper == "DR":
+				if !cfg.CreditDebitSfx {
+					return nil, fmt.Errorf("Value '%v' contains a CR/DR suffix, set 'credit_debit_suffix' if this is expected", origVal)
+				}
+				numSigns++
+				isNegated = upper == "DR"
+			case !cfg.isCurrencyWord(upper):
+				return nil, fmt.Errorf("Value '%v' contains unexpected text '%s'", origVal, string(word))
+			}
+		default:
+			return nil, fmt.Errorf("Value '%v' contains an unexpected character '%c'", origVal, v)
+		}
 	}
 
-	// Tease out everything except decimal digits (effectively strips currency
-	// symbols, commas, etc)
-	var runeRes []rune
-	for _, v := range []rune(rawval) {
-		if unicode.IsDigit(v) || v == '.' {
-			runeRes = append(runeRes, v)
+	if hasOpenParen || hasCloseParen {
+		if !cfg.ParensNegative {
+			return nil, fmt.Errorf("Value '%v' is wrapped in parentheses, set 'parentheses_negative' if this is expected", origVal)
 		}
+		if !hasOpenParen || !hasCloseParen {
+			return nil, fmt.Errorf("Value '%v' contains unbalanced parentheses", origVal)
+		}
+		numSigns++
+		isNegated = true
+	}
+
+	if numSigns > 1 {
+		return nil, fmt.Errorf("Value '%v' contains more than one sign indicator", origVal)
+	}
+
+	normalized, err := normalizeNumericValue(numeric, decimalSep, groupingSep)
+	if err != nil {
+		return nil, fmt.Errorf("Value '%v' does not appear to be a valid money representation: %v", origVal, err)
+	}
+
+	// Debit columns, i.e. on the left, are negated by default
+	if isDebit {
+		isNegated = true
 	}
 
-	// Now that we have something hopefully resembling a number, try and parse it
-	// into a Float
-	f, _, err := Zero().Parse(string(runeRes), 10)
+	// Now that we have something resembling a number, try and parse it into a
+	// Float
+	f, _, err := Zero().Parse(normalized, 10)
 	if err != nil {
 		return nil, err
 	}
@@ -330,3 +849,69 @@ func (r *CSVRunner) parseRawMoneyValue(rawval string, isDebit bool) (*big.Float,
 
 	return f, nil
 }
+
+// moneyAffixWord returns the run of letters at the start of the supplied text
+func moneyAffixWord(text []rune) []rune {
+	end := 0
+	for end < len(text) && unicode.IsLetter(text[end]) {
+		end++
+	}
+	return text[:end]
+}
+
+// normalizeNumericValue converts a value such as "1.234,56" into "1234.56",
+// rejecting anything where the position of the separators is ambiguous.
+func normalizeNumericValue(numeric []rune, decimalSep rune, groupingSep rune) (string, error) {
+	var intPart []rune
+	var fracPart []rune
+	var groups []int
+	var seenDecimal bool = false
+	var groupLen int = 0
+
+	for _, v := range numeric {
+		switch {
+		case unicode.IsDigit(v):
+			if seenDecimal {
+				fracPart = append(fracPart, v)
+			} else {
+				intPart = append(intPart, v)
+				groupLen++
+			}
+		case v == decimalSep:
+			if seenDecimal {
+				return "", fmt.Errorf("more than one decimal separator '%c'", decimalSep)
+			}
+			seenDecimal = true
+		case v == groupingSep:
+			if seenDecimal {
+				return "", fmt.Errorf("grouping separator '%c' found after the decimal separator '%c'", groupingSep, decimalSep)
+			}
+			groups = append(groups, groupLen)
+			groupLen = 0
+		default:
+			return "", fmt.Errorf("unexpected character '%c'", v)
+		}
+	}
+
+	// Digit groups must look like "1,234,567" - i.e. a leading group of 1 to 3
+	// digits followed by groups of exactly 3 digits
+	if len(groups) > 0 {
+		groups = append(groups, groupLen)
+		if groups[0] < 1 || groups[0] > 3 {
+			return "", fmt.Errorf("misplaced grouping separator '%c'", groupingSep)
+		}
+		for _, g := range groups[1:] {
+			if g != 3 {
+				return "", fmt.Errorf("misplaced grouping separator '%c'", groupingSep)
+			}
+		}
+	}
+
+	if len(intPart) == 0 {
+		intPart = []rune{'0'}
+	}
+	if len(fracPart) == 0 {
+		return string(intPart), nil
+	}
+	return fmt.Sprintf("%s.%s", string(intPart), string(fracPart)), nil
+}
@@ -0,0 +1,192 @@
+package lib
+
+import (
+	"fmt"
+	"math/big"
+	"sort"
+	"strings"
+	"time"
+)
+
+const BALANCE_ASSERTION_POSTING = "posting"
+const BALANCE_ASSERTION_DAILY = "daily"
+
+func (c *csvMappedAcctCfg) validateBalanceAssertion() error {
+	switch c.BalanceAssertion {
+	case "", BALANCE_ASSERTION_POSTING, BALANCE_ASSERTION_DAILY:
+	default:
+		return fmt.Errorf("Invalid balance_assertion value '%s'. Expected one of '%s' or '%s'", c.BalanceAssertion, BALANCE_ASSERTION_POSTING, BALANCE_ASSERTION_DAILY)
+	}
+
+	if c.BalanceCol < 0 {
+		return fmt.Errorf("Invalid balance column '%v'", c.BalanceCol)
+	}
+	return nil
+}
+
+// dailyBalances keeps track of the running balance values seen for each
+// statement day (and currency), in the order they appear in the CSV file.
+type dailyBalances struct {
+	days      []dailyBalanceKey
+	firstSeen map[dailyBalanceKey]*big.Float
+	lastSeen  map[dailyBalanceKey]*big.Float
+}
+
+type dailyBalanceKey struct {
+	date     time.Time
+	currency string
+}
+
+type dailyBalance struct {
+	date     time.Time
+	currency string
+	balance  *big.Float
+}
+
+func newDailyBalances() *dailyBalances {
+	return &dailyBalances{
+		firstSeen: make(map[dailyBalanceKey]*big.Float),
+		lastSeen:  make(map[dailyBalanceKey]*big.Float),
+	}
+}
+
+func (d *dailyBalances) add(date time.Time, currency string, balance *big.Float) {
+	key := dailyBalanceKey{date: date, currency: strings.ToUpper(currency)}
+	if _, ok := d.firstSeen[key]; !ok {
+		d.days = append(d.days, key)
+		d.firstSeen[key] = balance
+	}
+	d.lastSeen[key] = balance
+}
+
+// isNewestFirst reports whether the statement days were listed newest first
+func (d *dailyBalances) isNewestFirst() bool {
+	return len(d.days) > 0 && d.days[0].date.After(d.days[len(d.days)-1].date)
+}
+
+// closingBalances returns the end of day balance for each statement day, in
+// chronological order. Most institutions list transactions either oldest or
+// newest first, the closing balance for a day is the balance of the
+// chronologically last record of that day.
+func (d *dailyBalances) closingBalances() []dailyBalance {
+	var res []dailyBalance
+	isNewestFirst := d.isNewestFirst()
+	for _, key := range d.days {
+		balance := d.lastSeen[key]
+		if isNewestFirst {
+			balance = d.firstSeen[key]
+		}
+		res = append(res, dailyBalance{date: key.date, currency: key.currency, balance: balance})
+	}
+
+	sort.SliceStable(res, func(i, j int) bool {
+		if res[i].date.Equal(res[j].date) {
+			return res[i].currency < res[j].currency
+		}
+		return res[i].date.Before(res[j].date)
+	})
+	return res
+}
+
+// csvEntry is a ledger entry that is held back until the end of the file. Its
+// fingerprint is only added to the import history once it is written out.
+type csvEntry struct {
+	date        time.Time
+	text        string
+	fingerprint string
+}
+
+// writeCSVEntry writes out the ledger entry for a record, and adds its
+// fingerprint to the import history. Ledger checks balance assertions in the
+// order it reads them, so when the file has a balance column the entries are
+// held back and written out in date order once the whole file has been read
+// (see writeBalancedCSVEntries).
+func (r *CSVRunner) writeCSVEntry(imp *csvImport, date time.Time, fingerprint string, tr *LedgerTransaction) {
+	tr.SetDateFormat(r.viper.GetString("date_format_string"))
+	if imp.cfg.BalanceCol < 1 {
+		fmt.Fprintln(r.outputWriter, tr.String())
+		imp.history.add(fingerprint, date)
+		return
+	}
+	imp.entries = append(imp.entries, csvEntry{date: date, text: tr.String(), fingerprint: fingerprint})
+}
+
+// flushCSVEntry writes out a held back entry
+func (r *CSVRunner) flushCSVEntry(imp *csvImport, entry csvEntry) {
+	fmt.Fprintln(r.outputWriter, entry.text)
+	imp.history.add(entry.fingerprint, entry.date)
+}
+
+// writeBalancedCSVEntries writes out the held back entries in date order. In
+// "daily" mode, each day's balance assertion follows the last entry of that
+// day.
+func (r *CSVRunner) writeBalancedCSVEntries(imp *csvImport) error {
+	if imp.cfg.BalanceCol < 1 {
+		return nil
+	}
+
+	// Entries of newest first files are reversed, so that the entries within
+	// a day are in the order of their running balance as well
+	entries := imp.entries
+	if imp.balances.isNewestFirst() {
+		entries = make([]csvEntry, len(imp.entries))
+		for idx, entry := range imp.entries {
+			entries[len(imp.entries)-1-idx] = entry
+		}
+	}
+	sort.SliceStable(entries, func(i, j int) bool {
+		return entries[i].date.Before(entries[j].date)
+	})
+
+	var assertions []csvEntry
+	if imp.cfg.BalanceAssertion == BALANCE_ASSERTION_DAILY {
+		var err error
+		if assertions, err = r.dailyBalanceAssertions(imp); err != nil {
+			return err
+		}
+	}
+
+	for _, entry := range entries {
+		for len(assertions) > 0 && assertions[0].date.Before(entry.date) {
+			r.flushCSVEntry(imp, assertions[0])
+			assertions = assertions[1:]
+		}
+		r.flushCSVEntry(imp, entry)
+	}
+	for _, assertion := range assertions {
+		r.flushCSVEntry(imp, assertion)
+	}
+
+	imp.entries = nil
+	return nil
+}
+
+// dailyBalanceAssertions returns the "Statement Balance" entries for each
+// statement day that was not imported before, in date order
+func (r *CSVRunner) dailyBalanceAssertions(imp *csvImport) ([]csvEntry, error) {
+	var res []csvEntry
+	for _, db := range imp.balances.closingBalances() {
+		fingerprint := imp.fingerprinter.fingerprint(db.date, db.balance, imp.cfg.fingerprintCurrency(db.currency), "Statement Balance", nil)
+		if imp.history.contains(fingerprint) {
+			r.logger.Debugf("Skipping balance assertion for %s as it was already imported (fingerprint %s)", db.date, fingerprint)
+			continue
+		}
+
+		tr, err := NewLedgerTransaction(db.date, "Statement Balance", []TransactionPosting{
+			{
+				Account:          imp.cfg.primaryAccount(),
+				Amount:           Zero(),
+				Currency:         db.currency,
+				BalanceAssertion: db.balance,
+			},
+		})
+		if err != nil {
+			return nil, err
+		}
+		tr.AddKeyValComment(FINGERPRINT_COMMENT_KEY, fingerprint)
+		tr.SetDateFormat(r.viper.GetString("date_format_string"))
+		res = append(res, csvEntry{date: db.date, text: tr.String(), fingerprint: fingerprint})
+	}
+
+	return res, nil
+}
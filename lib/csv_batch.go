@@ -0,0 +1,276 @@
+package lib
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	viperlib "github.com/spf13/viper"
+)
+
+// The input path used to read CSV data from stdin
+const CSV_STDIN_PATH = "-"
+
+// CSVImportJob is a single CSV stream, along with the name of the mapping used
+// to import it. If Input is not set, the CSV file at Path is opened when the
+// job is imported and closed again right after.
+type CSVImportJob struct {
+	Name    string
+	Input   io.Reader
+	Path    string
+	Mapping string
+}
+
+// CSVInput is a CSV file path, along with the name of the mapping used to
+// import it. The mapping is selected using the "file_patterns" of each mapping
+// if it is left empty.
+type CSVInput struct {
+	Path    string
+	Mapping string
+}
+
+// csvBatch holds the state shared by all the CSV files imported in one run
+type csvBatch struct {
+	lookupList *ledgerAccountLookup
+	histories  map[string]*importHistory
+
+	// Mappings that were created during this run
+	stubbed map[string]bool
+}
+
+type csvManifestEntry struct {
+	Mapping string   `mapstructure:"mapping"`
+	Files   []string `mapstructure:"files"`
+}
+
+// ExpandCSVInputs expands the supplied file names, globs, and directories
+// (which include all their *.csv files) into a list of CSV inputs
+func ExpandCSVInputs(paths []string, mapping string) ([]CSVInput, error) {
+	return expandCSVInputs(paths, mapping, "")
+}
+
+func expandCSVInputs(paths []string, mapping string, baseDir string) ([]CSVInput, error) {
+	var res []CSVInput
+	for _, path := range paths {
+		if path != CSV_STDIN_PATH && baseDir != "" && !filepath.IsAbs(path) {
+			path = filepath.Join(baseDir, path)
+		}
+
+		files, err := expandCSVPath(path)
+		if err != nil {
+			return nil, err
+		}
+		for _, file := range files {
+			res = append(res, CSVInput{Path: file, Mapping: mapping})
+		}
+	}
+	return res, nil
+}
+
+func expandCSVPath(path string) ([]string, error) {
+	if path == CSV_STDIN_PATH {
+		return []string{path}, nil
+	}
+
+	if strings.ContainsAny(path, "*?[") {
+		matches, err := filepath.Glob(path)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid CSV file pattern '%s': %v", path, err)
+		}
+
+		var files []string
+		for _, match := range matches {
+			if info, err := os.Stat(match); err == nil && !info.IsDir() {
+				files = append(files, match)
+			}
+		}
+		if len(files) == 0 {
+			return nil, fmt.Errorf("No CSV files match the pattern '%s'", path)
+		}
+		sort.Strings(files)
+		return files, nil
+	}
+
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+	if !info.IsDir() {
+		return []string{path}, nil
+	}
+
+	entries, err := ioutil.ReadDir(path)
+	if err != nil {
+		return nil, err
+	}
+	var files []string
+	for _, entry := range entries {
+		if !entry.IsDir() && strings.EqualFold(filepath.Ext(entry.Name()), ".csv") {
+			files = append(files, filepath.Join(path, entry.Name()))
+		}
+	}
+	if len(files) == 0 {
+		return nil, fmt.Errorf("The directory '%s' does not contain any CSV files", path)
+	}
+	return files, nil
+}
+
+// LoadCSVManifest reads the list of CSV files (and their mappings) declared
+// in a batch manifest. Relative paths are resolved against the directory the
+// manifest is in.
+func LoadCSVManifest(path string) ([]CSVInput, error) {
+	v := viperlib.New()
+	v.SetConfigFile(path)
+	if err := v.ReadInConfig(); err != nil {
+		return nil, err
+	}
+
+	var entries []csvManifestEntry
+	if err := v.UnmarshalKey("imports", &entries); err != nil {
+		return nil, err
+	}
+	if len(entries) == 0 {
+		return nil, fmt.Errorf("The manifest '%s' does not list any imports", path)
+	}
+
+	var res []CSVInput
+	for idx, entry := range entries {
+		if len(entry.Files) == 0 {
+			return nil, fmt.Errorf("Import #%d in the manifest '%s' does not list any files", idx+1, path)
+		}
+		inputs, err := expandCSVInputs(entry.Files, entry.Mapping, filepath.Dir(path))
+		if err != nil {
+			return nil, err
+		}
+		res = append(res, inputs...)
+	}
+	return res, nil
+}
+
+// ImportCSVFiles imports all the supplied CSV files in a single run. Inputs
+// without a mapping are matched against the "file_patterns" of the configured
+// mappings.
+func (r *CSVRunner) ImportCSVFiles(inputs []CSVInput, stdin io.Reader) error {
+	var jobs []CSVImportJob
+	seen := make(map[string]bool)
+
+	for _, inp := range inputs {
+		path := inp.Path
+		if path != CSV_STDIN_PATH {
+			path = filepath.Clean(path)
+		}
+		if seen[path] {
+			r.logger.Debugf("Skipping CSV file %s as it was already listed", path)
+			continue
+		}
+		seen[path] = true
+
+		mapping := inp.Mapping
+		if mapping == "" {
+			if path == CSV_STDIN_PATH {
+				return fmt.Errorf("A mapping needs to be specified in order to read CSV data from stdin")
+			}
+
+			var err error
+			mapping, err = r.selectCSVMapping(path)
+			if err != nil {
+				return err
+			}
+		}
+
+		if path == CSV_STDIN_PATH {
+			jobs = append(jobs, CSVImportJob{Name: "stdin", Input: stdin, Mapping: mapping})
+			continue
+		}
+
+		jobs = append(jobs, CSVImportJob{Name: path, Path: path, Mapping: mapping})
+	}
+
+	return r.GenerateBatchLedgerEntries(jobs)
+}
+
+// importCSVJob imports a single job as part of a batch, opening (and closing)
+// its CSV file if needed
+func (r *CSVRunner) importCSVJob(job CSVImportJob, batch *csvBatch) error {
+	if job.Input != nil {
+		return r.importCSV(job, batch)
+	}
+
+	csvData, err := os.Open(job.Path)
+	if err != nil {
+		r.logger.WithError(err).Errorf("Unable to open CSV file %s", job.Path)
+		return err
+	}
+	defer csvData.Close()
+
+	job.Input = csvData
+	return r.importCSV(job, batch)
+}
+
+// selectCSVMapping finds the mapping whose "file_patterns" match the supplied
+// file.
+func (r *CSVRunner) selectCSVMapping(path string) (string, error) {
+	var mappings []string
+	for mapping := range r.viper.GetStringMap("csv.account") {
+		mappings = append(mappings, mapping)
+	}
+	sort.Strings(mappings)
+
+	var matches []string
+	for _, mapping := range mappings {
+		var mappedCfg csvMappedAcctCfg
+		csvMappedActKey := fmt.Sprintf("csv.account.%s", mapping)
+		if err := r.viper.UnmarshalKey(csvMappedActKey, &mappedCfg); err != nil {
+			r.logger.WithError(err).Errorf("Unable to decode configuration key %s", csvMappedActKey)
+			return "", err
+		}
+
+		for _, pattern := range mappedCfg.FilePatterns {
+			isMatch, err := matchFilePattern(pattern, path)
+			if err != nil {
+				return "", fmt.Errorf("Invalid file pattern '%s' in configuration key %s: %v", pattern, csvMappedActKey, err)
+			}
+			if isMatch {
+				matches = append(matches, mapping)
+				break
+			}
+		}
+	}
+
+	switch len(matches) {
+	case 0:
+		return "", fmt.Errorf("None of the CSV mappings match the file %s. Either specify a mapping, or add a matching 'file_patterns' entry to one of your mappings", path)
+	case 1:
+		r.logger.Debugf("Selected the '%s' mapping for CSV file %s", matches[0], path)
+		return matches[0], nil
+	default:
+		return "", fmt.Errorf("The CSV file %s matches more than one mapping: %s", path, strings.Join(matches, ", "))
+	}
+}
+
+// matchFilePattern matches a file against a glob pattern. Absolute patterns
+// are matched against the absolute path of the file, while relative patterns
+// are matched against the trailing components of its path. For example,
+// "amro/*.csv" matches "statements/amro/2021-01.csv".
+func matchFilePattern(pattern string, path string) (bool, error) {
+	pattern = filepath.ToSlash(pattern)
+	if strings.HasPrefix(pattern, "/") {
+		absPath, err := filepath.Abs(path)
+		if err != nil {
+			return false, err
+		}
+		return filepath.Match(pattern, filepath.ToSlash(absPath))
+	}
+
+	components := strings.Split(filepath.ToSlash(path), "/")
+	numComponents := strings.Count(pattern, "/") + 1
+	if numComponents > len(components) {
+		return false, nil
+	}
+	target := strings.Join(components[len(components)-numComponents:], "/")
+	return filepath.Match(pattern, target)
+}
@@ -0,0 +1,154 @@
+package lib
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/stretchr/testify/assert"
+	"io/ioutil"
+	"strings"
+	"testing"
+
+	log "github.com/sirupsen/logrus"
+	afero "github.com/spf13/afero"
+	viperlib "github.com/spf13/viper"
+)
+
+func TestCSVBatchImport(t *testing.T) {
+	type test struct {
+		name        string
+		skipTest    bool
+		inpManifest string
+		inpPaths    []string
+		inpMapping  string
+		inpStdin    string
+		expOutput   string
+		expError    error
+	}
+
+	tests := []test{
+		{
+			name:        "imports the files listed in a manifest",
+			skipTest:    false,
+			inpManifest: "testdata/csv/batch/manifest.yml",
+			expOutput:   "testdata/csv/batch/batch.ledger",
+			expError:    nil,
+		},
+		{
+			name:      "selects mappings using file patterns",
+			skipTest:  false,
+			inpPaths:  []string{"testdata/csv/batch"},
+			expOutput: "testdata/csv/batch/batch.ledger",
+			expError:  nil,
+		},
+		{
+			name:       "reads from stdin",
+			skipTest:   false,
+			inpPaths:   []string{"-"},
+			inpMapping: "bank",
+			inpStdin:   "\"Date\",\"Note\",\"Amount\"\n\"2021/2/3\",\"GROCERIES\",\"-23.45\"\n",
+			expOutput:  "testdata/csv/batch/stdin.ledger",
+			expError:   nil,
+		},
+		{
+			name:      "requires a mapping to read from stdin",
+			skipTest:  false,
+			inpPaths:  []string{"-"},
+			inpStdin:  "\"Date\",\"Note\",\"Amount\"\n\"2021/2/3\",\"GROCERIES\",\"-23.45\"\n",
+			expOutput: "testdata/stripe/empty-response.ledger",
+			expError:  fmt.Errorf("expect an error here"),
+		},
+		{
+			name:      "errors out on files that do not match any mapping",
+			skipTest:  false,
+			inpPaths:  []string{"testdata/csv/basic-record.csv"},
+			expOutput: "testdata/stripe/empty-response.ledger",
+			expError:  fmt.Errorf("expect an error here"),
+		},
+		{
+			name:      "errors out on globs that do not match any files",
+			skipTest:  false,
+			inpPaths:  []string{"testdata/csv/batch/*.tsv"},
+			expOutput: "testdata/stripe/empty-response.ledger",
+			expError:  fmt.Errorf("expect an error here"),
+		},
+		{
+			name:        "errors out on manifest entries without any files",
+			skipTest:    false,
+			inpManifest: "testdata/csv/batch/bad-manifest.yml",
+			expOutput:   "testdata/stripe/empty-response.ledger",
+			expError:    fmt.Errorf("expect an error here"),
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			if tc.skipTest {
+				t.Skip(fmt.Sprintf("Skipping test: %s", tc.name))
+			}
+
+			appFs := afero.NewMemMapFs()
+			v := viperlib.New()
+			v.SetFs(appFs)
+			v.SetDefault("date_format_string", "2006-01-02")
+			v.SetConfigName("slcconfig")
+			v.AddConfigPath("/")
+			afero.WriteFile(appFs, "/slcconfig.yml", []byte("---"), 0644)
+			v.ReadInConfig()
+			v.Set("csv.account.bank", &csvMappedAcctCfg{
+				LedgerAcctName: "Assets:Bank",
+				CsvDateFormat:  "2006/1/2",
+				DateCol:        1,
+				DescCol:        2,
+				MoneyCols:      []int{3},
+				NegateAmt:      false,
+				NoteCols:       []int{},
+				Currency:       "eur",
+				HeaderRow:      1,
+				FilePatterns:   []string{"bank-*.csv"},
+			})
+			v.Set("csv.account.visa", &csvMappedAcctCfg{
+				LedgerAcctName:     "Liabilities:Visa",
+				CsvDateFormat:      "2006-01-02",
+				DateCol:            1,
+				DescCol:            2,
+				MoneyCols:          []int{3},
+				NegateAmt:          false,
+				NoteCols:           []int{},
+				Currency:           "cad",
+				HeaderRow:          1,
+				ForeignAmountCol:   4,
+				ForeignCurrencyCol: 5,
+				FilePatterns:       []string{"batch/visa-*.csv"},
+			})
+			v.Set("ledger_account_lookups", &[]lookupItem{})
+
+			var logger = log.WithFields(log.Fields{"name": "slc-testing"})
+			var output bytes.Buffer
+			bar := &StubProgressBar{}
+			runner := NewCSVRunner(&output, v, logger, bar)
+
+			expOutput, err := ioutil.ReadFile(tc.expOutput)
+			if err != nil {
+				t.Fatalf("Unable to read expected output file %s", tc.expOutput)
+			}
+
+			var inputs []CSVInput
+			if tc.inpManifest != "" {
+				inputs, err = LoadCSVManifest(tc.inpManifest)
+			} else {
+				inputs, err = ExpandCSVInputs(tc.inpPaths, tc.inpMapping)
+			}
+
+			result := err
+			if err == nil {
+				result = runner.ImportCSVFiles(inputs, strings.NewReader(tc.inpStdin))
+			}
+			if tc.expError != nil {
+				assert.NotNil(t, result)
+			} else {
+				assert.Nil(t, result)
+			}
+			assert.Equal(t, string(expOutput), output.String())
+		})
+	}
+}
@@ -0,0 +1,154 @@
+package lib
+
+import (
+	"fmt"
+	"strings"
+)
+
+func (c *csvMappedAcctCfg) hasColumnNames() bool {
+	for _, sp := range c.SkipPatterns {
+		if sp.ColumnName != "" {
+			return true
+		}
+	}
+	return c.DateColName != "" || c.DescColName != "" || len(c.MoneyColNames) > 0 ||
+		len(c.NoteColNames) > 0 || c.DirectionColName != "" || c.BalanceColName != "" ||
+		c.CurrencyColName != "" || c.ForeignAmountColName != "" || c.ForeignCurrencyColName != "" ||
+		c.RateColName != ""
+}
+
+func (c *csvMappedAcctCfg) validateColumnNames() error {
+	if !c.hasColumnNames() {
+		return nil
+	}
+
+	if c.HeaderRow < 1 {
+		return fmt.Errorf("A 'header_row' is needed in order to reference columns by name")
+	}
+
+	conflicts := []struct {
+		indexKey string
+		nameKey  string
+		hasIndex bool
+		hasName  bool
+	}{
+		{"date_col", "date_col_name", c.DateCol != 0, c.DateColName != ""},
+		{"desc_col", "desc_col_name", c.DescCol != 0, c.DescColName != ""},
+		{"money_cols", "money_col_names", len(c.MoneyCols) > 0, len(c.MoneyColNames) > 0},
+		{"note_cols", "note_col_names", len(c.NoteCols) > 0, len(c.NoteColNames) > 0},
+		{"direction_col", "direction_col_name", c.DirectionCol != 0, c.DirectionColName != ""},
+		{"balance_col", "balance_col_name", c.BalanceCol != 0, c.BalanceColName != ""},
+		{"currency_col", "currency_col_name", c.CurrencyCol != 0, c.CurrencyColName != ""},
+		{"foreign_amount_col", "foreign_amount_col_name", c.ForeignAmountCol != 0, c.ForeignAmountColName != ""},
+		{"foreign_currency_col", "foreign_currency_col_name", c.ForeignCurrencyCol != 0, c.ForeignCurrencyColName != ""},
+		{"rate_col", "rate_col_name", c.RateCol != 0, c.RateColName != ""},
+	}
+	for _, col := range conflicts {
+		if col.hasIndex && col.hasName {
+			return fmt.Errorf("Only one of '%s' or '%s' can be specified", col.indexKey, col.nameKey)
+		}
+	}
+	return nil
+}
+
+// resolveColumnNames looks up any columns referenced by name in the supplied
+// header record and fills in the corresponding column indexes. Header names
+// are matched case-insensitively, ignoring any surrounding whitespace.
+func (c *csvMappedAcctCfg) resolveColumnNames(header []string) error {
+	indexes := make(map[string]int)
+	duplicates := make(map[string]bool)
+	for idx, val := range header {
+		key := normalizeColumnName(val)
+		if _, ok := indexes[key]; ok {
+			duplicates[key] = true
+			continue
+		}
+		indexes[key] = idx + 1
+	}
+
+	lookup := func(name string) (int, error) {
+		key := normalizeColumnName(name)
+		if duplicates[key] {
+			return 0, fmt.Errorf("The column '%s' appears more than once in the CSV header", name)
+		}
+		col, ok := indexes[key]
+		if !ok {
+			return 0, fmt.Errorf("The column '%s' could not be found in the CSV header %v", name, header)
+		}
+		return col, nil
+	}
+
+	var err error
+	if c.DateColName != "" {
+		if c.DateCol, err = lookup(c.DateColName); err != nil {
+			return err
+		}
+	}
+	if c.DescColName != "" {
+		if c.DescCol, err = lookup(c.DescColName); err != nil {
+			return err
+		}
+	}
+	if c.DirectionColName != "" {
+		if c.DirectionCol, err = lookup(c.DirectionColName); err != nil {
+			return err
+		}
+	}
+	if c.BalanceColName != "" {
+		if c.BalanceCol, err = lookup(c.BalanceColName); err != nil {
+			return err
+		}
+	}
+	if len(c.MoneyColNames) > 0 {
+		c.MoneyCols = []int{}
+		for _, name := range c.MoneyColNames {
+			col, err := lookup(name)
+			if err != nil {
+				return err
+			}
+			c.MoneyCols = append(c.MoneyCols, col)
+		}
+	}
+	if c.CurrencyColName != "" {
+		if c.CurrencyCol, err = lookup(c.CurrencyColName); err != nil {
+			return err
+		}
+	}
+	if c.ForeignAmountColName != "" {
+		if c.ForeignAmountCol, err = lookup(c.ForeignAmountColName); err != nil {
+			return err
+		}
+	}
+	if c.ForeignCurrencyColName != "" {
+		if c.ForeignCurrencyCol, err = lookup(c.ForeignCurrencyColName); err != nil {
+			return err
+		}
+	}
+	if c.RateColName != "" {
+		if c.RateCol, err = lookup(c.RateColName); err != nil {
+			return err
+		}
+	}
+	for idx, sp := range c.SkipPatterns {
+		if sp.ColumnName != "" {
+			if c.SkipPatterns[idx].Column, err = lookup(sp.ColumnName); err != nil {
+				return err
+			}
+		}
+	}
+	if len(c.NoteColNames) > 0 {
+		c.NoteCols = []int{}
+		for _, name := range c.NoteColNames {
+			col, err := lookup(name)
+			if err != nil {
+				return err
+			}
+			c.NoteCols = append(c.NoteCols, col)
+		}
+	}
+	return nil
+}
+
+func normalizeColumnName(name string) string {
+	return strings.ToLower(strings.TrimSpace(name))
+}
@@ -0,0 +1,92 @@
+package lib
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+	"unicode"
+)
+
+var isoCurrencyRgx = regexp.MustCompile(`^[A-Za-z]{3}$`)
+
+// rowCurrency returns the commodity for a single CSV record. Mappings without
+// a currency column (or records with an empty currency value) use the
+// configured "currency" for all postings.
+func (c *csvMappedAcctCfg) rowCurrency(record []string) (string, error) {
+	if c.CurrencyCol < 1 {
+		return c.currency(), nil
+	}
+
+	rawval := strings.TrimSpace(record[c.CurrencyCol-1])
+	if rawval == "" {
+		return c.currency(), nil
+	}
+	return c.lookupCurrency(rawval, c.CurrencyCol)
+}
+
+// lookupCurrency maps a currency value from the specified column to its ledger
+// commodity
+func (c *csvMappedAcctCfg) lookupCurrency(rawval string, col int) (string, error) {
+	// Map keys are lowercased when the config file is read, so these are
+	// matched case-insensitively
+	for symbol, commodity := range c.CurrencyMap {
+		if strings.EqualFold(symbol, rawval) {
+			return commodity, nil
+		}
+	}
+
+	if isoCurrencyRgx.MatchString(rawval) {
+		return rawval, nil
+	}
+	return "", fmt.Errorf("Unrecognized currency '%s' in column %d. Add it to the 'currency_map' setting to specify the ledger commodity it represents", rawval, col)
+}
+
+// isoCurrency returns the ISO currency code of a commodity, or an empty string
+// if it is not known. Commodities from the "currency_map" setting (e.g. "$")
+// are resolved back to the ISO currency code they are mapped from (e.g. "USD").
+func (c *csvMappedAcctCfg) isoCurrency(commodity string) string {
+	if isoCurrencyRgx.MatchString(commodity) {
+		return strings.ToUpper(commodity)
+	}
+	for symbol, mapped := range c.CurrencyMap {
+		if mapped == commodity && isoCurrencyRgx.MatchString(symbol) {
+			return strings.ToUpper(symbol)
+		}
+	}
+	return ""
+}
+
+// currencyExponent returns the number of decimals in the minor unit of a
+// commodity
+func (c *csvMappedAcctCfg) currencyExponent(commodity string) int {
+	return currencyExponent(c.isoCurrency(commodity))
+}
+
+// isCurrencyWord reports whether a word next to a money value (e.g. the "EUR"
+// in "EUR 1.234,56") is the configured currency, or part of one of the values
+// in the "currency_map" setting
+func (c *csvMappedAcctCfg) isCurrencyWord(word string) bool {
+	candidates := []string{c.currency()}
+	for symbol, commodity := range c.CurrencyMap {
+		candidates = append(candidates, symbol, commodity)
+	}
+
+	for _, candidate := range candidates {
+		for _, field := range strings.FieldsFunc(candidate, func(r rune) bool { return !unicode.IsLetter(r) }) {
+			if strings.EqualFold(field, word) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// fingerprintCurrency returns the commodity to include in a transaction
+// fingerprint. This is only done for multi-currency mappings, which keeps the
+// fingerprints of single currency imports stable.
+func (c *csvMappedAcctCfg) fingerprintCurrency(currency string) string {
+	if c.CurrencyCol < 1 {
+		return ""
+	}
+	return strings.ToUpper(currency)
+}
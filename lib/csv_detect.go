@@ -0,0 +1,663 @@
+package lib
+
+import (
+	"bytes"
+	"encoding/csv"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/big"
+	"regexp"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	mapstructure "github.com/mitchellh/mapstructure"
+	charmap "golang.org/x/text/encoding/charmap"
+	unicode "golang.org/x/text/encoding/unicode"
+	transform "golang.org/x/text/transform"
+	yaml "gopkg.in/yaml.v2"
+)
+
+// The maximum number of CSV records used to infer a mapping
+const CSV_DETECT_SAMPLE_SIZE = 100
+
+// The number of transactions shown when previewing a detected mapping
+const CSV_DETECT_PREVIEW_SIZE = 5
+
+var csvDetectDelimiters = []string{",", ";", "\t", "|"}
+
+// Date layouts tried (in order) when looking for date columns. Where a column
+// could be parsed by more than one layout (e.g. 01/02/2006 vs 02/01/2006), the
+// first one wins.
+var csvDetectDateLayouts = []string{
+	"2006-01-02",
+	"2006/01/02",
+	"2006/1/2",
+	"20060102",
+	"01/02/2006",
+	"1/2/2006",
+	"02/01/2006",
+	"2/1/2006",
+	"02.01.2006",
+	"2.1.2006",
+	"02-01-2006",
+	"01-02-2006",
+	"2-Jan-2006",
+	"02-Jan-2006",
+	"2 Jan 2006",
+	"02 Jan 2006",
+	"Jan 2, 2006",
+	"2-Jan-06",
+	"02-Jan-06",
+	"01/02/06",
+	"02/01/06",
+	"02.01.06",
+	"2006-01-02 15:04:05",
+	"2006-01-02T15:04:05",
+}
+
+var csvDetectFractionRgx = regexp.MustCompile(`[.,][0-9]{2}([^0-9]|$)`)
+
+var csvDetectCurrencies = []struct {
+	symbol   string
+	currency string
+}{
+	{"€", "eur"},
+	{"£", "gbp"},
+	{"¥", "jpy"},
+	{"EUR", "eur"},
+	{"USD", "usd"},
+	{"GBP", "gbp"},
+	{"CAD", "cad"},
+	{"AUD", "aud"},
+	{"CHF", "chf"},
+	{"NZD", "nzd"},
+}
+
+// DetectMapping infers a CSV mapping from a sample file, proposes it as the
+// "csv.account.<mappedAcct>" config key (if not already present), and writes a
+// preview of the first few generated ledger transactions.
+func (r *CSVRunner) DetectMapping(csvStream io.Reader, mappedAcct string) error {
+	var isProposed bool = false
+	csvMappedActKey := fmt.Sprintf("csv.account.%s", mappedAcct)
+
+	defer func() {
+		if isProposed {
+			if err := r.state.Save(); err != nil {
+				r.logger.WithError(err).Warn("Unable to update the proposals file")
+			}
+		}
+		r.progressBar.SetTotal(r.progressBar.Current(), true)
+	}()
+
+	rawData, err := ioutil.ReadAll(csvStream)
+	if err != nil {
+		r.logger.WithError(err).Error("Unable to read CSV file")
+		return err
+	}
+
+	mappedCfg, err := r.detectCSVMapping(rawData)
+	if err != nil {
+		r.logger.WithError(err).Error("Unable to infer a mapping from this CSV file")
+		return err
+	}
+
+	cfg, err := encodeCSVMapping(mappedCfg)
+	if err != nil {
+		r.logger.WithError(err).Errorf("Unable to decode mapped configuration key %s", csvMappedActKey)
+		return err
+	}
+
+	if r.viper.IsSet(csvMappedActKey) {
+		r.logger.Warnf("The '%s' configuration key already exists and has not been modified. Copy over any of the proposed values you would like to use.", csvMappedActKey)
+	} else {
+		r.logger.Infof("Proposed the '%s' configuration key in %s. Copy it over to your config file once you are happy with the preview.", csvMappedActKey, r.state.ProposalsPath())
+		r.state.propose(csvMappedActKey, cfg)
+		isProposed = true
+	}
+
+	proposal, err := yaml.Marshal(map[string]interface{}{
+		"csv": map[string]interface{}{
+			"account": map[string]interface{}{
+				mappedAcct: cfg,
+			},
+		},
+	})
+	if err != nil {
+		return err
+	}
+
+	fmt.Fprintf(r.outputWriter, "; Proposed configuration for the '%s' mapping:\n;\n", mappedAcct)
+	for _, line := range strings.Split(strings.TrimRight(string(proposal), "\n"), "\n") {
+		fmt.Fprintf(r.outputWriter, ";   %s\n", line)
+	}
+	fmt.Fprintf(r.outputWriter, ";\n; Preview of the first %d transactions:\n\n", CSV_DETECT_PREVIEW_SIZE)
+
+	return r.previewMapping(rawData, mappedAcct, mappedCfg)
+}
+
+// previewMapping writes out the first few transactions using the supplied
+// mapping, without persisting any lookup or import history changes.
+func (r *CSVRunner) previewMapping(rawData []byte, mappedAcct string, mappedCfg *csvMappedAcctCfg) error {
+	lookupList, err := initializeLookupList(r.logger, r.viper, r.state)
+	if err != nil {
+		return err
+	}
+
+	history, err := initializeImportHistory(r.logger, r.viper, r.state, mappedAcct, mappedCfg.importHistoryDays())
+	if err != nil {
+		return err
+	}
+
+	imp := &csvImport{
+		mappedAcct:    mappedAcct,
+		mappedKey:     fmt.Sprintf("csv.account.%s", mappedAcct),
+		cfg:           mappedCfg,
+		lookupList:    lookupList,
+		history:       history,
+		fingerprinter: newTransactionFingerprinter(mappedAcct),
+		balances:      newDailyBalances(),
+	}
+
+	data, err := mappedCfg.newCSVReader(bytes.NewReader(rawData))
+	if err != nil {
+		return err
+	}
+
+	for lineCtr := 1; r.summary.numTransactions < CSV_DETECT_PREVIEW_SIZE; lineCtr++ {
+		record, err := data.Read()
+		if err != nil {
+			if err == io.EOF {
+				break
+			}
+			return err
+		}
+
+		if err := r.processCSVRecord(record, lineCtr, imp); err != nil {
+			return err
+		}
+	}
+
+	return r.writeBalancedCSVEntries(imp)
+}
+
+func encodeCSVMapping(mappedCfg *csvMappedAcctCfg) (map[string]interface{}, error) {
+	var cfg map[string]interface{}
+	if err := mapstructure.Decode(mappedCfg, &cfg); err != nil {
+		return nil, err
+	}
+	return cfg, nil
+}
+
+// detectCSVMapping sniffs the encoding, delimiter, header row, and column
+// types of the supplied CSV data in order to propose a mapping for it.
+func (r *CSVRunner) detectCSVMapping(rawData []byte) (*csvMappedAcctCfg, error) {
+	mappedCfg := &csvMappedAcctCfg{
+		LedgerAcctName: "Assets:Bank",
+		NegateAmt:      false,
+		NoteCols:       []int{},
+		Currency:       "eur",
+	}
+
+	text, encodingName, err := detectCSVEncoding(rawData)
+	if err != nil {
+		return nil, err
+	}
+	mappedCfg.Encoding = encodingName
+
+	records, delimiter, isLazy, err := detectCSVDelimiter(text)
+	if err != nil {
+		return nil, err
+	}
+	if delimiter != "," {
+		mappedCfg.Delimiter = delimiter
+		if delimiter == "\t" {
+			mappedCfg.Delimiter = "tab"
+		}
+	}
+	mappedCfg.LazyQuotes = isLazy
+
+	// Only consider records that have the most common number of fields
+	numFields := modalFieldCount(records)
+	var sample [][]string
+	for _, record := range records {
+		if len(record) == numFields {
+			sample = append(sample, record)
+		}
+	}
+	if len(sample) != len(records) {
+		mappedCfg.VariableFields = true
+	}
+
+	// Infer the column types without considering the first record, as this
+	// may very well be a header row
+	data := sample
+	if len(sample) > 1 {
+		data = sample[1:]
+	}
+
+	dateCol, dateFormat := detectDateColumn(data, numFields)
+	if dateCol < 1 {
+		return nil, fmt.Errorf("Unable to find a column containing dates")
+	}
+	mappedCfg.DateCol = dateCol
+	mappedCfg.CsvDateFormat = dateFormat
+
+	if len(sample) > 1 {
+		if _, err := time.Parse(dateFormat, strings.TrimSpace(sample[0][dateCol-1])); err != nil {
+			mappedCfg.HeaderRow = 1
+		} else {
+			data = sample
+		}
+	}
+
+	moneyCols := r.detectMoneyColumns(data, numFields, dateCol, mappedCfg)
+	if len(moneyCols) < 1 {
+		return nil, fmt.Errorf("Unable to find a column containing money values")
+	}
+
+	usedCols := map[int]bool{dateCol: true}
+	mappedCfg.MoneyCols = []int{moneyCols[0]}
+	if pair := r.findDebitCreditPair(data, moneyCols, mappedCfg); pair != nil {
+		mappedCfg.MoneyCols = pair
+	}
+	for _, col := range mappedCfg.MoneyCols {
+		usedCols[col] = true
+	}
+
+	if len(mappedCfg.MoneyCols) == 1 && !isSignedColumn(data, mappedCfg.MoneyCols[0]) {
+		if col := detectDirectionColumn(data, numFields, usedCols); col > 0 {
+			mappedCfg.DirectionCol = col
+			usedCols[col] = true
+		}
+	}
+
+	for _, col := range moneyCols {
+		if !usedCols[col] && r.isRunningBalance(data, col, mappedCfg) {
+			mappedCfg.BalanceCol = col
+			usedCols[col] = true
+			break
+		}
+	}
+
+	// The description is assumed to be the longest text column, anything else
+	// that varies from record to record is added as a note
+	var longestAvg int = -1
+	for col := 1; col <= numFields; col++ {
+		if usedCols[col] || moneyColsContains(moneyCols, col) {
+			continue
+		}
+		if avg := averageLength(data, col); avg > longestAvg {
+			longestAvg = avg
+			mappedCfg.DescCol = col
+		}
+	}
+	if mappedCfg.DescCol < 1 {
+		return nil, fmt.Errorf("Unable to find a column containing descriptions")
+	}
+	usedCols[mappedCfg.DescCol] = true
+
+	for col := 1; col <= numFields; col++ {
+		if usedCols[col] || moneyColsContains(moneyCols, col) {
+			continue
+		}
+		if columnDateLayout(data, col) != "" {
+			continue
+		}
+		if isVaryingColumn(data, col) {
+			mappedCfg.NoteCols = append(mappedCfg.NoteCols, col)
+		}
+	}
+
+	if currency := detectCurrency(data, mappedCfg.MoneyCols); currency != "" {
+		mappedCfg.Currency = currency
+	}
+
+	r.logger.Debugf("Detected CSV mapping: %#v", mappedCfg)
+	return mappedCfg, nil
+}
+
+func detectCSVEncoding(rawData []byte) (string, string, error) {
+	if bytes.HasPrefix(rawData, []byte{0xff, 0xfe}) || bytes.HasPrefix(rawData, []byte{0xfe, 0xff}) {
+		encodingName := "utf-16le"
+		if rawData[0] == 0xfe {
+			encodingName = "utf-16be"
+		}
+		decoded, _, err := transform.Bytes(unicode.BOMOverride(unicode.UTF8.NewDecoder()), rawData)
+		if err != nil {
+			return "", "", err
+		}
+		return string(decoded), encodingName, nil
+	}
+
+	rawData = bytes.TrimPrefix(rawData, []byte{0xef, 0xbb, 0xbf})
+	if utf8.Valid(rawData) {
+		return string(rawData), "", nil
+	}
+
+	// Anything that isn't valid UTF-8 is most likely Windows-1252 (a superset
+	// of Latin-1) encoded
+	decoded, err := charmap.Windows1252.NewDecoder().Bytes(rawData)
+	if err != nil {
+		return "", "", err
+	}
+	return string(decoded), "windows-1252", nil
+}
+
+// detectCSVDelimiter picks the delimiter that splits the most records into
+// the same (greater than one) number of fields.
+func detectCSVDelimiter(text string) ([][]string, string, bool, error) {
+	var bestRecords [][]string
+	var bestDelimiter string
+	var bestIsLazy bool
+	var bestScore int = 0
+
+	for _, isLazy := range []bool{false, true} {
+		for _, delimiter := range csvDetectDelimiters {
+			reader := csv.NewReader(strings.NewReader(text))
+			reader.Comma, _ = utf8.DecodeRuneInString(delimiter)
+			reader.LazyQuotes = isLazy
+			reader.FieldsPerRecord = -1
+
+			var records [][]string
+			var err error
+			for len(records) < CSV_DETECT_SAMPLE_SIZE {
+				var record []string
+				record, err = reader.Read()
+				if err != nil {
+					break
+				}
+				records = append(records, record)
+			}
+			if err != nil && err != io.EOF {
+				continue
+			}
+
+			numFields := modalFieldCount(records)
+			if numFields < 2 {
+				continue
+			}
+
+			var score int = 0
+			for _, record := range records {
+				if len(record) == numFields {
+					score++
+				}
+			}
+			if score > bestScore {
+				bestRecords = records
+				bestDelimiter = delimiter
+				bestIsLazy = isLazy
+				bestScore = score
+			}
+		}
+
+		if bestScore > 0 {
+			return bestRecords, bestDelimiter, bestIsLazy, nil
+		}
+	}
+
+	return nil, "", false, fmt.Errorf("Unable to determine the CSV delimiter")
+}
+
+func modalFieldCount(records [][]string) int {
+	counts := make(map[int]int)
+	var mode int = 0
+	for _, record := range records {
+		counts[len(record)]++
+		if counts[len(record)] > counts[mode] || (counts[len(record)] == counts[mode] && len(record) < mode) {
+			mode = len(record)
+		}
+	}
+	return mode
+}
+
+// detectDateColumn returns the first column where every value can be parsed
+// using one of the known date layouts.
+func detectDateColumn(data [][]string, numFields int) (int, string) {
+	for col := 1; col <= numFields; col++ {
+		if layout := columnDateLayout(data, col); layout != "" {
+			return col, layout
+		}
+	}
+	return 0, ""
+}
+
+func columnDateLayout(data [][]string, col int) string {
+	for _, layout := range csvDetectDateLayouts {
+		if isDateColumn(data, col, layout) {
+			return layout
+		}
+	}
+	return ""
+}
+
+func isDateColumn(data [][]string, col int, layout string) bool {
+	var numValues int = 0
+	for _, record := range data {
+		val := strings.TrimSpace(record[col-1])
+		if val == "" {
+			return false
+		}
+		if _, err := time.Parse(layout, val); err != nil {
+			return false
+		}
+		numValues++
+	}
+	return numValues > 0
+}
+
+// detectMoneyColumns returns all the columns where every value can be parsed
+// as a money value. The decimal separator that results in the most money
+// columns is saved in the mapping.
+func (r *CSVRunner) detectMoneyColumns(data [][]string, numFields int, dateCol int, mappedCfg *csvMappedAcctCfg) []int {
+	var best []int
+	for _, decimalSep := range []string{"", ","} {
+		cfg := &csvMappedAcctCfg{
+			DecimalSep:     decimalSep,
+			ParensNegative: true,
+			TrailingSign:   true,
+			CreditDebitSfx: true,
+		}
+		var cols []int
+		for col := 1; col <= numFields; col++ {
+			if col != dateCol && r.isMoneyColumn(data, col, cfg) {
+				cols = append(cols, col)
+			}
+		}
+		if len(cols) > len(best) {
+			best = cols
+			mappedCfg.DecimalSep = decimalSep
+		}
+	}
+
+	// Only enable the sign indicators that are actually used
+	for _, record := range data {
+		for _, col := range best {
+			val := strings.ToUpper(strings.TrimSpace(record[col-1]))
+			if strings.HasPrefix(val, "(") {
+				mappedCfg.ParensNegative = true
+			}
+			if strings.HasSuffix(val, "-") || strings.HasSuffix(val, "+") {
+				mappedCfg.TrailingSign = true
+			}
+			if strings.HasSuffix(val, "CR") || strings.HasSuffix(val, "DR") {
+				mappedCfg.CreditDebitSfx = true
+			}
+		}
+	}
+	return best
+}
+
+func (r *CSVRunner) isMoneyColumn(data [][]string, col int, cfg *csvMappedAcctCfg) bool {
+	// At least one value needs to look like a money amount (e.g. "12.00") to
+	// avoid mistaking reference numbers for money values
+	var hasFraction bool = false
+	for _, record := range data {
+		val := strings.TrimSpace(record[col-1])
+		if val == "" {
+			continue
+		}
+		if _, err := r.parseRawMoneyValue(val, false, cfg); err != nil {
+			return false
+		}
+		if csvDetectFractionRgx.MatchString(val) {
+			hasFraction = true
+		}
+	}
+	return hasFraction
+}
+
+// findDebitCreditPair looks for two money columns where only one of the two
+// columns has a (non-zero) value in each record.
+func (r *CSVRunner) findDebitCreditPair(data [][]string, moneyCols []int, cfg *csvMappedAcctCfg) []int {
+	for idx := 0; idx+1 < len(moneyCols); idx++ {
+		debitCol, creditCol := moneyCols[idx], moneyCols[idx+1]
+		var isPair bool = true
+		var numDebits, numCredits int = 0, 0
+		for _, record := range data {
+			hasDebit := !r.isZeroMoneyValue(record[debitCol-1], cfg)
+			hasCredit := !r.isZeroMoneyValue(record[creditCol-1], cfg)
+			if hasDebit == hasCredit {
+				isPair = false
+				break
+			}
+			if hasDebit {
+				numDebits++
+			} else {
+				numCredits++
+			}
+		}
+		if isPair && numDebits > 0 && numCredits > 0 {
+			return []int{debitCol, creditCol}
+		}
+	}
+	return nil
+}
+
+func (r *CSVRunner) isZeroMoneyValue(val string, cfg *csvMappedAcctCfg) bool {
+	f, err := r.parseRawMoneyValue(val, false, cfg)
+	return err != nil || f.Sign() == 0
+}
+
+// isRunningBalance checks whether the differences between consecutive values
+// in a column line up with the transaction amounts, for statements listed
+// either oldest or newest first.
+func (r *CSVRunner) isRunningBalance(data [][]string, col int, cfg *csvMappedAcctCfg) bool {
+	if len(data) < 2 {
+		return false
+	}
+
+	var amounts []*big.Float
+	var balances []*big.Float
+	for _, record := range data {
+		amount, err := r.coerceMoneyValue(record, cfg)
+		if err != nil {
+			return false
+		}
+		balance, err := r.parseRawMoneyValue(record[col-1], false, cfg)
+		if err != nil || strings.TrimSpace(record[col-1]) == "" {
+			return false
+		}
+		amounts = append(amounts, amount)
+		balances = append(balances, balance)
+	}
+
+	tolerance := Zero().SetFloat64(0.005)
+	var isOldestFirst, isNewestFirst bool = true, true
+	for idx := 1; idx < len(balances); idx++ {
+		// oldest first: balance[i] - balance[i-1] == amount[i]
+		delta := Zero().Sub(Zero().Sub(balances[idx], balances[idx-1]), amounts[idx])
+		if delta.Abs(delta).Cmp(tolerance) > 0 {
+			isOldestFirst = false
+		}
+
+		// newest first: balance[i-1] - balance[i] == amount[i-1]
+		delta = Zero().Sub(Zero().Sub(balances[idx-1], balances[idx]), amounts[idx-1])
+		if delta.Abs(delta).Cmp(tolerance) > 0 {
+			isNewestFirst = false
+		}
+	}
+	return isOldestFirst || isNewestFirst
+}
+
+func detectDirectionColumn(data [][]string, numFields int, usedCols map[int]bool) int {
+	indicators := []string{"D", "DR", "Debit", "C", "CR", "Credit"}
+	for col := 1; col <= numFields; col++ {
+		if usedCols[col] {
+			continue
+		}
+		var isIndicator bool = true
+		for _, record := range data {
+			var isMatch bool = false
+			for _, indicator := range indicators {
+				if strings.EqualFold(strings.TrimSpace(record[col-1]), indicator) {
+					isMatch = true
+				}
+			}
+			if !isMatch {
+				isIndicator = false
+				break
+			}
+		}
+		if isIndicator && len(data) > 0 {
+			return col
+		}
+	}
+	return 0
+}
+
+// isSignedColumn checks whether any of the money values in a column carry
+// their own sign indicator
+func isSignedColumn(data [][]string, col int) bool {
+	for _, record := range data {
+		val := strings.ToUpper(strings.TrimSpace(record[col-1]))
+		if strings.ContainsAny(val, "-+(") || strings.HasSuffix(val, "CR") || strings.HasSuffix(val, "DR") {
+			return true
+		}
+	}
+	return false
+}
+
+func moneyColsContains(moneyCols []int, col int) bool {
+	for _, c := range moneyCols {
+		if c == col {
+			return true
+		}
+	}
+	return false
+}
+
+func averageLength(data [][]string, col int) int {
+	if len(data) == 0 {
+		return 0
+	}
+	var total int = 0
+	for _, record := range data {
+		total += utf8.RuneCountInString(strings.TrimSpace(record[col-1]))
+	}
+	return total / len(data)
+}
+
+func isVaryingColumn(data [][]string, col int) bool {
+	for _, record := range data {
+		if strings.TrimSpace(record[col-1]) != strings.TrimSpace(data[0][col-1]) {
+			return true
+		}
+	}
+	return false
+}
+
+func detectCurrency(data [][]string, moneyCols []int) string {
+	for _, record := range data {
+		for _, col := range moneyCols {
+			for _, c := range csvDetectCurrencies {
+				if strings.Contains(strings.ToUpper(record[col-1]), c.symbol) {
+					return c.currency
+				}
+			}
+		}
+	}
+	return ""
+}
@@ -0,0 +1,188 @@
+package lib
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/stretchr/testify/assert"
+	"io/ioutil"
+	"os"
+	"testing"
+
+	log "github.com/sirupsen/logrus"
+	afero "github.com/spf13/afero"
+	viperlib "github.com/spf13/viper"
+)
+
+func TestCSVDetect(t *testing.T) {
+	type test struct {
+		name       string
+		skipTest   bool
+		inpCSVData string
+		expMapping *csvMappedAcctCfg
+		expOutput  string
+		expError   error
+	}
+
+	tests := []test{
+		{
+			name:       "detects debit and credit columns with a running balance",
+			skipTest:   false,
+			inpCSVData: "testdata/csv/basic-record.csv",
+			expMapping: &csvMappedAcctCfg{
+				LedgerAcctName: "Assets:Bank",
+				CsvDateFormat:  "2-Jan-2006",
+				DateCol:        2,
+				DescCol:        3,
+				MoneyCols:      []int{5, 6},
+				NegateAmt:      false,
+				NoteCols:       []int{},
+				Currency:       "eur",
+				BalanceCol:     7,
+			},
+			expOutput: "testdata/csv/detect-basic-record.ledger",
+			expError:  nil,
+		},
+		{
+			name:       "detects a header row",
+			skipTest:   false,
+			inpCSVData: "testdata/csv/single-money-column-w-header.csv",
+			expMapping: &csvMappedAcctCfg{
+				LedgerAcctName: "Assets:Bank",
+				CsvDateFormat:  "2006/1/2",
+				DateCol:        1,
+				DescCol:        2,
+				MoneyCols:      []int{3},
+				NegateAmt:      false,
+				NoteCols:       []int{},
+				Currency:       "eur",
+				HeaderRow:      1,
+			},
+			expOutput: "testdata/csv/detect-single-money-column-w-header.ledger",
+			expError:  nil,
+		},
+		{
+			name:       "detects the dialect and number format",
+			skipTest:   false,
+			inpCSVData: "testdata/csv/semicolon-latin1.csv",
+			expMapping: &csvMappedAcctCfg{
+				LedgerAcctName: "Assets:Bank",
+				CsvDateFormat:  "02-01-2006",
+				DateCol:        1,
+				DescCol:        2,
+				MoneyCols:      []int{3},
+				NegateAmt:      false,
+				NoteCols:       []int{},
+				Currency:       "eur",
+				HeaderRow:      1,
+				DecimalSep:     ",",
+				Delimiter:      ";",
+				Encoding:       "windows-1252",
+			},
+			expOutput: "testdata/csv/detect-semicolon-latin1.ledger",
+			expError:  nil,
+		},
+		{
+			name:       "detects sign indicators",
+			skipTest:   false,
+			inpCSVData: "testdata/csv/sign-indicators.csv",
+			expMapping: &csvMappedAcctCfg{
+				LedgerAcctName: "Assets:Bank",
+				CsvDateFormat:  "2006-01-02",
+				DateCol:        1,
+				DescCol:        2,
+				MoneyCols:      []int{3},
+				NegateAmt:      false,
+				NoteCols:       []int{},
+				Currency:       "eur",
+				ParensNegative: true,
+				TrailingSign:   true,
+				CreditDebitSfx: true,
+			},
+			expOutput: "testdata/csv/detect-sign-indicators.ledger",
+			expError:  nil,
+		},
+		{
+			name:       "detects a debit/credit indicator column",
+			skipTest:   false,
+			inpCSVData: "testdata/csv/debit-credit-indicator-defaults.csv",
+			expMapping: &csvMappedAcctCfg{
+				LedgerAcctName: "Assets:Bank",
+				CsvDateFormat:  "2006-01-02",
+				DateCol:        1,
+				DescCol:        2,
+				MoneyCols:      []int{3},
+				NegateAmt:      false,
+				NoteCols:       []int{},
+				Currency:       "eur",
+				DirectionCol:   4,
+			},
+			expOutput: "testdata/csv/detect-debit-credit-indicator-defaults.ledger",
+			expError:  nil,
+		},
+		{
+			name:       "errors out on files it cannot make sense of",
+			skipTest:   false,
+			inpCSVData: "testdata/csv/bad-csv-record.csv",
+			expMapping: nil,
+			expOutput:  "testdata/stripe/empty-response.ledger",
+			expError:   fmt.Errorf("Unable to infer a mapping"),
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			csvMappingKeyName := "test_cc_account"
+			csvMappingKeyFullName := fmt.Sprintf("csv.account.%s", csvMappingKeyName)
+
+			if tc.skipTest {
+				t.Skip(fmt.Sprintf("Skipping test: %s", tc.name))
+			}
+
+			csvFixture, err := os.Open(tc.inpCSVData)
+			if err != nil {
+				t.Fatalf("Unable to read fixtures file %s", tc.inpCSVData)
+			}
+			defer csvFixture.Close()
+
+			appFs := afero.NewMemMapFs()
+			v := viperlib.New()
+			v.SetFs(appFs)
+			v.SetConfigName("slcconfig")
+			v.AddConfigPath("/")
+			afero.WriteFile(appFs, "/slcconfig.yml", []byte("---"), 0644)
+			v.ReadInConfig()
+			v.Set("ledger_account_lookups", &[]lookupItem{})
+
+			state, err := OpenRunState(appFs, "/slcstate.yml", "/slcproposals.yml")
+			if err != nil {
+				t.Fatalf("Unable to open the state file: %v", err)
+			}
+			defer state.Close()
+
+			var logger = log.WithFields(log.Fields{"name": "slc-testing"})
+			var output bytes.Buffer
+			bar := &StubProgressBar{}
+			runner := NewCSVRunner(&output, v, logger, bar)
+			runner.SetRunState(state)
+
+			expOutput, err := ioutil.ReadFile(tc.expOutput)
+			if err != nil {
+				t.Fatalf("Unable to read expected output file %s", tc.expOutput)
+			}
+
+			result := runner.DetectMapping(csvFixture, csvMappingKeyName)
+			proposals := readSavedState(t, appFs, "/slcproposals.yml")
+			assert.False(t, v.IsSet(csvMappingKeyFullName))
+			if tc.expError != nil {
+				assert.NotNil(t, result)
+				assert.False(t, proposals.IsSet(csvMappingKeyFullName))
+			} else {
+				assert.Nil(t, result)
+				var mapping csvMappedAcctCfg
+				assert.Nil(t, proposals.UnmarshalKey(csvMappingKeyFullName, &mapping))
+				assert.Equal(t, tc.expMapping, &mapping)
+			}
+			assert.Equal(t, string(expOutput), output.String())
+		})
+	}
+}
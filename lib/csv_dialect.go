@@ -0,0 +1,79 @@
+package lib
+
+import (
+	"encoding/csv"
+	"fmt"
+	"io"
+	"strings"
+	"unicode/utf8"
+
+	encoding "golang.org/x/text/encoding"
+	htmlindex "golang.org/x/text/encoding/htmlindex"
+	unicode "golang.org/x/text/encoding/unicode"
+	transform "golang.org/x/text/transform"
+)
+
+// newCSVReader sets up a CSV reader for the dialect (delimiter, quoting,
+// encoding, etc) described by the mapped account config.
+func (c *csvMappedAcctCfg) newCSVReader(inp io.Reader) (*csv.Reader, error) {
+	var enc encoding.Encoding = encoding.Nop
+	if c.Encoding != "" {
+		var err error
+		enc, err = htmlindex.Get(c.Encoding)
+		if err != nil {
+			return nil, fmt.Errorf("Unsupported CSV encoding '%s'", c.Encoding)
+		}
+	}
+
+	// BOMOverride strips any UTF-8 byte order mark, and switches to the
+	// appropriate UTF-16 decoder if it comes across a UTF-16 byte order mark
+	decoder := unicode.BOMOverride(enc.NewDecoder())
+	reader := csv.NewReader(transform.NewReader(inp, decoder))
+
+	if c.Delimiter != "" {
+		delim, err := parseDialectChar("delimiter", c.Delimiter)
+		if err != nil {
+			return nil, err
+		}
+		reader.Comma = delim
+	}
+
+	if c.Comment != "" {
+		comment, err := parseDialectChar("comment", c.Comment)
+		if err != nil {
+			return nil, err
+		}
+		if comment == reader.Comma {
+			return nil, fmt.Errorf("The CSV comment and delimiter characters cannot both be '%c'", comment)
+		}
+		reader.Comment = comment
+	}
+
+	reader.LazyQuotes = c.LazyQuotes
+	if c.VariableFields || c.hasSkipRules() {
+		// Preamble, footer, and subtotal rows rarely have the same number of
+		// fields as the transaction records
+		reader.FieldsPerRecord = -1
+	}
+
+	return reader, nil
+}
+
+func parseDialectChar(name string, val string) (rune, error) {
+	switch strings.ToLower(val) {
+	case "tab", `\t`:
+		return '\t', nil
+	case "space":
+		return ' ', nil
+	}
+
+	if utf8.RuneCountInString(val) != 1 {
+		return 0, fmt.Errorf("The CSV %s '%s' must be a single character", name, val)
+	}
+
+	ru, _ := utf8.DecodeRuneInString(val)
+	if ru == '"' || ru == '\r' || ru == '\n' || ru == utf8.RuneError {
+		return 0, fmt.Errorf("Invalid CSV %s '%s'", name, val)
+	}
+	return ru, nil
+}
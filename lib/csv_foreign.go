@@ -0,0 +1,91 @@
+package lib
+
+import (
+	"fmt"
+	"math/big"
+	"strings"
+)
+
+func (c *csvMappedAcctCfg) validateForeignAmount() error {
+	hasCurrencyCol := c.ForeignCurrencyCol != 0 || c.ForeignCurrencyColName != ""
+	hasAmountCol := c.ForeignAmountCol != 0 || c.ForeignAmountColName != ""
+	hasRateCol := c.RateCol != 0 || c.RateColName != ""
+
+	if (hasAmountCol || hasRateCol) && !hasCurrencyCol {
+		return fmt.Errorf("A 'foreign_currency_col' is needed in order to use the 'foreign_amount_col' or 'rate_col' settings")
+	}
+	if hasCurrencyCol && !hasAmountCol && !hasRateCol {
+		return fmt.Errorf("Either a 'foreign_amount_col' or 'rate_col' is needed in order to use the 'foreign_currency_col' setting")
+	}
+	return nil
+}
+
+// applyForeignAmount converts the counter-posting of a record into the foreign
+// commodity the transaction originally took place in, with a cost annotation
+// in the home currency. Records without a foreign currency value (or with one
+// that matches the home currency) are left as-is.
+func (r *CSVRunner) applyForeignAmount(record []string, cfg *csvMappedAcctCfg, posting *TransactionPosting) error {
+	if cfg.ForeignCurrencyCol < 1 {
+		return nil
+	}
+
+	rawCurrency := strings.TrimSpace(record[cfg.ForeignCurrencyCol-1])
+	if rawCurrency == "" {
+		return nil
+	}
+	foreignCurrency, err := cfg.lookupCurrency(rawCurrency, cfg.ForeignCurrencyCol)
+	if err != nil {
+		return err
+	}
+	if strings.EqualFold(foreignCurrency, posting.Currency) {
+		return nil
+	}
+
+	var rate *big.Float
+	if cfg.RateCol > 0 && strings.TrimSpace(record[cfg.RateCol-1]) != "" {
+		rate, err = r.parseRawMoneyValue(record[cfg.RateCol-1], false, cfg)
+		if err != nil {
+			return fmt.Errorf("Unable to parse the exchange rate from column %d: %v", cfg.RateCol, err)
+		}
+		rate.Abs(rate)
+		if rate.Sign() == 0 {
+			return fmt.Errorf("Invalid exchange rate '%s' in column %d", record[cfg.RateCol-1], cfg.RateCol)
+		}
+	}
+
+	homeAmount := Zero().Abs(posting.Amount)
+	var foreignAmount *big.Float
+	if cfg.ForeignAmountCol > 0 && strings.TrimSpace(record[cfg.ForeignAmountCol-1]) != "" {
+		foreignAmount, err = r.parseRawMoneyValue(record[cfg.ForeignAmountCol-1], false, cfg)
+		if err != nil {
+			return fmt.Errorf("Unable to parse the foreign amount from column %d: %v", cfg.ForeignAmountCol, err)
+		}
+		foreignAmount.Abs(foreignAmount)
+	} else if rate != nil {
+		// The rate is the number of home currency units per foreign currency
+		// unit, e.g. 1.36 CAD per USD
+		foreignAmount = roundToMinorUnit(Zero().Quo(homeAmount, rate), cfg.currencyExponent(foreignCurrency))
+	} else {
+		return fmt.Errorf("The record has a foreign currency '%s', but no foreign amount or exchange rate", rawCurrency)
+	}
+
+	if posting.Amount.Sign() < 0 {
+		foreignAmount.Neg(foreignAmount)
+	}
+
+	homeCurrency := posting.Currency
+	posting.Amount = foreignAmount
+	posting.Currency = foreignCurrency
+	posting.CostCurrency = homeCurrency
+
+	// Use the per unit rate if it accounts for the home amount exactly,
+	// otherwise the total cost is needed for the transaction to balance
+	if rate != nil && approxEquals(Zero().Mul(Zero().Abs(foreignAmount), rate), homeAmount) {
+		posting.Cost = rate
+		posting.IsTotalCost = false
+	} else {
+		posting.Cost = homeAmount
+		posting.IsTotalCost = true
+	}
+	return nil
+}
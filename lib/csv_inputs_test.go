@@ -178,6 +178,862 @@ func TestCSVInputs(t *testing.T) {
 			expOutput:  "testdata/csv/discards-transactions.ledger",
 			expError:   nil,
 		},
+		{
+			name:     "handles european number formats",
+			skipTest: false,
+			inpCSVMapCfg: &csvMappedAcctCfg{
+				LedgerAcctName: "Assets:ABNAMRO",
+				CsvDateFormat:  "02-01-2006",
+				DateCol:        1,
+				DescCol:        2,
+				MoneyCols:      []int{3},
+				NegateAmt:      false,
+				NoteCols:       []int{},
+				Currency:       "eur",
+				DecimalSep:     ",",
+				GroupingSep:    ".",
+			},
+			inpLookupList: &[]lookupItem{},
+			inpCSVData:    "testdata/csv/european-number-format.csv",
+			expOutput:     "testdata/csv/european-number-format.ledger",
+			expError:      nil,
+		},
+		{
+			name:     "handles parentheses, trailing signs, and CR/DR suffixes",
+			skipTest: false,
+			inpCSVMapCfg: &csvMappedAcctCfg{
+				LedgerAcctName: "Assets:Bank123",
+				CsvDateFormat:  "2006-01-02",
+				DateCol:        1,
+				DescCol:        2,
+				MoneyCols:      []int{3},
+				NegateAmt:      false,
+				NoteCols:       []int{},
+				Currency:       "usd",
+				ParensNegative: true,
+				TrailingSign:   true,
+				CreditDebitSfx: true,
+			},
+			inpLookupList: &[]lookupItem{},
+			inpCSVData:    "testdata/csv/sign-indicators.csv",
+			expOutput:     "testdata/csv/sign-indicators.ledger",
+			expError:      nil,
+		},
+		{
+			name:     "rejects sign indicators that have not been configured",
+			skipTest: false,
+			inpCSVMapCfg: &csvMappedAcctCfg{
+				LedgerAcctName: "Assets:Bank123",
+				CsvDateFormat:  "2006-01-02",
+				DateCol:        1,
+				DescCol:        2,
+				MoneyCols:      []int{3},
+				NegateAmt:      false,
+				NoteCols:       []int{},
+				Currency:       "usd",
+			},
+			inpLookupList: &[]lookupItem{},
+			inpCSVData:    "testdata/csv/sign-indicators.csv",
+			expOutput:     "testdata/stripe/empty-response.ledger",
+			expError:      fmt.Errorf("expect an error here"),
+		},
+		{
+			name:     "rejects ambiguous number formats",
+			skipTest: false,
+			inpCSVMapCfg: &csvMappedAcctCfg{
+				LedgerAcctName: "Assets:Bank123",
+				CsvDateFormat:  "2006-01-02",
+				DateCol:        1,
+				DescCol:        2,
+				MoneyCols:      []int{3},
+				NegateAmt:      false,
+				NoteCols:       []int{},
+				Currency:       "usd",
+			},
+			inpLookupList: &[]lookupItem{},
+			inpCSVData:    "testdata/csv/ambiguous-number-format.csv",
+			expOutput:     "testdata/stripe/empty-response.ledger",
+			expError:      fmt.Errorf("expect an error here"),
+		},
+		{
+			name:     "rejects identical decimal and grouping separators",
+			skipTest: false,
+			inpCSVMapCfg: &csvMappedAcctCfg{
+				LedgerAcctName: "Assets:Bank123",
+				CsvDateFormat:  "2006-01-02",
+				DateCol:        1,
+				DescCol:        2,
+				MoneyCols:      []int{3},
+				NegateAmt:      false,
+				NoteCols:       []int{},
+				Currency:       "usd",
+				DecimalSep:     ",",
+				GroupingSep:    ",",
+			},
+			inpLookupList: &[]lookupItem{},
+			inpCSVData:    "testdata/csv/ambiguous-number-format.csv",
+			expOutput:     "testdata/stripe/empty-response.ledger",
+			expError:      fmt.Errorf("expect an error here"),
+		},
+		{
+			name:     "handles semicolon separated latin-1 files",
+			skipTest: false,
+			inpCSVMapCfg: &csvMappedAcctCfg{
+				LedgerAcctName: "Assets:Sparkasse",
+				CsvDateFormat:  "02-01-2006",
+				DateCol:        1,
+				DescCol:        2,
+				MoneyCols:      []int{3},
+				NegateAmt:      false,
+				NoteCols:       []int{},
+				Currency:       "eur",
+				HeaderRow:      1,
+				DecimalSep:     ",",
+				Delimiter:      ";",
+				Encoding:       "iso-8859-1",
+			},
+			inpLookupList: &[]lookupItem{},
+			inpCSVData:    "testdata/csv/semicolon-latin1.csv",
+			expOutput:     "testdata/csv/semicolon-latin1.ledger",
+			expError:      nil,
+		},
+		{
+			name:     "handles tab separated utf-16 files",
+			skipTest: false,
+			inpCSVMapCfg: &csvMappedAcctCfg{
+				LedgerAcctName: "Assets:Bank123",
+				CsvDateFormat:  "2006-01-02",
+				DateCol:        1,
+				DescCol:        2,
+				MoneyCols:      []int{3},
+				NegateAmt:      false,
+				NoteCols:       []int{},
+				Currency:       "cad",
+				Delimiter:      "tab",
+				Encoding:       "utf-16le",
+			},
+			inpLookupList: &[]lookupItem{},
+			inpCSVData:    "testdata/csv/utf16-tab-separated.csv",
+			expOutput:     "testdata/csv/utf16-tab-separated.ledger",
+			expError:      nil,
+		},
+		{
+			name:     "handles byte order marks, comments, lazy quotes, and variable fields",
+			skipTest: false,
+			inpCSVMapCfg: &csvMappedAcctCfg{
+				LedgerAcctName: "Assets:Bank123",
+				CsvDateFormat:  "2006-01-02",
+				DateCol:        1,
+				DescCol:        2,
+				MoneyCols:      []int{3},
+				NegateAmt:      false,
+				NoteCols:       []int{4},
+				Currency:       "usd",
+				Comment:        "#",
+				LazyQuotes:     true,
+				VariableFields: true,
+			},
+			inpLookupList: &[]lookupItem{},
+			inpCSVData:    "testdata/csv/bom-comments-variable-fields.csv",
+			expOutput:     "testdata/csv/bom-comments-variable-fields.ledger",
+			expError:      nil,
+		},
+		{
+			name:     "rejects unsupported encodings",
+			skipTest: false,
+			inpCSVMapCfg: &csvMappedAcctCfg{
+				LedgerAcctName: "Assets:Bank123",
+				CsvDateFormat:  "2006-01-02",
+				DateCol:        1,
+				DescCol:        2,
+				MoneyCols:      []int{3},
+				NegateAmt:      false,
+				NoteCols:       []int{},
+				Currency:       "usd",
+				Encoding:       "klingon",
+			},
+			inpLookupList: &[]lookupItem{},
+			inpCSVData:    "testdata/csv/utf16-tab-separated.csv",
+			expOutput:     "testdata/stripe/empty-response.ledger",
+			expError:      fmt.Errorf("expect an error here"),
+		},
+		{
+			name:     "handles debit/credit indicator columns",
+			skipTest: false,
+			inpCSVMapCfg: &csvMappedAcctCfg{
+				LedgerAcctName: "Assets:ING",
+				CsvDateFormat:  "20060102",
+				DateCol:        1,
+				DescCol:        2,
+				MoneyCols:      []int{4},
+				NegateAmt:      false,
+				NoteCols:       []int{},
+				Currency:       "eur",
+				DecimalSep:     ",",
+				DirectionCol:   3,
+				DebitValues:    []string{"Af"},
+				CreditValues:   []string{"Bij"},
+			},
+			inpLookupList: &[]lookupItem{},
+			inpCSVData:    "testdata/csv/debit-credit-indicator.csv",
+			expOutput:     "testdata/csv/debit-credit-indicator.ledger",
+			expError:      nil,
+		},
+		{
+			name:     "handles the default debit/credit indicator values",
+			skipTest: false,
+			inpCSVMapCfg: &csvMappedAcctCfg{
+				LedgerAcctName: "Liabilities:Visa",
+				CsvDateFormat:  "2006-01-02",
+				DateCol:        1,
+				DescCol:        2,
+				MoneyCols:      []int{3},
+				NegateAmt:      false,
+				NoteCols:       []int{},
+				Currency:       "usd",
+				DirectionCol:   4,
+			},
+			inpLookupList: &[]lookupItem{},
+			inpCSVData:    "testdata/csv/debit-credit-indicator-defaults.csv",
+			expOutput:     "testdata/csv/debit-credit-indicator-defaults.ledger",
+			expError:      nil,
+		},
+		{
+			name:     "rejects unrecognized debit/credit indicators",
+			skipTest: false,
+			inpCSVMapCfg: &csvMappedAcctCfg{
+				LedgerAcctName: "Assets:ING",
+				CsvDateFormat:  "20060102",
+				DateCol:        1,
+				DescCol:        2,
+				MoneyCols:      []int{4},
+				NegateAmt:      false,
+				NoteCols:       []int{},
+				Currency:       "eur",
+				DecimalSep:     ",",
+				DirectionCol:   3,
+			},
+			inpLookupList: &[]lookupItem{},
+			inpCSVData:    "testdata/csv/debit-credit-indicator.csv",
+			expOutput:     "testdata/stripe/empty-response.ledger",
+			expError:      fmt.Errorf("expect an error here"),
+		},
+		{
+			name:     "adds balance assertions to the primary postings",
+			skipTest: false,
+			inpCSVMapCfg: &csvMappedAcctCfg{
+				LedgerAcctName: "Assets:BankOfMontreal",
+				CsvDateFormat:  "02-Jan-2006",
+				DateCol:        2,
+				DescCol:        3,
+				MoneyCols:      []int{5, 6},
+				NegateAmt:      false,
+				NoteCols:       []int{},
+				Currency:       "CAD",
+				BalanceCol:     7,
+			},
+			inpLookupList: &[]lookupItem{},
+			inpCSVData:    "testdata/csv/basic-record.csv",
+			expOutput:     "testdata/csv/balance-assertion-postings.ledger",
+			expError:      nil,
+		},
+		{
+			name:     "adds daily balance assertions for newest first statements",
+			skipTest: false,
+			inpCSVMapCfg: &csvMappedAcctCfg{
+				LedgerAcctName:   "Assets:BankOfMontreal",
+				CsvDateFormat:    "02-Jan-2006",
+				DateCol:          2,
+				DescCol:          3,
+				MoneyCols:        []int{5, 6},
+				NegateAmt:        false,
+				NoteCols:         []int{},
+				Currency:         "CAD",
+				BalanceCol:       7,
+				BalanceAssertion: "daily",
+			},
+			inpLookupList: &[]lookupItem{},
+			inpCSVData:    "testdata/csv/basic-record.csv",
+			expOutput:     "testdata/csv/balance-assertion-daily.ledger",
+			expError:      nil,
+		},
+		{
+			name:     "adds daily balance assertions for oldest first statements",
+			skipTest: false,
+			inpCSVMapCfg: &csvMappedAcctCfg{
+				LedgerAcctName:   "Assets:Bank123",
+				CsvDateFormat:    "1/2/2006",
+				DateCol:          1,
+				DescCol:          3,
+				MoneyCols:        []int{4, 5},
+				NegateAmt:        false,
+				NoteCols:         []int{2},
+				Currency:         "eur",
+				BalanceCol:       6,
+				BalanceAssertion: "daily",
+			},
+			inpLookupList: &[]lookupItem{},
+			inpCSVData:    "testdata/csv/two-money-columns-2.csv",
+			expOutput:     "testdata/csv/balance-assertion-daily-oldest-first.ledger",
+			expError:      nil,
+		},
+		{
+			name:     "rejects unknown balance assertion styles",
+			skipTest: false,
+			inpCSVMapCfg: &csvMappedAcctCfg{
+				LedgerAcctName:   "Assets:Bank123",
+				CsvDateFormat:    "1/2/2006",
+				DateCol:          1,
+				DescCol:          3,
+				MoneyCols:        []int{4, 5},
+				NegateAmt:        false,
+				NoteCols:         []int{2},
+				Currency:         "eur",
+				BalanceCol:       6,
+				BalanceAssertion: "weekly",
+			},
+			inpLookupList: &[]lookupItem{},
+			inpCSVData:    "testdata/csv/two-money-columns-2.csv",
+			expOutput:     "testdata/stripe/empty-response.ledger",
+			expError:      fmt.Errorf("expect an error here"),
+		},
+		{
+			name:     "references columns by header name",
+			skipTest: false,
+			inpCSVMapCfg: &csvMappedAcctCfg{
+				LedgerAcctName: "Assets:Bank123",
+				CsvDateFormat:  "2006/1/2",
+				DateColName:    "Date",
+				DescColName:    "note",
+				MoneyColNames:  []string{" AMOUNT "},
+				NegateAmt:      false,
+				Currency:       "eur",
+				HeaderRow:      1,
+			},
+			inpLookupList: &[]lookupItem{},
+			inpCSVData:    "testdata/csv/single-money-column-w-header.csv",
+			expOutput:     "testdata/csv/single-money-column-w-header.ledger",
+			expError:      nil,
+		},
+		{
+			name:     "references reordered columns by header name",
+			skipTest: false,
+			inpCSVMapCfg: &csvMappedAcctCfg{
+				LedgerAcctName: "Assets:Bank123",
+				CsvDateFormat:  "2006-01-02",
+				DateColName:    "Booking Date",
+				DescColName:    "Description",
+				MoneyColNames:  []string{"Amount"},
+				NegateAmt:      false,
+				NoteColNames:   []string{"Reference"},
+				Currency:       "eur",
+				HeaderRow:      2,
+				BalanceColName: "Balance",
+			},
+			inpLookupList: &[]lookupItem{},
+			inpCSVData:    "testdata/csv/header-names.csv",
+			expOutput:     "testdata/csv/header-names.ledger",
+			expError:      nil,
+		},
+		{
+			name:     "errors out when a named column is missing from the header",
+			skipTest: false,
+			inpCSVMapCfg: &csvMappedAcctCfg{
+				LedgerAcctName: "Assets:Bank123",
+				CsvDateFormat:  "2006-01-02",
+				DateColName:    "Booking Date",
+				DescColName:    "Description",
+				MoneyColNames:  []string{"Debit", "Credit"},
+				NegateAmt:      false,
+				Currency:       "eur",
+				HeaderRow:      2,
+			},
+			inpLookupList: &[]lookupItem{},
+			inpCSVData:    "testdata/csv/header-names.csv",
+			expOutput:     "testdata/stripe/empty-response.ledger",
+			expError:      fmt.Errorf("expect an error here"),
+		},
+		{
+			name:     "errors out when column names are used without a header row",
+			skipTest: false,
+			inpCSVMapCfg: &csvMappedAcctCfg{
+				LedgerAcctName: "Assets:Bank123",
+				CsvDateFormat:  "2006-01-02",
+				DateColName:    "Booking Date",
+				DescColName:    "Description",
+				MoneyColNames:  []string{"Amount"},
+				NegateAmt:      false,
+				Currency:       "eur",
+			},
+			inpLookupList: &[]lookupItem{},
+			inpCSVData:    "testdata/csv/header-names.csv",
+			expOutput:     "testdata/stripe/empty-response.ledger",
+			expError:      fmt.Errorf("expect an error here"),
+		},
+		{
+			name:     "errors out when a column is referenced by both index and name",
+			skipTest: false,
+			inpCSVMapCfg: &csvMappedAcctCfg{
+				LedgerAcctName: "Assets:Bank123",
+				CsvDateFormat:  "2006-01-02",
+				DateCol:        3,
+				DateColName:    "Booking Date",
+				DescColName:    "Description",
+				MoneyColNames:  []string{"Amount"},
+				NegateAmt:      false,
+				Currency:       "eur",
+				HeaderRow:      2,
+			},
+			inpLookupList: &[]lookupItem{},
+			inpCSVData:    "testdata/csv/header-names.csv",
+			expOutput:     "testdata/stripe/empty-response.ledger",
+			expError:      fmt.Errorf("expect an error here"),
+		},
+		{
+			name:     "skips preamble, footer, and pattern matched rows",
+			skipTest: false,
+			inpCSVMapCfg: &csvMappedAcctCfg{
+				LedgerAcctName: "Assets:Bank123",
+				CsvDateFormat:  "2006-01-02",
+				DateCol:        1,
+				DescCol:        2,
+				MoneyCols:      []int{3},
+				NegateAmt:      false,
+				NoteCols:       []int{},
+				Currency:       "eur",
+				HeaderRow:      3,
+				SkipRowsBefore: 2,
+				SkipRowsAfter:  2,
+				SkipPatterns: []csvSkipPattern{
+					{Pattern: "(?i)^pending$", ColumnName: "Status"},
+					{Pattern: "^[0-9-]+,Subtotal,"},
+				},
+			},
+			inpLookupList: &[]lookupItem{},
+			inpCSVData:    "testdata/csv/preamble-footer.csv",
+			expOutput:     "testdata/csv/preamble-footer.ledger",
+			expError:      nil,
+		},
+		{
+			name:     "errors out on footer rows when they are not skipped",
+			skipTest: false,
+			inpCSVMapCfg: &csvMappedAcctCfg{
+				LedgerAcctName: "Assets:Bank123",
+				CsvDateFormat:  "2006-01-02",
+				DateCol:        1,
+				DescCol:        2,
+				MoneyCols:      []int{3},
+				NegateAmt:      false,
+				NoteCols:       []int{},
+				Currency:       "eur",
+				HeaderRow:      3,
+				SkipRowsBefore: 2,
+				SkipPatterns: []csvSkipPattern{
+					{Pattern: "^Pending$", Column: 4},
+					{Pattern: "Subtotal"},
+				},
+			},
+			inpLookupList: &[]lookupItem{},
+			inpCSVData:    "testdata/csv/preamble-footer.csv",
+			expOutput:     "testdata/csv/preamble-footer-no-footer.ledger",
+			expError:      fmt.Errorf("expect an error here"),
+		},
+		{
+			name:     "rejects a header row that is skipped",
+			skipTest: false,
+			inpCSVMapCfg: &csvMappedAcctCfg{
+				LedgerAcctName: "Assets:Bank123",
+				CsvDateFormat:  "2006-01-02",
+				DateCol:        1,
+				DescCol:        2,
+				MoneyCols:      []int{3},
+				NegateAmt:      false,
+				NoteCols:       []int{},
+				Currency:       "jpy",
+				HeaderRow:      1,
+				SkipRowsBefore: 1,
+			},
+			inpLookupList: &[]lookupItem{},
+			inpCSVData:    "testdata/csv/split-postings-jpy.csv",
+			expOutput:     "testdata/stripe/empty-response.ledger",
+			expError:      fmt.Errorf("expect an error here"),
+		},
+		{
+			name:     "rejects invalid skip patterns",
+			skipTest: false,
+			inpCSVMapCfg: &csvMappedAcctCfg{
+				LedgerAcctName: "Assets:Bank123",
+				CsvDateFormat:  "2006-01-02",
+				DateCol:        1,
+				DescCol:        2,
+				MoneyCols:      []int{3},
+				NegateAmt:      false,
+				NoteCols:       []int{},
+				Currency:       "eur",
+				HeaderRow:      3,
+				SkipPatterns: []csvSkipPattern{
+					{Pattern: "(Pending", Column: 4},
+				},
+			},
+			inpLookupList: &[]lookupItem{},
+			inpCSVData:    "testdata/csv/preamble-footer.csv",
+			expOutput:     "testdata/stripe/empty-response.ledger",
+			expError:      fmt.Errorf("expect an error here"),
+		},
+		{
+			name:     "uses the currency of each record",
+			skipTest: false,
+			inpCSVMapCfg: &csvMappedAcctCfg{
+				LedgerAcctName: "Assets:Wise",
+				CsvDateFormat:  "2006-01-02",
+				DateCol:        1,
+				DescCol:        2,
+				MoneyCols:      []int{3},
+				NegateAmt:      false,
+				NoteCols:       []int{},
+				Currency:       "eur",
+				HeaderRow:      1,
+				CurrencyCol:    4,
+				CurrencyMap:    map[string]string{"£": "GBP"},
+				BalanceCol:     5,
+			},
+			inpLookupList: &[]lookupItem{},
+			inpCSVData:    "testdata/csv/multi-currency.csv",
+			expOutput:     "testdata/csv/multi-currency.ledger",
+			expError:      nil,
+		},
+		{
+			name:     "generates daily balance assertions for each currency",
+			skipTest: false,
+			inpCSVMapCfg: &csvMappedAcctCfg{
+				LedgerAcctName:   "Assets:Wise",
+				CsvDateFormat:    "2006-01-02",
+				DateCol:          1,
+				DescCol:          2,
+				MoneyCols:        []int{3},
+				NegateAmt:        false,
+				NoteCols:         []int{},
+				Currency:         "eur",
+				HeaderRow:        1,
+				CurrencyCol:      4,
+				CurrencyMap:      map[string]string{"£": "GBP"},
+				BalanceCol:       5,
+				BalanceAssertion: "daily",
+			},
+			inpLookupList: &[]lookupItem{},
+			inpCSVData:    "testdata/csv/multi-currency.csv",
+			expOutput:     "testdata/csv/multi-currency-daily.ledger",
+			expError:      nil,
+		},
+		{
+			name:     "errors out on unrecognized currencies",
+			skipTest: false,
+			inpCSVMapCfg: &csvMappedAcctCfg{
+				LedgerAcctName: "Assets:Wise",
+				CsvDateFormat:  "2006-01-02",
+				DateCol:        1,
+				DescCol:        2,
+				MoneyCols:      []int{3},
+				NegateAmt:      false,
+				NoteCols:       []int{},
+				Currency:       "eur",
+				HeaderRow:      1,
+				CurrencyCol:    4,
+			},
+			inpLookupList: &[]lookupItem{},
+			inpCSVData:    "testdata/csv/multi-currency.csv",
+			expOutput:     "testdata/csv/multi-currency-unrecognized.ledger",
+			expError:      fmt.Errorf("expect an error here"),
+		},
+		{
+			name:     "writes foreign amounts with cost annotations",
+			skipTest: false,
+			inpCSVMapCfg: &csvMappedAcctCfg{
+				LedgerAcctName:     "Liabilities:Visa",
+				CsvDateFormat:      "2006-01-02",
+				DateCol:            1,
+				DescCol:            2,
+				MoneyCols:          []int{3},
+				NegateAmt:          false,
+				NoteCols:           []int{},
+				Currency:           "cad",
+				HeaderRow:          1,
+				ForeignAmountCol:   4,
+				ForeignCurrencyCol: 5,
+				RateCol:            6,
+			},
+			inpLookupList: &[]lookupItem{},
+			inpCSVData:    "testdata/csv/foreign-amounts.csv",
+			expOutput:     "testdata/csv/foreign-amounts.ledger",
+			expError:      nil,
+		},
+		{
+			name:     "writes foreign amounts with total costs when there is no rate column",
+			skipTest: false,
+			inpCSVMapCfg: &csvMappedAcctCfg{
+				LedgerAcctName:         "Liabilities:Visa",
+				CsvDateFormat:          "2006-01-02",
+				DateCol:                1,
+				DescCol:                2,
+				MoneyCols:              []int{3},
+				NegateAmt:              false,
+				NoteCols:               []int{},
+				Currency:               "cad",
+				HeaderRow:              1,
+				ForeignAmountCol:       4,
+				ForeignCurrencyColName: "Original Currency",
+			},
+			inpLookupList: &[]lookupItem{},
+			inpCSVData:    "testdata/csv/foreign-amounts.csv",
+			expOutput:     "testdata/csv/foreign-amounts-no-rate.ledger",
+			expError:      fmt.Errorf("expect an error here"),
+		},
+		{
+			name:     "requires a foreign currency column",
+			skipTest: false,
+			inpCSVMapCfg: &csvMappedAcctCfg{
+				LedgerAcctName:   "Liabilities:Visa",
+				CsvDateFormat:    "2006-01-02",
+				DateCol:          1,
+				DescCol:          2,
+				MoneyCols:        []int{3},
+				NegateAmt:        false,
+				NoteCols:         []int{},
+				Currency:         "cad",
+				HeaderRow:        1,
+				ForeignAmountCol: 4,
+				RateCol:          6,
+			},
+			inpLookupList: &[]lookupItem{},
+			inpCSVData:    "testdata/csv/foreign-amounts.csv",
+			expOutput:     "testdata/stripe/empty-response.ledger",
+			expError:      fmt.Errorf("expect an error here"),
+		},
+		{
+			name:     "splits records over several accounts",
+			skipTest: false,
+			inpCSVMapCfg: &csvMappedAcctCfg{
+				LedgerAcctName: "Assets:Checking",
+				CsvDateFormat:  "2006-01-02",
+				DateCol:        1,
+				DescCol:        2,
+				MoneyCols:      []int{3},
+				NegateAmt:      false,
+				NoteCols:       []int{},
+				HeaderRow:      1,
+			},
+			inpLookupList: &[]lookupItem{
+				{Search: "^MORTGAGE", Description: "Mortgage", Splits: []lookupSplit{
+					{AcctName: "Liabilities:Mortgage", Amount: float64Ptr(1100)},
+					{AcctName: "Expenses:Interest", Remainder: true},
+				}},
+				{Search: "^PHONE BILL", Description: "Phone bill", Splits: []lookupSplit{
+					{AcctName: "Expenses:Business:Phone", Percent: float64Ptr(60)},
+					{AcctName: "Expenses:Phone", Percent: float64Ptr(40)},
+				}},
+				{Search: "^LOTTERY POOL$", Description: "Lottery pool", Splits: []lookupSplit{
+					{AcctName: "Expenses:Lottery:Alice", Percent: float64Ptr(33.33)},
+					{AcctName: "Expenses:Lottery:Bob", Percent: float64Ptr(33.33)},
+					{AcctName: "Expenses:Lottery:Carol", Percent: float64Ptr(33.34)},
+				}},
+			},
+			inpCSVData: "testdata/csv/split-postings.csv",
+			expOutput:  "testdata/csv/split-postings.ledger",
+			expError:   nil,
+		},
+		{
+			name:     "rejects invalid splits",
+			skipTest: false,
+			inpCSVMapCfg: &csvMappedAcctCfg{
+				LedgerAcctName: "Assets:Checking",
+				CsvDateFormat:  "2006-01-02",
+				DateCol:        1,
+				DescCol:        2,
+				MoneyCols:      []int{3},
+				NegateAmt:      false,
+				NoteCols:       []int{},
+				HeaderRow:      1,
+			},
+			inpLookupList: &[]lookupItem{
+				{Search: "^PHONE BILL", Description: "Phone bill", Splits: []lookupSplit{
+					{AcctName: "Expenses:Business:Phone", Percent: float64Ptr(60)},
+					{AcctName: "Expenses:Phone", Percent: float64Ptr(30)},
+				}},
+			},
+			inpCSVData: "testdata/csv/split-postings.csv",
+			expOutput:  "testdata/stripe/empty-response.ledger",
+			expError:   fmt.Errorf("expect an error here"),
+		},
+		{
+			name:     "requires a remainder split with fixed amounts",
+			skipTest: false,
+			inpCSVMapCfg: &csvMappedAcctCfg{
+				LedgerAcctName: "Assets:Checking",
+				CsvDateFormat:  "2006-01-02",
+				DateCol:        1,
+				DescCol:        2,
+				MoneyCols:      []int{3},
+				NegateAmt:      false,
+				NoteCols:       []int{},
+				HeaderRow:      1,
+			},
+			inpLookupList: &[]lookupItem{
+				{Search: "^MORTGAGE", Description: "Mortgage", Splits: []lookupSplit{
+					{AcctName: "Liabilities:Mortgage", Amount: float64Ptr(1100)},
+					{AcctName: "Expenses:Interest", Amount: float64Ptr(300)},
+				}},
+			},
+			inpCSVData: "testdata/csv/split-postings.csv",
+			expOutput:  "testdata/stripe/empty-response.ledger",
+			expError:   fmt.Errorf("expect an error here"),
+		},
+		{
+			name:     "errors out when the fixed splits exceed the record amount",
+			skipTest: false,
+			inpCSVMapCfg: &csvMappedAcctCfg{
+				LedgerAcctName: "Assets:Checking",
+				CsvDateFormat:  "2006-01-02",
+				DateCol:        1,
+				DescCol:        2,
+				MoneyCols:      []int{3},
+				NegateAmt:      false,
+				NoteCols:       []int{},
+				HeaderRow:      1,
+			},
+			inpLookupList: &[]lookupItem{
+				{Search: "^MORTGAGE", Description: "Mortgage", Splits: []lookupSplit{
+					{AcctName: "Liabilities:Mortgage", Amount: float64Ptr(1600)},
+					{AcctName: "Expenses:Interest", Remainder: true},
+				}},
+			},
+			inpCSVData: "testdata/csv/split-postings.csv",
+			expOutput:  "testdata/stripe/empty-response.ledger",
+			expError:   fmt.Errorf("expect an error here"),
+		},
+		{
+			name:     "rounds split amounts to the minor unit of the currency",
+			skipTest: false,
+			inpCSVMapCfg: &csvMappedAcctCfg{
+				LedgerAcctName: "Assets:Checking",
+				CsvDateFormat:  "2006-01-02",
+				DateCol:        1,
+				DescCol:        2,
+				MoneyCols:      []int{3},
+				NegateAmt:      false,
+				NoteCols:       []int{},
+				Currency:       "jpy",
+				HeaderRow:      1,
+			},
+			inpLookupList: &[]lookupItem{
+				{Search: "^LOTTERY POOL$", Description: "Lottery pool", Splits: []lookupSplit{
+					{AcctName: "Expenses:Lottery:Alice", Percent: float64Ptr(33.33)},
+					{AcctName: "Expenses:Lottery:Bob", Percent: float64Ptr(33.33)},
+					{AcctName: "Expenses:Lottery:Carol", Percent: float64Ptr(33.34)},
+				}},
+				{Search: "^RENT$", Description: "Rent", Splits: []lookupSplit{
+					{AcctName: "Expenses:Rent", Amount: float64Ptr(50000.4)},
+					{AcctName: "Expenses:Business:Office", Percent: float64Ptr(10)},
+					{AcctName: "Expenses:Utilities", Remainder: true},
+				}},
+			},
+			inpCSVData: "testdata/csv/split-postings-jpy.csv",
+			expOutput:  "testdata/csv/split-postings-jpy.ledger",
+			expError:   nil,
+		},
+		{
+			name:     "rounds split amounts to the minor unit of a mapped currency",
+			skipTest: false,
+			inpCSVMapCfg: &csvMappedAcctCfg{
+				LedgerAcctName: "Assets:Checking",
+				CsvDateFormat:  "2006-01-02",
+				DateCol:        1,
+				DescCol:        2,
+				MoneyCols:      []int{3},
+				NegateAmt:      false,
+				NoteCols:       []int{},
+				CurrencyCol:    4,
+				CurrencyMap:    map[string]string{"jpy": "¥"},
+				HeaderRow:      1,
+			},
+			inpLookupList: &[]lookupItem{
+				{Search: "^LOTTERY POOL$", Description: "Lottery pool", Splits: []lookupSplit{
+					{AcctName: "Expenses:Lottery:Alice", Percent: float64Ptr(33.33)},
+					{AcctName: "Expenses:Lottery:Bob", Percent: float64Ptr(33.33)},
+					{AcctName: "Expenses:Lottery:Carol", Percent: float64Ptr(33.34)},
+				}},
+				{Search: "^RENT$", Description: "Rent", Splits: []lookupSplit{
+					{AcctName: "Expenses:Rent", Amount: float64Ptr(50000.4)},
+					{AcctName: "Expenses:Business:Office", Percent: float64Ptr(10)},
+					{AcctName: "Expenses:Utilities", Remainder: true},
+				}},
+			},
+			inpCSVData: "testdata/csv/split-postings-jpy-mapped.csv",
+			expOutput:  "testdata/csv/split-postings-jpy-mapped.ledger",
+			expError:   nil,
+		},
+		{
+			name:     "adds tags and metadata from the lookup list",
+			skipTest: false,
+			inpCSVMapCfg: &csvMappedAcctCfg{
+				LedgerAcctName: "Assets:Checking",
+				CsvDateFormat:  "2006-01-02",
+				DateCol:        1,
+				DescCol:        2,
+				MoneyCols:      []int{3},
+				NegateAmt:      false,
+				NoteCols:       []int{},
+				HeaderRow:      1,
+			},
+			inpLookupList: &[]lookupItem{
+				{
+					Search:      "^MORTGAGE",
+					AcctName:    "Expenses:Housing",
+					Description: "Mortgage",
+					Payee:       "First National Bank",
+					Tags:        []string{"housing", "recurring"},
+					Metadata:    []string{"Loan: 12-3456"},
+				},
+				{
+					Search:          "^PHONE BILL",
+					Description:     "Phone bill",
+					Tags:            []string{"business"},
+					PostingMetadata: []string{"Project: acme"},
+					Splits: []lookupSplit{
+						{AcctName: "Expenses:Business:Phone", Percent: float64Ptr(60)},
+						{AcctName: "Expenses:Phone", Percent: float64Ptr(40)},
+					},
+				},
+				{
+					Search:      "^LOTTERY POOL$",
+					AcctName:    "Expenses:Lottery",
+					Description: "Lottery pool",
+					PostingTags: []string{"shared"},
+				},
+			},
+			inpCSVData: "testdata/csv/split-postings.csv",
+			expOutput:  "testdata/csv/tags-metadata.ledger",
+			expError:   nil,
+		},
+		{
+			name:     "rejects invalid metadata",
+			skipTest: false,
+			inpCSVMapCfg: &csvMappedAcctCfg{
+				LedgerAcctName: "Assets:Checking",
+				CsvDateFormat:  "2006-01-02",
+				DateCol:        1,
+				DescCol:        2,
+				MoneyCols:      []int{3},
+				NegateAmt:      false,
+				NoteCols:       []int{},
+				HeaderRow:      1,
+			},
+			inpLookupList: &[]lookupItem{
+				{Search: "^MORTGAGE", AcctName: "Expenses:Housing", Metadata: []string{"Loan number 12-3456"}},
+			},
+			inpCSVData: "testdata/csv/split-postings.csv",
+			expOutput:  "testdata/stripe/empty-response.ledger",
+			expError:   fmt.Errorf("expect an error here"),
+		},
 	}
 
 	for _, tc := range tests {
@@ -227,3 +1083,50 @@ func TestCSVInputs(t *testing.T) {
 		})
 	}
 }
+
+func TestParseRawMoneyValue(t *testing.T) {
+	type test struct {
+		name     string
+		inpValue string
+		inpCfg   csvMappedAcctCfg
+		expValue string
+		expError bool
+	}
+
+	tests := []test{
+		{name: "plain value", inpValue: "45.00", expValue: "45"},
+		{name: "currency symbol", inpValue: "-$1,045.50", expValue: "-1045.5"},
+		{name: "configured currency code", inpValue: "EUR 12.50", inpCfg: csvMappedAcctCfg{Currency: "eur"}, expValue: "12.5"},
+		{name: "currency_map symbol", inpValue: "12.50 US$", inpCfg: csvMappedAcctCfg{CurrencyMap: map[string]string{"us$": "USD"}}, expValue: "12.5"},
+		{name: "unknown currency code", inpValue: "GBP 12.50", inpCfg: csvMappedAcctCfg{Currency: "eur"}, expError: true},
+		{name: "stray letters", inpValue: "12abc", expError: true},
+		{name: "stray leading letters", inpValue: "abc12", expError: true},
+		{name: "stray characters", inpValue: "#12.50", expError: true},
+		{name: "DR suffix", inpValue: "45.00 DR", inpCfg: csvMappedAcctCfg{CreditDebitSfx: true}, expValue: "-45"},
+		{name: "DR suffix without a space", inpValue: "45.00DR", inpCfg: csvMappedAcctCfg{CreditDebitSfx: true}, expValue: "-45"},
+		{name: "CR suffix without a space", inpValue: "45.00cr", inpCfg: csvMappedAcctCfg{CreditDebitSfx: true}, expValue: "45"},
+		{name: "DR suffix when not enabled", inpValue: "45.00 DR", expError: true},
+		{name: "DR suffix without a space when not enabled", inpValue: "45.00DR", expError: true},
+		{name: "CR suffix without a space when not enabled", inpValue: "45.00CR", expError: true},
+		{name: "sign and DR suffix", inpValue: "-45.00DR", inpCfg: csvMappedAcctCfg{CreditDebitSfx: true}, expError: true},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			var logger = log.WithFields(log.Fields{"name": "slc-testing"})
+			runner := NewCSVRunner(&bytes.Buffer{}, viperlib.New(), logger, &StubProgressBar{})
+
+			result, err := runner.parseRawMoneyValue(tc.inpValue, false, &tc.inpCfg)
+			if tc.expError {
+				assert.NotNil(t, err)
+				return
+			}
+			assert.Nil(t, err)
+			assert.Equal(t, tc.expValue, result.Text('f', -1))
+		})
+	}
+}
+
+func float64Ptr(val float64) *float64 {
+	return &val
+}
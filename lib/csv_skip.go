@@ -0,0 +1,76 @@
+package lib
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// csvSkipPattern describes rows that should be ignored, such as "Pending"
+// transactions or subtotal lines. The pattern is matched against a single
+// column if one is specified, otherwise against the whole row (with the
+// fields joined by commas).
+type csvSkipPattern struct {
+	Pattern    string `mapstructure:"pattern"`
+	Column     int    `mapstructure:"column,omitempty"`
+	ColumnName string `mapstructure:"column_name,omitempty"`
+}
+
+func (c *csvMappedAcctCfg) compileSkipPatterns() ([]*regexp.Regexp, error) {
+	if c.SkipRowsBefore < 0 {
+		return nil, fmt.Errorf("Invalid skip_rows_before value '%d'", c.SkipRowsBefore)
+	}
+	if c.SkipRowsAfter < 0 {
+		return nil, fmt.Errorf("Invalid skip_rows_after value '%d'", c.SkipRowsAfter)
+	}
+	// Both count rows from the top of the file, so the header row needs to
+	// come after the skipped ones
+	if c.HeaderRow > 0 && c.HeaderRow <= c.SkipRowsBefore {
+		return nil, fmt.Errorf("The header_row (%d) is one of the rows skipped by skip_rows_before (%d). Both count rows from the top of the file, so the header_row needs to be greater than skip_rows_before", c.HeaderRow, c.SkipRowsBefore)
+	}
+
+	var rgxs []*regexp.Regexp
+	for idx, sp := range c.SkipPatterns {
+		if sp.Column < 0 {
+			return nil, fmt.Errorf("Invalid column '%d' in skip pattern #%d", sp.Column, idx+1)
+		}
+		if sp.Column != 0 && sp.ColumnName != "" {
+			return nil, fmt.Errorf("Only one of 'column' or 'column_name' can be specified in skip pattern #%d", idx+1)
+		}
+		rgx, err := regexp.Compile(sp.Pattern)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid regular expression '%s' in skip pattern #%d: %v", sp.Pattern, idx+1, err)
+		}
+		rgxs = append(rgxs, rgx)
+	}
+	return rgxs, nil
+}
+
+// hasSkipRules returns true if the mapping skips rows, which usually means
+// that the file contains records with a different number of fields
+func (c *csvMappedAcctCfg) hasSkipRules() bool {
+	return c.SkipRowsBefore > 0 || c.SkipRowsAfter > 0 || len(c.SkipPatterns) > 0
+}
+
+func (imp *csvImport) shouldSkipRecord(record []string, lineNumber int) bool {
+	cfg := imp.cfg
+	if lineNumber <= cfg.SkipRowsBefore {
+		return true
+	}
+
+	for idx, sp := range cfg.SkipPatterns {
+		var val string
+		if sp.Column > 0 {
+			if sp.Column > len(record) {
+				continue
+			}
+			val = record[sp.Column-1]
+		} else {
+			val = strings.Join(record, ",")
+		}
+		if imp.skipPatterns[idx].MatchString(val) {
+			return true
+		}
+	}
+	return false
+}
@@ -163,12 +163,6 @@ func TestCSVFlow(t *testing.T) {
 				NoteCols:       []int{},
 				Currency:       "eur",
 			},
-			expCSVLookupList: &[]lookupItem{
-				{
-					Search:   "[0-9]++",
-					AcctName: "Assets:NewBankAccount",
-				},
-			},
 			expError: fmt.Errorf("expect an error here"),
 		},
 		{
@@ -200,22 +194,22 @@ func TestCSVFlow(t *testing.T) {
 			},
 			expCSVLookupList: &[]lookupItem{
 				{
-					Search:      "Withdrawal Transfer to       acct123                                             ",
+					Search:      "^Withdrawal Transfer to       acct123                                             $",
 					AcctName:    "Expenses:Unknown",
 					Description: "Withdrawal Transfer to       acct123                                             ",
 				},
 				{
-					Search:      "External Deposit             Miscellaneous Payments       STRIPE ABCD123K8E  ",
+					Search:      "^External Deposit             Miscellaneous Payments       STRIPE ABCD123K8E  $",
 					AcctName:    "Expenses:Unknown",
 					Description: "External Deposit             Miscellaneous Payments       STRIPE ABCD123K8E  ",
 				},
 				{
-					Search:      "Maintenance Service Charge                                                            ",
+					Search:      "^Maintenance Service Charge                                                            $",
 					AcctName:    "Expenses:Unknown",
 					Description: "Maintenance Service Charge                                                            ",
 				},
 				{
-					Search:      "External Deposit             Miscellaneous Payments       STRIPE ABCD123J2Q  ",
+					Search:      "^External Deposit             Miscellaneous Payments       STRIPE ABCD123J2Q  $",
 					AcctName:    "Expenses:Unknown",
 					Description: "External Deposit             Miscellaneous Payments       STRIPE ABCD123J2Q  ",
 				},
@@ -262,17 +256,7 @@ func TestCSVFlow(t *testing.T) {
 			},
 			expCSVLookupList: &[]lookupItem{
 				{
-					Search:      "(?i)withdrawal.*to.*acct123",
-					AcctName:    "Assets:Scotiabank",
-					Description: "Cash Transfer",
-				},
-				{
-					Search:      "(?i)external deposit .*stripe",
-					AcctName:    "Income:Stripe",
-					Description: "Revenue",
-				},
-				{
-					Search:      "Maintenance Service Charge                                                            ",
+					Search:      "^Maintenance Service Charge                                                            $",
 					AcctName:    "Expenses:Unknown",
 					Description: "Maintenance Service Charge                                                            ",
 				},
@@ -313,10 +297,17 @@ func TestCSVFlow(t *testing.T) {
 				v.Set("ledger_account_lookups", tc.inpLookupList)
 			}
 
+			state, err := OpenRunState(appFs, "/slcstate.yml", "/slcproposals.yml")
+			if err != nil {
+				t.Fatalf("Unable to open the state file: %v", err)
+			}
+			defer state.Close()
+
 			var logger = log.WithFields(log.Fields{"name": "slc-testing"})
 			var output bytes.Buffer
 			bar := &StubProgressBar{}
 			runner := NewCSVRunner(&output, v, logger, bar)
+			runner.SetRunState(state)
 
 			expOutput, err := ioutil.ReadFile(tc.expOutput)
 			if err != nil {
@@ -331,8 +322,13 @@ func TestCSVFlow(t *testing.T) {
 			}
 			assert.Equal(t, string(expOutput), output.String())
 
+			// Stub mappings are proposed, rather than written to the config
+			mappingSrc := v
+			if !tc.inpIsMappingKeyPresent {
+				mappingSrc = readSavedState(t, appFs, "/slcproposals.yml")
+			}
 			var mappedCfg csvMappedAcctCfg
-			err = v.UnmarshalKey(csvMappingKeyFullName, &mappedCfg)
+			err = mappingSrc.UnmarshalKey(csvMappingKeyFullName, &mappedCfg)
 			if err != nil {
 				t.Fatalf("Unable to unmarshal config key %s", csvMappingKeyFullName)
 			}
@@ -340,12 +336,156 @@ func TestCSVFlow(t *testing.T) {
 
 			if tc.expCSVLookupList != nil {
 				var nameLookupList []lookupItem
-				err = v.UnmarshalKey("ledger_account_lookups", &nameLookupList)
+				err = readSavedState(t, appFs, "/slcstate.yml").UnmarshalKey(LOOKUPS_STATE_KEY, &nameLookupList)
 				if err != nil {
-					t.Fatalf("Unable to unmarshal config key %s", "ledger_account_lookups")
+					t.Fatalf("Unable to unmarshal state key %s", LOOKUPS_STATE_KEY)
 				}
 				assert.Equal(t, tc.expCSVLookupList, &nameLookupList)
 			}
+
+			cfgData, _ := afero.ReadFile(appFs, "/slcconfig.yml")
+			assert.Equal(t, "---", string(cfgData), "the config file is left alone")
+		})
+	}
+}
+
+func TestCSVImportHistory(t *testing.T) {
+	type test struct {
+		name           string
+		skipTest       bool
+		inpCSVData     []string
+		inpBalanceCol  int
+		inpHistoryDays int
+		inpState       string
+		expOutput      []string
+		expErrors      []bool
+		expNumImported int
+	}
+
+	tests := []test{
+		{
+			name:           "skips records that were imported in a previous run",
+			skipTest:       false,
+			inpCSVData:     []string{"testdata/csv/two-money-columns-4.csv", "testdata/csv/two-money-columns-4.csv"},
+			expOutput:      []string{"testdata/csv/two-money-columns-4.ledger", "testdata/stripe/empty-response.ledger"},
+			expNumImported: 3,
+		},
+		{
+			name:           "keeps legitimate same-day duplicates",
+			skipTest:       false,
+			inpCSVData:     []string{"testdata/csv/same-day-duplicates.csv", "testdata/csv/same-day-duplicates.csv"},
+			expOutput:      []string{"testdata/csv/same-day-duplicates.ledger", "testdata/stripe/empty-response.ledger"},
+			expNumImported: 3,
+		},
+		{
+			name:           "only imports new records from overlapping statements",
+			skipTest:       false,
+			inpCSVData:     []string{"testdata/csv/overlap-statement-1.csv", "testdata/csv/overlap-statement-2.csv"},
+			expOutput:      []string{"testdata/csv/overlap-statement-1.ledger", "testdata/csv/overlap-statement-2.ledger"},
+			expNumImported: 4,
+		},
+		{
+			name:           "does not record held back records when a later record fails",
+			skipTest:       false,
+			inpCSVData:     []string{"testdata/csv/held-back-records-bad-row.csv", "testdata/csv/held-back-records.csv"},
+			inpBalanceCol:  6,
+			expOutput:      []string{"testdata/stripe/empty-response.ledger", "testdata/csv/held-back-records.ledger"},
+			expErrors:      []bool{true, false},
+			expNumImported: 3,
+		},
+		{
+			name:           "drops the fingerprints of records that are older than the retention period",
+			skipTest:       false,
+			inpCSVData:     []string{"testdata/csv/overlap-statement-1.csv", "testdata/csv/later-statement.csv"},
+			inpHistoryDays: 30,
+			expOutput:      []string{"testdata/csv/overlap-statement-1.ledger", "testdata/csv/later-statement.ledger"},
+			expNumImported: 2,
+		},
+		{
+			name:           "keeps the fingerprints saved by earlier versions",
+			skipTest:       false,
+			inpCSVData:     []string{"testdata/csv/overlap-statement-2.csv"},
+			inpHistoryDays: 1,
+			inpState:       "csv:\n  import_history:\n    test_cc_account:\n    - f1003ce3d8ff0105\n    - a6da9ef9815a2e9a\n    - b44989139714231f\n",
+			expOutput:      []string{"testdata/csv/overlap-statement-2.ledger"},
+			expNumImported: 4,
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			csvMappingKeyName := "test_cc_account"
+			csvMappingKeyFullName := fmt.Sprintf("csv.account.%s", csvMappingKeyName)
+
+			if tc.skipTest {
+				t.Skip(fmt.Sprintf("Skipping test: %s", tc.name))
+			}
+
+			appFs := afero.NewMemMapFs()
+			v := viperlib.New()
+			v.SetFs(appFs)
+			v.SetDefault("date_format_string", "2006-01-02")
+			v.SetConfigName("slcconfig")
+			v.AddConfigPath("/")
+			afero.WriteFile(appFs, "/slcconfig.yml", []byte("---"), 0644)
+			v.ReadInConfig()
+			v.Set(csvMappingKeyFullName, &csvMappedAcctCfg{
+				LedgerAcctName:    "Assets:Bank123",
+				CsvDateFormat:     "02.01.2006",
+				DateCol:           1,
+				DescCol:           2,
+				MoneyCols:         []int{4, 5},
+				NegateAmt:         false,
+				NoteCols:          []int{3},
+				Currency:          "usd",
+				BalanceCol:        tc.inpBalanceCol,
+				ImportHistoryDays: tc.inpHistoryDays,
+			})
+
+			if tc.inpState != "" {
+				afero.WriteFile(appFs, "/slcstate.yml", []byte(tc.inpState), 0644)
+			}
+
+			for idx, inpCSVData := range tc.inpCSVData {
+				csvFixture, err := os.Open(inpCSVData)
+				if err != nil {
+					t.Fatalf("Unable to read fixtures file %s", inpCSVData)
+				}
+				defer csvFixture.Close()
+
+				expOutput, err := ioutil.ReadFile(tc.expOutput[idx])
+				if err != nil {
+					t.Fatalf("Unable to read expected output file %s", tc.expOutput[idx])
+				}
+
+				// Each run locks and reads the state file left by the previous one
+				state, err := OpenRunState(appFs, "/slcstate.yml", "/slcproposals.yml")
+				if err != nil {
+					t.Fatalf("Unable to open the state file: %v", err)
+				}
+
+				var logger = log.WithFields(log.Fields{"name": "slc-testing"})
+				var output bytes.Buffer
+				bar := &StubProgressBar{}
+				runner := NewCSVRunner(&output, v, logger, bar)
+				runner.SetRunState(state)
+
+				result := runner.GenerateLedgerEntries(csvFixture, csvMappingKeyName)
+				if len(tc.expErrors) > idx && tc.expErrors[idx] {
+					assert.NotNil(t, result)
+				} else {
+					assert.Nil(t, result)
+				}
+				assert.Equal(t, string(expOutput), output.String())
+				assert.Nil(t, state.Close())
+			}
+
+			var history []string
+			err := readSavedState(t, appFs, "/slcstate.yml").UnmarshalKey(fmt.Sprintf("%s.%s", CSV_IMPORT_HISTORY_KEY, csvMappingKeyName), &history)
+			if err != nil {
+				t.Fatalf("Unable to unmarshal the import history for %s", csvMappingKeyName)
+			}
+			assert.Equal(t, tc.expNumImported, len(history))
 		})
 	}
 }
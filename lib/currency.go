@@ -0,0 +1,53 @@
+package lib
+
+import (
+	"fmt"
+	"math/big"
+	"strings"
+)
+
+// Number of decimals in the minor unit of the (ISO 4217) currencies that do not
+// have two. Amounts in all other currencies are in cents. See
+// https://stripe.com/docs/currencies#zero-decimal
+var currencyExponents = map[string]int{
+	// Zero-decimal currencies
+	"BIF": 0,
+	"CLP": 0,
+	"DJF": 0,
+	"GNF": 0,
+	"JPY": 0,
+	"KMF": 0,
+	"KRW": 0,
+	"MGA": 0,
+	"PYG": 0,
+	"RWF": 0,
+	"UGX": 0,
+	"VND": 0,
+	"VUV": 0,
+	"XAF": 0,
+	"XOF": 0,
+	"XPF": 0,
+
+	// Three-decimal currencies
+	"BHD": 3,
+	"JOD": 3,
+	"KWD": 3,
+	"OMR": 3,
+	"TND": 3,
+}
+
+// currencyExponent returns the number of decimals in the minor unit of an ISO
+// currency code, e.g. 2 for USD or 0 for JPY
+func currencyExponent(currency string) int {
+	if exp, ok := currencyExponents[strings.ToUpper(currency)]; ok {
+		return exp
+	}
+	return 2
+}
+
+// roundToMinorUnit rounds an amount to the supplied number of decimals, e.g. to
+// the cent for USD or to a whole yen for JPY
+func roundToMinorUnit(val *big.Float, exponent int) *big.Float {
+	res, _ := Zero().SetString(fmt.Sprintf("%.*f", exponent, val))
+	return res
+}
@@ -0,0 +1,168 @@
+package lib
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"math/big"
+	"regexp"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	viperlib "github.com/spf13/viper"
+)
+
+const CSV_IMPORT_HISTORY_KEY = "csv.import_history"
+const CSV_IMPORT_HISTORY_DAYS = 365
+const FINGERPRINT_COMMENT_KEY = "Fingerprint"
+
+var fingerprintWhitespaceRgx = regexp.MustCompile(`\s+`)
+
+// importHistory keeps track of the fingerprints of the imported records. Each
+// fingerprint is saved along with the date of its record (e.g. "2021-08-03
+// 1cafaed275c95ed6"), so that the ones that are too old to show up in an
+// overlapping statement again can be dropped. Fingerprints saved by earlier
+// versions do not have a date, and are kept as-is.
+type importHistory struct {
+	key          string
+	fingerprints []string
+	dates        map[string]string
+	state        *RunState
+	logger       *log.Entry
+
+	// Fingerprints of records dated more than this many days before the
+	// oldest record of this run are dropped
+	retentionDays int
+	oldest        time.Time
+}
+
+func initializeImportHistory(l *log.Entry, v *viperlib.Viper, state *RunState, mappedAcct string, retentionDays int) (*importHistory, error) {
+	var entries []string
+	key := fmt.Sprintf("%s.%s", CSV_IMPORT_HISTORY_KEY, mappedAcct)
+
+	if err := state.lookup(key, v).UnmarshalKey(key, &entries); err != nil {
+		l.WithError(err).Errorf("Unable to decode state key %s", key)
+		return nil, err
+	}
+	l.Debugf("Decoded import history key %s with %d entries", key, len(entries))
+
+	var fingerprints []string
+	dates := make(map[string]string)
+	for _, entry := range entries {
+		var date, fp string
+		if fields := strings.Fields(entry); len(fields) == 2 {
+			date, fp = fields[0], fields[1]
+		} else {
+			fp = entry
+		}
+		if _, ok := dates[fp]; !ok {
+			fingerprints = append(fingerprints, fp)
+		}
+		dates[fp] = date
+	}
+
+	return &importHistory{
+		key:           key,
+		fingerprints:  fingerprints,
+		dates:         dates,
+		state:         state,
+		logger:        l,
+		retentionDays: retentionDays,
+	}, nil
+}
+
+// track notes the date of a record in this run. The history is pruned
+// relative to the oldest one when it is saved.
+func (h *importHistory) track(date time.Time) {
+	if h.oldest.IsZero() || date.Before(h.oldest) {
+		h.oldest = date
+	}
+}
+
+func (h *importHistory) contains(fingerprint string) bool {
+	_, ok := h.dates[fingerprint]
+	return ok
+}
+
+func (h *importHistory) add(fingerprint string, date time.Time) {
+	if h.contains(fingerprint) {
+		return
+	}
+	h.dates[fingerprint] = date.Format("2006-01-02")
+	h.fingerprints = append(h.fingerprints, fingerprint)
+}
+
+// persistData saves the fingerprints, leaving out the ones of records dated
+// more than the retention period before the oldest record of this run
+func (h *importHistory) persistData() error {
+	var cutoff string
+	if !h.oldest.IsZero() {
+		cutoff = h.oldest.AddDate(0, 0, -h.retentionDays).Format("2006-01-02")
+	}
+
+	var entries []string
+	numPruned := 0
+	for _, fp := range h.fingerprints {
+		date := h.dates[fp]
+		switch {
+		case date == "":
+			entries = append(entries, fp)
+		case date < cutoff:
+			numPruned++
+		default:
+			entries = append(entries, fmt.Sprintf("%s %s", date, fp))
+		}
+	}
+	if numPruned > 0 {
+		h.logger.Debugf("Dropped %d fingerprints of records dated before %s from import history key %s", numPruned, cutoff, h.key)
+	}
+
+	h.state.set(h.key, entries)
+	return nil
+}
+
+// transactionFingerprinter generates stable identifiers for CSV records. Rows
+// that are otherwise identical on the same day (e.g. two coffees for the same
+// amount) are told apart by the order in which they appear.
+type transactionFingerprinter struct {
+	mappedAcct  string
+	occurrences map[string]int
+}
+
+func newTransactionFingerprinter(mappedAcct string) *transactionFingerprinter {
+	return &transactionFingerprinter{
+		mappedAcct:  mappedAcct,
+		occurrences: make(map[string]int),
+	}
+}
+
+// fingerprint returns the identifier for a single record. The currency is left
+// out if it is empty.
+func (f *transactionFingerprinter) fingerprint(date time.Time, amount *big.Float, currency string, description string, notes []string) string {
+	var normalizedNotes []string
+	for _, note := range notes {
+		normalizedNotes = append(normalizedNotes, normalizeFingerprintField(note))
+	}
+
+	amountVal := fmt.Sprintf("%.4f", amount)
+	if currency != "" {
+		amountVal = fmt.Sprintf("%s %s", amountVal, currency)
+	}
+
+	base := strings.Join([]string{
+		f.mappedAcct,
+		date.Format("2006-01-02"),
+		amountVal,
+		normalizeFingerprintField(description),
+		strings.Join(normalizedNotes, "\x1f"),
+	}, "\x1e")
+
+	f.occurrences[base]++
+	sum := sha256.Sum256([]byte(fmt.Sprintf("%s\x1e%d", base, f.occurrences[base])))
+	return hex.EncodeToString(sum[:8])
+}
+
+func normalizeFingerprintField(val string) string {
+	return strings.TrimSpace(fingerprintWhitespaceRgx.ReplaceAllString(val, " "))
+}
@@ -11,6 +11,7 @@ import (
 type LedgerTransaction struct {
 	date        time.Time
 	dateFormat  string
+	precision   int
 	isCleared   bool
 	description string
 	comments    []string
@@ -21,20 +22,80 @@ type TransactionPosting struct {
 	Account  string
 	Amount   *big.Float
 	Currency string
+
+	// Optional balance assertion, i.e. the expected account balance after this
+	// posting
+	BalanceAssertion *big.Float
+
+	// Optional cost of this posting in another commodity. This is either the
+	// per unit price (e.g. 45.00 USD @ 1.36 CAD) or, if IsTotalCost is set, the
+	// total cost of the posting (e.g. 45.00 USD @@ 61.20 CAD).
+	Cost         *big.Float
+	CostCurrency string
+	IsTotalCost  bool
+
+	// Optional comments (tags & metadata) written out below this posting
+	Comments []string
+}
+
+func (p *TransactionPosting) AddComment(comment string) {
+	comment = strings.TrimSpace(comment)
+	if comment != "" {
+		p.Comments = append(p.Comments, comment)
+	}
+}
+
+func (p *TransactionPosting) AddKeyValComment(key string, val string) {
+	key = strings.TrimSpace(key)
+	val = strings.TrimSpace(val)
+	if key != "" && val != "" {
+		p.Comments = append(p.Comments, fmt.Sprintf("%s: %s", key, val))
+	}
+}
+
+func (p *TransactionPosting) AddTags(tags []string) {
+	p.AddComment(formatTags(tags))
+}
+
+// weight returns the amount (and commodity) this posting contributes towards
+// balancing its transaction
+func (p TransactionPosting) weight() (*big.Float, string) {
+	if p.Cost == nil {
+		return p.Amount, strings.ToUpper(p.Currency)
+	}
+
+	if p.IsTotalCost {
+		cost := Zero().Abs(p.Cost)
+		if p.Amount.Sign() < 0 {
+			cost.Neg(cost)
+		}
+		return cost, strings.ToUpper(p.CostCurrency)
+	}
+	return Zero().Mul(p.Amount, p.Cost), strings.ToUpper(p.CostCurrency)
 }
 
 func NewLedgerTransaction(date time.Time, desc string, lines []TransactionPosting) (*LedgerTransaction, error) {
-	sum := Zero()
+	// Postings must balance out for each commodity separately
+	var commodities []string
+	sums := make(map[string]*big.Float)
 	for _, line := range lines {
-		sum.Add(sum, line.Amount)
+		amount, commodity := line.weight()
+		if _, ok := sums[commodity]; !ok {
+			commodities = append(commodities, commodity)
+			sums[commodity] = Zero()
+		}
+		sums[commodity].Add(sums[commodity], amount)
 	}
-	if !approxEquals(sum, Zero()) {
-		return nil, fmt.Errorf("The items in this ledger transaction appear to be unbalanced. The amounts in these ledger posting should balance out to 0, but results in %.4f instead. Lines: %v", sum, lines)
+	for _, commodity := range commodities {
+		if sum := sums[commodity]; !approxEquals(sum, Zero()) {
+			return nil, fmt.Errorf("The items in this ledger transaction appear to be unbalanced. The amounts in these ledger posting should balance out to 0, but results in %.4f %s instead. Lines: %v", sum, commodity, lines)
+		}
 	}
 
 	return &LedgerTransaction{
 		date:        date,
 		dateFormat:  "2006-01-02",
+		precision:   4,
 		isCleared:   true,
 		description: desc,
 		comments:    []string{},
@@ -48,6 +109,14 @@ func (l *LedgerTransaction) SetDateFormat(format string) {
 	}
 }
 
+// SetPrecision sets the number of decimals that the posting amounts (and
+// balance assertions) are written out with
+func (l *LedgerTransaction) SetPrecision(precision int) {
+	if precision >= 0 {
+		l.precision = precision
+	}
+}
+
 func (l *LedgerTransaction) sanitizeDescription() {
 	rgx := regexp.MustCompile(`\s+`)
 	s := rgx.ReplaceAllString(l.description, " ")
@@ -69,6 +138,24 @@ func (l *LedgerTransaction) AddKeyValComment(key string, val string) {
 	}
 }
 
+// AddTags adds a comment line with the supplied tags, e.g. :business:travel:
+func (l *LedgerTransaction) AddTags(tags []string) {
+	l.AddComment(formatTags(tags))
+}
+
+func formatTags(tags []string) string {
+	var res []string
+	for _, tag := range tags {
+		if tag = strings.TrimSpace(tag); tag != "" {
+			res = append(res, tag)
+		}
+	}
+	if len(res) == 0 {
+		return ""
+	}
+	return fmt.Sprintf(":%s:", strings.Join(res, ":"))
+}
+
 func (l *LedgerTransaction) String() string {
 	var res strings.Builder
 
@@ -103,22 +190,62 @@ func (l *LedgerTransaction) String() string {
 			acctStrLen = len(line.Account)
 		}
 
-		if len(fmt.Sprintf("%.4f", line.Amount)) > amtStrLen {
-			amtStrLen = len(fmt.Sprintf("%.4f", line.Amount))
+		if len(fmt.Sprintf("%.*f", l.precision, line.Amount)) > amtStrLen {
+			amtStrLen = len(fmt.Sprintf("%.*f", l.precision, line.Amount))
 		}
 	}
 
 	// transaction lines: e.g. Liabilities:SalesTax  -2.82 USD
 	for _, line := range l.lines {
 		res.WriteString(fmt.Sprintf(
-			"%4s%-*s    %*.4f %s\n",
+			"%4s%-*s    %*.*f %s",
 			"", // indent
 			acctStrLen,
 			line.Account,
 			amtStrLen,
+			l.precision,
 			line.Amount,
 			strings.ToUpper(line.Currency),
 		))
+
+		// cost: e.g. Expenses:Travel  45.00 USD @@ 61.20 CAD
+		if line.Cost != nil {
+			if line.IsTotalCost {
+				res.WriteString(fmt.Sprintf(
+					" @@ %.4f %s",
+					Zero().Abs(line.Cost),
+					strings.ToUpper(line.CostCurrency),
+				))
+			} else {
+				// Per unit prices are written out in full, as rounding them
+				// would unbalance the transaction
+				res.WriteString(fmt.Sprintf(
+					" @ %s %s",
+					line.Cost.Text('f', -1),
+					strings.ToUpper(line.CostCurrency),
+				))
+			}
+		}
+
+		// balance assertion: e.g. Assets:Bank  -0.01 EUR = 70.29 EUR
+		if line.BalanceAssertion != nil {
+			res.WriteString(fmt.Sprintf(
+				" = %.*f %s",
+				l.precision,
+				line.BalanceAssertion,
+				strings.ToUpper(line.Currency),
+			))
+		}
+		res.WriteString("\n")
+
+		// posting comment lines: e.g. ; Project: acme
+		for _, comment := range line.Comments {
+			res.WriteString(fmt.Sprintf(
+				"%8s; %s\n",
+				"", // indent
+				comment,
+			))
+		}
 	}
 
 	return res.String()
@@ -128,12 +255,6 @@ func (l *LedgerTransaction) formatDate(date int64) string {
 	return time.Unix(date, 0).Format(l.dateFormat)
 }
 
-func (l *LedgerTransaction) formatUnitAmount(amount int64, currency string) string {
-	// amount / 100
-	res := Zero().Quo(Zero().SetInt64(amount), Zero().SetFloat64(100))
-	return fmt.Sprintf("%.4f %s", res, strings.ToUpper(currency))
-}
-
 func Zero() *big.Float {
 	r := big.NewFloat(0.0)
 	r.SetPrec(64)
@@ -0,0 +1,173 @@
+package lib
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"math/big"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// journalTransaction is a (simplified) transaction read from an existing
+// Ledger journal file
+type journalTransaction struct {
+	date     time.Time
+	payee    string
+	metadata map[string]string
+	postings []journalPosting
+}
+
+type journalPosting struct {
+	account string
+
+	// nil for postings with an elided amount
+	amount *big.Float
+}
+
+var journalHeaderRgx = regexp.MustCompile(`^(\d{4}[-/.]\d{1,2}[-/.]\d{1,2})(?:=\S+)?\s+(?:[*!]\s*)?(?:\([^)]*\)\s*)?(.*)$`)
+var journalSeparatorRgx = regexp.MustCompile(`\t|  `)
+var journalAmountRgx = regexp.MustCompile(`(-?)\s*[^\d\s-]*\s*(-?)([\d,]*\.?\d+)`)
+
+// parseLedgerJournal reads the transactions of a Ledger journal. Directives,
+// automated and periodic transactions, as well as anything else it does not
+// understand are skipped.
+func parseLedgerJournal(inp io.Reader) ([]journalTransaction, error) {
+	var res []journalTransaction
+	var current *journalTransaction
+
+	scanner := bufio.NewScanner(inp)
+	for scanner.Scan() {
+		line := strings.TrimRight(scanner.Text(), " \t\r")
+		trimmed := strings.TrimSpace(line)
+
+		if trimmed == "" {
+			current.inferElidedAmount()
+			current = nil
+			continue
+		}
+
+		isIndented := line[0] == ' ' || line[0] == '\t'
+		if !isIndented {
+			current.inferElidedAmount()
+			current = nil
+			match := journalHeaderRgx.FindStringSubmatch(line)
+			if match == nil {
+				continue
+			}
+			date, err := parseJournalDate(match[1])
+			if err != nil {
+				continue
+			}
+
+			payee := match[2]
+			if idx := strings.Index(payee, "  ;"); idx >= 0 {
+				payee = payee[:idx]
+			}
+			res = append(res, journalTransaction{
+				date:     date,
+				payee:    strings.TrimSpace(payee),
+				metadata: make(map[string]string),
+			})
+			current = &res[len(res)-1]
+			continue
+		}
+
+		if current == nil {
+			continue
+		}
+
+		if strings.HasPrefix(trimmed, ";") {
+			// e.g. "; Payee: Coffee Bar"
+			comment := strings.TrimSpace(strings.TrimPrefix(trimmed, ";"))
+			if parts := strings.SplitN(comment, ":", 2); len(parts) == 2 && !strings.ContainsAny(parts[0], " \t") && parts[0] != "" {
+				current.metadata[strings.ToLower(parts[0])] = strings.TrimSpace(parts[1])
+			}
+			continue
+		}
+
+		posting, ok := parseJournalPosting(trimmed)
+		if ok {
+			current.postings = append(current.postings, posting)
+		}
+	}
+
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	current.inferElidedAmount()
+	return res, nil
+}
+
+// inferElidedAmount fills in the amount of a posting that was left out, which
+// Ledger works out by balancing the transaction. Transactions with more than
+// one elided amount are left as-is.
+func (tr *journalTransaction) inferElidedAmount() {
+	if tr == nil {
+		return
+	}
+
+	elided := -1
+	sum := Zero()
+	for idx, posting := range tr.postings {
+		if posting.amount != nil {
+			sum.Add(sum, posting.amount)
+			continue
+		}
+		if elided >= 0 {
+			return
+		}
+		elided = idx
+	}
+	if elided >= 0 {
+		tr.postings[elided].amount = sum.Neg(sum)
+	}
+}
+
+func parseJournalDate(val string) (time.Time, error) {
+	val = strings.NewReplacer("/", "-", ".", "-").Replace(val)
+	parts := strings.Split(val, "-")
+	if len(parts) != 3 {
+		return time.Time{}, fmt.Errorf("Invalid journal date '%s'", val)
+	}
+	return time.Parse("2006-1-2", val)
+}
+
+// parseJournalPosting parses a posting line such as
+// "Expenses:Coffee  3.50 EUR @ 1.2 USD = 10.00 EUR ; comment"
+func parseJournalPosting(line string) (journalPosting, bool) {
+	if idx := strings.Index(line, ";"); idx >= 0 {
+		line = line[:idx]
+	}
+	line = strings.TrimSpace(line)
+
+	// The account is separated from the amount by a tab, or by at least
+	// two spaces
+	account := line
+	var rawAmount string
+	if loc := journalSeparatorRgx.FindStringIndex(line); loc != nil {
+		account, rawAmount = line[:loc[0]], line[loc[1]:]
+	}
+
+	// Virtual accounts, e.g. (Budget:Food) or [Assets:Savings]
+	account = strings.Trim(strings.TrimSpace(account), "()[]")
+	if account == "" {
+		return journalPosting{}, false
+	}
+	// Leave out the cost and balance assertion
+	if idx := strings.IndexAny(rawAmount, "@="); idx >= 0 {
+		rawAmount = rawAmount[:idx]
+	}
+
+	posting := journalPosting{account: account}
+	if match := journalAmountRgx.FindStringSubmatch(rawAmount); match != nil {
+		if amount, ok := Zero().SetString(strings.ReplaceAll(match[3], ",", "")); ok {
+			if match[1] == "-" || match[2] == "-" {
+				amount.Neg(amount)
+			}
+			posting.amount = amount
+		}
+	}
+	return posting, true
+}
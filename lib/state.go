@@ -0,0 +1,251 @@
+package lib
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+
+	"github.com/spf13/afero"
+	viperlib "github.com/spf13/viper"
+	yaml "gopkg.in/yaml.v2"
+)
+
+const LOOKUPS_STATE_KEY = "ledger_account_lookups"
+
+const proposalsHeader = `# Proposed slc configuration, generated from your imports. Nothing in here is
+# used as-is: review the values and copy the ones you would like to keep over
+# to your config file.
+`
+
+// RunState holds everything slc keeps track of between runs, such as the
+// imported Stripe payouts, the CSV import history, and the lookup entries it has
+// learned. It is kept in its own file so that the user's config file is never
+// written to. Proposed configuration (e.g. new CSV mappings and learned lookup
+// entries) is written to a separate file, for the user to review.
+type RunState struct {
+	fs            afero.Fs
+	path          string
+	proposalsPath string
+	lockPath      string
+
+	values    *viperlib.Viper
+	proposals *viperlib.Viper
+	proposed  bool
+
+	// In dry run mode, Save writes a diff of the changes here instead of
+	// writing the files. The state as read is kept around for the diff.
+	dryRun        io.Writer
+	origValues    string
+	origProposals string
+}
+
+// NewRunState returns a state that only lives in memory, and is never saved
+func NewRunState() *RunState {
+	return &RunState{
+		values:    viperlib.New(),
+		proposals: viperlib.New(),
+	}
+}
+
+// OpenRunState reads the state file at path (if it exists), along with any
+// previous proposals. A lock file is created next to the state file so that
+// concurrent runs do not overwrite each other's state; it is removed by Close.
+func OpenRunState(fs afero.Fs, path string, proposalsPath string) (*RunState, error) {
+	s := newFileRunState(fs, path, proposalsPath)
+	s.lockPath = fmt.Sprintf("%s.lock", path)
+
+	if err := fs.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return nil, err
+	}
+	lock, err := fs.OpenFile(s.lockPath, os.O_RDWR|os.O_CREATE|os.O_EXCL, 0600)
+	if os.IsExist(err) {
+		return nil, fmt.Errorf("Another slc run is using the state file %s. If that is not the case, remove the lock file %s and try again.", path, s.lockPath)
+	} else if err != nil {
+		return nil, err
+	}
+	fmt.Fprintf(lock, "%d\n", os.Getpid())
+	lock.Close()
+
+	if err := s.read(); err != nil {
+		s.Close()
+		return nil, err
+	}
+	return s, nil
+}
+
+// OpenDryRunState reads the state file like OpenRunState, but never writes to
+// the file system (not even the lock file). Instead, Save writes a diff of the
+// changes that would have been saved to w, as Ledger comments.
+func OpenDryRunState(fs afero.Fs, path string, proposalsPath string, w io.Writer) (*RunState, error) {
+	s := newFileRunState(afero.NewReadOnlyFs(fs), path, proposalsPath)
+	s.dryRun = w
+
+	if err := s.read(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+func newFileRunState(fs afero.Fs, path string, proposalsPath string) *RunState {
+	s := NewRunState()
+	s.fs = fs
+	s.path = path
+	s.proposalsPath = proposalsPath
+	return s
+}
+
+func (s *RunState) read() error {
+	if err := readStateFile(s.fs, s.path, s.values); err != nil {
+		return fmt.Errorf("Unable to read the state file %s: %v", s.path, err)
+	}
+	if err := readStateFile(s.fs, s.proposalsPath, s.proposals); err != nil {
+		return fmt.Errorf("Unable to read the proposals file %s: %v", s.proposalsPath, err)
+	}
+
+	if s.dryRun != nil {
+		var err error
+		if s.origValues, err = marshalStateFile("", s.values); err != nil {
+			return err
+		}
+		if s.origProposals, err = marshalStateFile(proposalsHeader, s.proposals); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func readStateFile(fs afero.Fs, path string, v *viperlib.Viper) error {
+	v.SetConfigType("yaml")
+	data, err := afero.ReadFile(fs, path)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	return v.ReadConfig(bytes.NewReader(data))
+}
+
+// Path returns the location of the state file, or an empty string for an
+// in-memory state
+func (s *RunState) Path() string {
+	return s.path
+}
+
+// ProposalsPath returns the location of the proposals file
+func (s *RunState) ProposalsPath() string {
+	return s.proposalsPath
+}
+
+// lookup returns the viper instance to read a state key from. Older versions
+// of slc kept their state in the config file, which is used until the key has
+// been saved to the state file.
+func (s *RunState) lookup(key string, v *viperlib.Viper) *viperlib.Viper {
+	if !s.values.IsSet(key) && v != nil && v.IsSet(key) {
+		return v
+	}
+	return s.values
+}
+
+func (s *RunState) set(key string, val interface{}) {
+	s.values.Set(key, val)
+}
+
+// propose adds a configuration value to the proposals file
+func (s *RunState) propose(key string, val interface{}) {
+	s.proposals.Set(key, val)
+	s.proposed = true
+}
+
+// Save writes the state file (and the proposals file, if anything was
+// proposed). Files are written to a temporary file first, so that a crash
+// does not leave a half written state behind.
+func (s *RunState) Save() error {
+	if s.path == "" {
+		return nil
+	}
+	if s.dryRun != nil {
+		return s.writeDryRunDiff()
+	}
+
+	if err := writeStateFile(s.fs, s.path, "", s.values); err != nil {
+		return fmt.Errorf("Unable to write the state file %s: %v", s.path, err)
+	}
+	if s.proposed {
+		if err := writeStateFile(s.fs, s.proposalsPath, proposalsHeader, s.proposals); err != nil {
+			return fmt.Errorf("Unable to write the proposals file %s: %v", s.proposalsPath, err)
+		}
+	}
+	return nil
+}
+
+// Checkpoint saves the state in the middle of a run, so that the progress made
+// so far is not lost if the run is interrupted. In dry run mode, the changes
+// are only shown once the run is done.
+func (s *RunState) Checkpoint() error {
+	if s.dryRun != nil {
+		return nil
+	}
+	return s.Save()
+}
+
+// writeDryRunDiff writes the changes that Save would have made
+func (s *RunState) writeDryRunDiff() error {
+	values, err := marshalStateFile("", s.values)
+	if err != nil {
+		return err
+	}
+	writeStateDiff(s.dryRun, s.path, s.origValues, values)
+
+	if s.proposed {
+		proposals, err := marshalStateFile(proposalsHeader, s.proposals)
+		if err != nil {
+			return err
+		}
+		writeStateDiff(s.dryRun, s.proposalsPath, s.origProposals, proposals)
+	}
+	return nil
+}
+
+// marshalStateFile returns the YAML contents of a state (or proposals) file,
+// or an empty string if there is nothing in it
+func marshalStateFile(header string, v *viperlib.Viper) (string, error) {
+	settings := v.AllSettings()
+	if len(settings) == 0 {
+		return "", nil
+	}
+	data, err := yaml.Marshal(settings)
+	if err != nil {
+		return "", err
+	}
+	return header + string(data), nil
+}
+
+func writeStateFile(fs afero.Fs, path string, header string, v *viperlib.Viper) error {
+	data, err := marshalStateFile(header, v)
+	if err != nil {
+		return err
+	}
+
+	if err := fs.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	tmpPath := fmt.Sprintf("%s.tmp", path)
+	if err := afero.WriteFile(fs, tmpPath, []byte(data), 0600); err != nil {
+		return err
+	}
+	return fs.Rename(tmpPath, path)
+}
+
+// Close releases the lock on the state file
+func (s *RunState) Close() error {
+	if s.lockPath == "" {
+		return nil
+	}
+	if err := s.fs.Remove(s.lockPath); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	s.lockPath = ""
+	return nil
+}
@@ -0,0 +1,222 @@
+package lib
+
+import (
+	"fmt"
+	"io"
+	"strings"
+)
+
+// Number of unchanged lines shown around each change
+const STATE_DIFF_CONTEXT = 2
+
+type diffOp int
+
+const (
+	diffSame diffOp = iota
+	diffRemoved
+	diffAdded
+)
+
+type diffLine struct {
+	op   diffOp
+	text string
+}
+
+// diffLines returns the lines needed to turn "before" into "after", based on
+// their longest common subsequence. This uses the linear space variant of
+// Myers' diff algorithm, as state files can have tens of thousands of lines
+// (mostly import history), of which only a few change in each run.
+func diffLines(before []string, after []string) []diffLine {
+	lines := diffLinesLinear(nil, before, after)
+
+	// Removed lines are listed before the lines that were added in their place
+	res := make([]diffLine, 0, len(lines))
+	var added []diffLine
+	for _, line := range lines {
+		switch line.op {
+		case diffAdded:
+			added = append(added, line)
+		case diffRemoved:
+			res = append(res, line)
+		default:
+			res = append(append(res, added...), line)
+			added = nil
+		}
+	}
+	return append(res, added...)
+}
+
+// diffLinesLinear appends the diff of two lists of lines to res. The middle
+// snake of the shortest edit script splits the problem in two halves, which
+// are diffed on their own.
+func diffLinesLinear(res []diffLine, before []string, after []string) []diffLine {
+	switch {
+	case len(before) == 0:
+		for _, line := range after {
+			res = append(res, diffLine{diffAdded, line})
+		}
+		return res
+	case len(after) == 0:
+		for _, line := range before {
+			res = append(res, diffLine{diffRemoved, line})
+		}
+		return res
+	}
+
+	x, y, u, v, d := middleSnake(before, after)
+	if d > 1 {
+		res = diffLinesLinear(res, before[:x], after[:y])
+		for _, line := range before[x:u] {
+			res = append(res, diffLine{diffSame, line})
+		}
+		return diffLinesLinear(res, before[u:], after[v:])
+	}
+
+	// At most one line was added or removed, anywhere after the common
+	// leading lines
+	i, j := 0, 0
+	for i < len(before) && j < len(after) {
+		switch {
+		case before[i] == after[j]:
+			res = append(res, diffLine{diffSame, before[i]})
+			i++
+			j++
+		case len(before) > len(after):
+			res = append(res, diffLine{diffRemoved, before[i]})
+			i++
+		default:
+			res = append(res, diffLine{diffAdded, after[j]})
+			j++
+		}
+	}
+	for ; i < len(before); i++ {
+		res = append(res, diffLine{diffRemoved, before[i]})
+	}
+	for ; j < len(after); j++ {
+		res = append(res, diffLine{diffAdded, after[j]})
+	}
+	return res
+}
+
+// middleSnake finds the middle snake (x, y) -> (u, v) of the shortest edit
+// script between the two lists, along with the length d of that script, by
+// searching forward from the start and backward from the end at the same time.
+// See "An O(ND) Difference Algorithm and Its Variations" (Myers, 1986).
+func middleSnake(a []string, b []string) (int, int, int, int, int) {
+	n, m := len(a), len(b)
+	delta := n - m
+	odd := delta%2 != 0
+	maxD := (n + m + 1) / 2
+
+	// Both searches index their furthest reaching x values by the diagonal
+	// k = x - y, which ranges between -maxD and maxD around 0 (forward) and
+	// delta (backward)
+	offset := maxD + abs(delta) + 2
+	vf := make([]int, 2*offset+1)
+	vb := make([]int, 2*offset+1)
+	vf[offset+1] = 0
+	vb[offset+delta+1] = n + 1
+
+	for d := 0; d <= maxD; d++ {
+		for k := -d; k <= d; k += 2 {
+			var x int
+			if k == -d || (k != d && vf[offset+k-1] < vf[offset+k+1]) {
+				x = vf[offset+k+1]
+			} else {
+				x = vf[offset+k-1] + 1
+			}
+			y := x - k
+			sx, sy := x, y
+			for x < n && y < m && a[x] == b[y] {
+				x++
+				y++
+			}
+			vf[offset+k] = x
+			if odd && k >= delta-(d-1) && k <= delta+(d-1) && x >= vb[offset+k] {
+				return sx, sy, x, y, 2*d - 1
+			}
+		}
+
+		for k := delta - d; k <= delta+d; k += 2 {
+			var x int
+			if k == delta-d || (k != delta+d && vb[offset+k+1]-1 < vb[offset+k-1]) {
+				x = vb[offset+k+1] - 1
+			} else {
+				x = vb[offset+k-1]
+			}
+			y := x - k
+			ex, ey := x, y
+			for x > 0 && y > 0 && a[x-1] == b[y-1] {
+				x--
+				y--
+			}
+			vb[offset+k] = x
+			if !odd && k >= -d && k <= d && x <= vf[offset+k] {
+				return x, y, ex, ey, 2 * d
+			}
+		}
+	}
+
+	// Not reached, the searches always overlap by maxD
+	return 0, 0, n, m, n + m
+}
+
+func abs(val int) int {
+	if val < 0 {
+		return -val
+	}
+	return val
+}
+
+// writeStateDiff writes the changes between two versions of a state file as
+// Ledger comments, so that they can be part of the ledger output, e.g.
+//
+//	; Changes to .slc.state.yaml (dry run, not saved):
+//	;   stripe:
+//	; -   synced_until: 1615334400
+//	; +   synced_until: 1615338020
+func writeStateDiff(w io.Writer, path string, before string, after string) {
+	if before == after {
+		fmt.Fprintf(w, "; No changes to %s (dry run)\n", path)
+		return
+	}
+
+	lines := diffLines(splitDiffLines(before), splitDiffLines(after))
+
+	// Only the changed lines (and the ones around them) are shown
+	shown := make([]bool, len(lines))
+	for idx, line := range lines {
+		if line.op == diffSame {
+			continue
+		}
+		for k := idx - STATE_DIFF_CONTEXT; k <= idx+STATE_DIFF_CONTEXT; k++ {
+			if k >= 0 && k < len(lines) {
+				shown[k] = true
+			}
+		}
+	}
+
+	fmt.Fprintf(w, "; Changes to %s (dry run, not saved):\n", path)
+	for idx, line := range lines {
+		if !shown[idx] {
+			if idx == 0 || shown[idx-1] {
+				fmt.Fprintf(w, ";   ...\n")
+			}
+			continue
+		}
+		prefix := " "
+		if line.op == diffRemoved {
+			prefix = "-"
+		} else if line.op == diffAdded {
+			prefix = "+"
+		}
+		fmt.Fprintf(w, "; %s %s\n", prefix, line.text)
+	}
+}
+
+func splitDiffLines(val string) []string {
+	if val == "" {
+		return nil
+	}
+	return strings.Split(strings.TrimRight(val, "\n"), "\n")
+}
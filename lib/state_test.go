@@ -0,0 +1,236 @@
+package lib
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/spf13/afero"
+	"github.com/stretchr/testify/assert"
+	"testing"
+
+	log "github.com/sirupsen/logrus"
+	viperlib "github.com/spf13/viper"
+)
+
+// readSavedState reads back a state (or proposals) file written by a run
+func readSavedState(t *testing.T, fs afero.Fs, path string) *viperlib.Viper {
+	v := viperlib.New()
+	if err := readStateFile(fs, path, v); err != nil {
+		t.Fatalf("Unable to read the state file %s: %v", path, err)
+	}
+	return v
+}
+
+func TestRunStateLocking(t *testing.T) {
+	appFs := afero.NewMemMapFs()
+
+	state, err := OpenRunState(appFs, "/state/slcstate.yml", "/state/slcproposals.yml")
+	assert.Nil(t, err)
+
+	_, err = OpenRunState(appFs, "/state/slcstate.yml", "/state/slcproposals.yml")
+	assert.EqualError(t, err, "Another slc run is using the state file /state/slcstate.yml. If that is not the case, remove the lock file /state/slcstate.yml.lock and try again.")
+
+	assert.Nil(t, state.Close())
+	exists, _ := afero.Exists(appFs, "/state/slcstate.yml.lock")
+	assert.False(t, exists, "the lock file is removed")
+
+	state, err = OpenRunState(appFs, "/state/slcstate.yml", "/state/slcproposals.yml")
+	assert.Nil(t, err)
+	assert.Nil(t, state.Close())
+}
+
+func TestRunStateLearnedLookups(t *testing.T) {
+	type test struct {
+		name         string
+		skipTest     bool
+		inpConfig    []lookupItem
+		inpState     string
+		inpSearchStr string
+		expLearned   []lookupItem
+		expProposals string
+	}
+
+	tests := []test{
+		{
+			name:         "saves new entries to the state and proposals files",
+			skipTest:     false,
+			inpConfig:    []lookupItem{{Search: "^Coffee Bar$", AcctName: "Expenses:Coffee"}},
+			inpState:     "---",
+			inpSearchStr: "Book Shop",
+			expLearned: []lookupItem{
+				{Search: "^Book Shop$", AcctName: "Expenses:Unknown", Description: "Book Shop"},
+			},
+			expProposals: "# Proposed slc configuration, generated from your imports. Nothing in here is\n# used as-is: review the values and copy the ones you would like to keep over\n# to your config file.\nledger_account_lookups:\n- account_name: Expenses:Unknown\n  description: Book Shop\n  discard_transaction: false\n  search: ^Book Shop$\n",
+		},
+		{
+			name:         "uses the entries learned in previous runs",
+			skipTest:     false,
+			inpConfig:    []lookupItem{},
+			inpState:     "---\nledger_account_lookups:\n- search: ^Book Shop$\n  account_name: Expenses:Books\n",
+			inpSearchStr: "Book Shop",
+			expLearned: []lookupItem{
+				{Search: "^Book Shop$", AcctName: "Expenses:Books"},
+			},
+			expProposals: "# Proposed slc configuration, generated from your imports. Nothing in here is\n# used as-is: review the values and copy the ones you would like to keep over\n# to your config file.\nledger_account_lookups:\n- account_name: Expenses:Books\n  description: \"\"\n  discard_transaction: false\n  search: ^Book Shop$\n",
+		},
+		{
+			name:         "drops learned entries that were copied over to the config file",
+			skipTest:     false,
+			inpConfig:    []lookupItem{{Search: "^Book Shop$", AcctName: "Expenses:Books"}},
+			inpState:     "---\nledger_account_lookups:\n- search: ^Book Shop$\n  account_name: Expenses:Unknown\n",
+			inpSearchStr: "Book Shop",
+			expLearned:   []lookupItem{},
+			expProposals: "",
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			if tc.skipTest {
+				t.Skip("Skipping test: " + tc.name)
+			}
+
+			appFs := afero.NewMemMapFs()
+			afero.WriteFile(appFs, "/slcstate.yml", []byte(tc.inpState), 0644)
+			state, err := OpenRunState(appFs, "/slcstate.yml", "/slcproposals.yml")
+			if err != nil {
+				t.Fatalf("Unable to open the state file: %v", err)
+			}
+			defer state.Close()
+
+			v := viperlib.New()
+			v.Set("ledger_account_lookups", tc.inpConfig)
+			var logger = log.WithFields(log.Fields{"name": "slc-testing"})
+
+			lookupList, err := initializeLookupList(logger, v, state)
+			assert.Nil(t, err)
+			_, err = lookupList.getOrAddItem(tc.inpSearchStr, lookupRecord{}, "Expenses:Unknown")
+			assert.Nil(t, err)
+			assert.Nil(t, lookupList.persistData())
+			assert.Nil(t, state.Save())
+
+			var learned []lookupItem
+			assert.Nil(t, readSavedState(t, appFs, "/slcstate.yml").UnmarshalKey(LOOKUPS_STATE_KEY, &learned))
+			assert.Equal(t, tc.expLearned, learned)
+
+			proposals, _ := afero.ReadFile(appFs, "/slcproposals.yml")
+			assert.Equal(t, tc.expProposals, string(proposals))
+		})
+	}
+}
+
+func TestRunStateConfigFallback(t *testing.T) {
+	v := viperlib.New()
+	v.SetConfigType("yaml")
+	v.ReadConfig(bytes.NewBufferString("---\nstripe:\n  most_recently_processed_payout: po_old\n"))
+
+	// Values that older versions kept in the config file are used until they
+	// are saved in the state file
+	state := NewRunState()
+	assert.Equal(t, "po_old", state.lookup(STRIPE_LEGACY_CURSOR_STATE_KEY, v).GetString(STRIPE_LEGACY_CURSOR_STATE_KEY))
+
+	state.set(STRIPE_LEGACY_CURSOR_STATE_KEY, "po_new")
+	assert.Equal(t, "po_new", state.lookup(STRIPE_LEGACY_CURSOR_STATE_KEY, v).GetString(STRIPE_LEGACY_CURSOR_STATE_KEY))
+}
+
+func TestRunStateDryRun(t *testing.T) {
+	appFs := afero.NewMemMapFs()
+	stateData := "stripe:\n  synced_until: 1615334400\n"
+	afero.WriteFile(appFs, "/slcstate.yml", []byte(stateData), 0644)
+
+	var output bytes.Buffer
+	state, err := OpenDryRunState(appFs, "/slcstate.yml", "/slcproposals.yml", &output)
+	assert.Nil(t, err)
+
+	state.set(STRIPE_SYNCED_UNTIL_STATE_KEY, 1615338020)
+	state.set("csv.import_history.bank", []string{"21b3fce2244031ea"})
+	state.propose("csv.account.bank", map[string]interface{}{"date_col": 1})
+	assert.Nil(t, state.Save())
+	assert.Nil(t, state.Close())
+
+	assert.Equal(t, `; Changes to /slcstate.yml (dry run, not saved):
+; + csv:
+; +   import_history:
+; +     bank:
+; +     - 21b3fce2244031ea
+;   stripe:
+; -   synced_until: 1615334400
+; +   synced_until: 1615338020
+; Changes to /slcproposals.yml (dry run, not saved):
+; + # Proposed slc configuration, generated from your imports. Nothing in here is
+; + # used as-is: review the values and copy the ones you would like to keep over
+; + # to your config file.
+; + csv:
+; +   account:
+; +     bank:
+; +       date_col: 1
+`, output.String())
+
+	// Nothing is written, not even the lock file
+	data, _ := afero.ReadFile(appFs, "/slcstate.yml")
+	assert.Equal(t, stateData, string(data))
+	for _, path := range []string{"/slcstate.yml.lock", "/slcproposals.yml"} {
+		exists, _ := afero.Exists(appFs, path)
+		assert.False(t, exists, path)
+	}
+}
+
+func TestStateDiffLines(t *testing.T) {
+	type test struct {
+		name      string
+		inpBefore []string
+		inpAfter  []string
+		expDiff   []diffLine
+	}
+
+	tests := []test{
+		{
+			name:      "keeps the common lines around changes",
+			inpBefore: []string{"a", "b", "c", "d", "e"},
+			inpAfter:  []string{"a", "x", "c", "e", "f"},
+			expDiff: []diffLine{
+				{diffSame, "a"},
+				{diffRemoved, "b"},
+				{diffAdded, "x"},
+				{diffSame, "c"},
+				{diffRemoved, "d"},
+				{diffSame, "e"},
+				{diffAdded, "f"},
+			},
+		},
+		{
+			name:      "handles empty inputs",
+			inpBefore: nil,
+			inpAfter:  []string{"a"},
+			expDiff:   []diffLine{{diffAdded, "a"}},
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			assert.Equal(t, tc.expDiff, diffLines(tc.inpBefore, tc.inpAfter))
+		})
+	}
+}
+
+func TestStateDiffLargeHistory(t *testing.T) {
+	// A large import history only has a few lines changed at a time
+	var before []string
+	for i := 0; i < 100000; i++ {
+		before = append(before, fmt.Sprintf("    - %016x", i))
+	}
+	after := append([]string{"stripe:", "  synced_until: 1615338020"}, before...)
+	after = append(after, "    - ffffffffffffffff")
+	before = append([]string{"stripe:", "  synced_until: 1615334400"}, before...)
+
+	var res []diffLine
+	for _, line := range diffLines(before, after) {
+		if line.op != diffSame {
+			res = append(res, line)
+		}
+	}
+	assert.Equal(t, []diffLine{
+		{diffRemoved, "  synced_until: 1615334400"},
+		{diffAdded, "  synced_until: 1615338020"},
+		{diffAdded, "    - ffffffffffffffff"},
+	}, res)
+}
@@ -8,9 +8,10 @@ import (
 )
 
 func (r *StripeRunner) processStripeCharge(bt *stripe.BalanceTransaction, payout *stripe.Payout, lookupList *ledgerAccountLookup) error {
+	lookupRec := stripeLookupRecord(bt)
 	var trLines []TransactionPosting
 
-	bankAcctInfo, err := lookupList.getOrAddItem(payout.Destination.ID, "Assets:Bank")
+	bankAcctInfo, err := lookupList.getOrAddItem(payout.Destination.ID, lookupRec, "Assets:Bank")
 	if err != nil {
 		return err
 	}
@@ -18,25 +19,27 @@ func (r *StripeRunner) processStripeCharge(bt *stripe.BalanceTransaction, payout
 	accTaxAmt := Zero()
 	if bt.Source != nil && bt.Source.Charge != nil && bt.Source.Charge.Invoice != nil {
 		for _, taxAmt := range bt.Source.Charge.Invoice.TotalTaxAmounts {
-			taxAcctInfo, err := lookupList.getOrAddItem(taxAmt.TaxRate.ID, "Liabilities:SalesTax")
+			taxAcctInfo, err := lookupList.getOrAddItem(taxAmt.TaxRate.ID, lookupRec, "Liabilities:SalesTax")
 			if err != nil {
 				return err
 			}
 
 			normalizedTaxAmt := Zero().SetInt64(taxAmt.Amount)
 			if bt.Currency != bt.Source.Charge.Currency {
-				// normalizedTaxAmt *= exchange rate
-				normalizedTaxAmt.Mul(normalizedTaxAmt, Zero().SetFloat64(bt.ExchangeRate))
+				// Convert the tax amount to the minor unit of the balance
+				// transaction currency
+				normalizedTaxAmt = convertStripeAmount(normalizedTaxAmt, bt.Source.Charge.Currency, bt.Currency, bt.ExchangeRate)
 			}
 			accTaxAmt.Add(accTaxAmt, normalizedTaxAmt)
 
 			// Tax liability line
 			trLines = append(trLines, TransactionPosting{
 				Account: taxAcctInfo.AcctName,
-				// -1 * (normalizedTaxAmt / 100)
-				Amount:   Zero().Neg(Zero().Quo(normalizedTaxAmt, Zero().SetFloat64(100))),
+				// -1 * (normalizedTaxAmt / minor units)
+				Amount:   Zero().Neg(fromStripeAmount(normalizedTaxAmt, bt.Currency)),
 				Currency: string(bt.Currency),
 			})
+			taxAcctInfo.annotatePosting(&trLines[len(trLines)-1])
 		}
 	}
 
@@ -44,12 +47,12 @@ func (r *StripeRunner) processStripeCharge(bt *stripe.BalanceTransaction, payout
 	if bt.Source != nil && bt.Source.Charge != nil && bt.Source.Charge.Customer != nil {
 		incomeSrcKey = fmt.Sprintf("%s_%s", incomeSrcKey, bt.Source.Charge.Customer.ID)
 	}
-	incomeAcctInfo, err := lookupList.getOrAddItem(incomeSrcKey, "Income:Stripe")
+	incomeAcctInfo, err := lookupList.getOrAddItem(incomeSrcKey, lookupRec, "Income:Stripe")
 	if err != nil {
 		return err
 	}
 
-	stripeFeesAcctInfo, err := lookupList.getOrAddItem(STRIPE_FEES_LOOKUP_KEY, "Expenses:Stripe Fees")
+	stripeFeesAcctInfo, err := lookupList.getOrAddItem(STRIPE_FEES_LOOKUP_KEY, lookupRec, "Expenses:Stripe Fees")
 	if err != nil {
 		return err
 	}
@@ -57,26 +60,29 @@ func (r *StripeRunner) processStripeCharge(bt *stripe.BalanceTransaction, payout
 	// Income source line
 	trLines = append(trLines, TransactionPosting{
 		Account: incomeAcctInfo.AcctName,
-		// -1 * ((bt.Amount - accTaxAmt)/100)
-		Amount:   Zero().Neg(Zero().Quo(Zero().Sub(Zero().SetInt64(bt.Amount), accTaxAmt), Zero().SetFloat64(100))),
+		// -1 * ((bt.Amount - accTaxAmt) / minor units)
+		Amount:   Zero().Neg(fromStripeAmount(Zero().Sub(Zero().SetInt64(bt.Amount), accTaxAmt), bt.Currency)),
 		Currency: string(bt.Currency),
 	})
+	incomeAcctInfo.annotatePosting(&trLines[len(trLines)-1])
 
 	// Stripe fees line
 	trLines = append(trLines, TransactionPosting{
 		Account: stripeFeesAcctInfo.AcctName,
-		// bt.Fee / 100
-		Amount:   Zero().Quo(Zero().SetInt64(bt.Fee), Zero().SetFloat64(100)),
+		// bt.Fee / minor units
+		Amount:   fromStripeAmount(Zero().SetInt64(bt.Fee), bt.Currency),
 		Currency: string(bt.Currency),
 	})
+	stripeFeesAcctInfo.annotatePosting(&trLines[len(trLines)-1])
 
 	// Income destination line
 	trLines = append(trLines, TransactionPosting{
 		Account: bankAcctInfo.AcctName,
-		// bt.Net / 100
-		Amount:   Zero().Quo(Zero().SetInt64(bt.Net), Zero().SetFloat64(100)),
+		// bt.Net / minor units
+		Amount:   fromStripeAmount(Zero().SetInt64(bt.Net), bt.Currency),
 		Currency: string(bt.Currency),
 	})
+	bankAcctInfo.annotatePosting(&trLines[len(trLines)-1])
 
 	tr, err := NewLedgerTransaction(time.Unix(bt.Created, 0), "Stripe Payout", trLines)
 	if err != nil {
@@ -93,8 +99,10 @@ func (r *StripeRunner) processStripeCharge(bt *stripe.BalanceTransaction, payout
 		tr.AddKeyValComment("CustomerCountry", bt.Source.Charge.BillingDetails.Address.Country)
 		tr.AddKeyValComment("CustomerPostalCode", bt.Source.Charge.BillingDetails.Address.PostalCode)
 	}
+	incomeAcctInfo.annotateTransaction(tr)
 
 	tr.SetDateFormat(r.viper.GetString("date_format_string"))
+	tr.SetPrecision(stripeCurrencyExponent(bt.Currency))
 	fmt.Fprintln(r.outputWriter, tr.String())
 
 	return nil
@@ -0,0 +1,51 @@
+package lib
+
+import (
+	"fmt"
+	"math/big"
+	"strings"
+
+	stripe "github.com/stripe/stripe-go/v72"
+)
+
+// stripeCurrencyExponent returns the number of decimals in the minor unit of a
+// currency, i.e. the unit that Stripe amounts are in
+func stripeCurrencyExponent(currency stripe.Currency) int {
+	return currencyExponent(string(currency))
+}
+
+// stripeMinorUnits returns the size of the minor unit of a currency, e.g. 100
+// for USD (cents) or 1 for JPY
+func stripeMinorUnits(currency stripe.Currency) *big.Float {
+	res := Zero().SetInt64(1)
+	for i := 0; i < stripeCurrencyExponent(currency); i++ {
+		res.Mul(res, Zero().SetInt64(10))
+	}
+	return res
+}
+
+// fromStripeAmount converts an amount in the minor unit of a currency (as
+// returned by the Stripe API) to the regular amount, e.g. 2306 USD to 23.06
+func fromStripeAmount(amount *big.Float, currency stripe.Currency) *big.Float {
+	return Zero().Quo(amount, stripeMinorUnits(currency))
+}
+
+// convertStripeAmount converts an amount in the minor unit of one currency to
+// the minor unit of another, using the exchange rate between the two. The
+// result is rounded to a whole minor unit, so that it can be written out at
+// the precision of the currency.
+func convertStripeAmount(amount *big.Float, from stripe.Currency, to stripe.Currency, exchangeRate float64) *big.Float {
+	// (amount / from units) * exchange rate * to units
+	res := fromStripeAmount(amount, from)
+	res.Mul(res, Zero().SetFloat64(exchangeRate))
+	res.Mul(res, stripeMinorUnits(to))
+	rounded, _ := Zero().SetString(fmt.Sprintf("%.0f", res))
+	return rounded
+}
+
+// formatUnitAmount formats an amount in the minor unit of a currency, e.g.
+// 2306 USD as "23.06 USD"
+func (l *LedgerTransaction) formatUnitAmount(amount int64, currency string) string {
+	res := fromStripeAmount(Zero().SetInt64(amount), stripe.Currency(currency))
+	return fmt.Sprintf("%.*f %s", stripeCurrencyExponent(stripe.Currency(currency)), res, strings.ToUpper(currency))
+}
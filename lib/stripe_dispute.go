@@ -8,60 +8,115 @@ import (
 )
 
 func (r *StripeRunner) processStripeDispute(bt *stripe.BalanceTransaction, payout *stripe.Payout, lookupList *ledgerAccountLookup) error {
-	var trLines []TransactionPosting
+	tr, err := r.stripeDisputeTransaction(bt, payout, lookupList, "Stripe Dispute Charge")
+	if err != nil {
+		return err
+	}
 
-	bankAcctInfo, err := lookupList.getOrAddItem(payout.Destination.ID, "Assets:Bank")
+	tr.SetDateFormat(r.viper.GetString("date_format_string"))
+	tr.SetPrecision(stripeCurrencyExponent(bt.Currency))
+	fmt.Fprintln(r.outputWriter, tr.String())
+
+	return nil
+}
+
+// processStripeDisputeReversal handles disputes that were won (or withdrawn by
+// the customer), where Stripe returns the disputed amount along with the
+// dispute fee. The income and fees posted for the original dispute are
+// reversed.
+func (r *StripeRunner) processStripeDisputeReversal(bt *stripe.BalanceTransaction, payout *stripe.Payout, lookupList *ledgerAccountLookup) error {
+	tr, err := r.stripeDisputeTransaction(bt, payout, lookupList, "Stripe Dispute Reversal")
 	if err != nil {
 		return err
 	}
 
+	if bt.Source != nil && bt.Source.Dispute != nil {
+		dispute := bt.Source.Dispute
+		if dispute.Charge != nil {
+			tr.AddComment(fmt.Sprintf("Reverses Stripe dispute %s (%s) on charge %s", dispute.ID, dispute.Status, dispute.Charge.ID))
+		} else {
+			tr.AddComment(fmt.Sprintf("Reverses Stripe dispute %s (%s)", dispute.ID, dispute.Status))
+		}
+	}
+
+	tr.SetDateFormat(r.viper.GetString("date_format_string"))
+	tr.SetPrecision(stripeCurrencyExponent(bt.Currency))
+	fmt.Fprintln(r.outputWriter, tr.String())
+
+	return nil
+}
+
+// stripeDisputeTransaction returns the transaction for a dispute, or a dispute
+// reversal. The amount and fee are negative for disputes, and positive for
+// reversals.
+func (r *StripeRunner) stripeDisputeTransaction(bt *stripe.BalanceTransaction, payout *stripe.Payout, lookupList *ledgerAccountLookup, desc string) (*LedgerTransaction, error) {
+	lookupRec := stripeLookupRecord(bt)
+	var trLines []TransactionPosting
+
+	bankAcctInfo, err := lookupList.getOrAddItem(payout.Destination.ID, lookupRec, "Assets:Bank")
+	if err != nil {
+		return nil, err
+	}
+
 	incomeSrcKey := STRIPE_INCOME_SRC_LOOKUP_KEY
-	if bt.Source != nil && bt.Source.Charge != nil && bt.Source.Charge.Customer != nil {
-		incomeSrcKey = fmt.Sprintf("%s_%s", incomeSrcKey, bt.Source.Charge.Customer.ID)
+	if charge := disputedCharge(bt); charge != nil && charge.Customer != nil {
+		incomeSrcKey = fmt.Sprintf("%s_%s", incomeSrcKey, charge.Customer.ID)
 	}
-	incomeAcctInfo, err := lookupList.getOrAddItem(incomeSrcKey, "Income:Stripe")
+	incomeAcctInfo, err := lookupList.getOrAddItem(incomeSrcKey, lookupRec, "Income:Stripe")
 	if err != nil {
-		return err
+		return nil, err
 	}
 
-	stripeFeesAcctInfo, err := lookupList.getOrAddItem(STRIPE_FEES_LOOKUP_KEY, "Expenses:Stripe Fees")
+	stripeFeesAcctInfo, err := lookupList.getOrAddItem(STRIPE_FEES_LOOKUP_KEY, lookupRec, "Expenses:Stripe Fees")
 	if err != nil {
-		return err
+		return nil, err
 	}
 
 	// Income source line
 	trLines = append(trLines, TransactionPosting{
 		Account: incomeAcctInfo.AcctName,
-		// -1 * bt.Amount/100
-		Amount:   Zero().Neg(Zero().Quo(Zero().SetInt64(bt.Amount), Zero().SetFloat64(100))),
+		// -1 * bt.Amount / minor units
+		Amount:   Zero().Neg(fromStripeAmount(Zero().SetInt64(bt.Amount), bt.Currency)),
 		Currency: string(bt.Currency),
 	})
+	incomeAcctInfo.annotatePosting(&trLines[len(trLines)-1])
 
 	// Stripe fees line
 	trLines = append(trLines, TransactionPosting{
 		Account: stripeFeesAcctInfo.AcctName,
-		// bt.Fee / 100
-		Amount:   Zero().Quo(Zero().SetInt64(bt.Fee), Zero().SetFloat64(100)),
+		// bt.Fee / minor units
+		Amount:   fromStripeAmount(Zero().SetInt64(bt.Fee), bt.Currency),
 		Currency: string(bt.Currency),
 	})
+	stripeFeesAcctInfo.annotatePosting(&trLines[len(trLines)-1])
 
 	// Destination line
 	trLines = append(trLines, TransactionPosting{
 		Account: bankAcctInfo.AcctName,
-		// bt.Net / 100
-		Amount:   Zero().Quo(Zero().SetInt64(bt.Net), Zero().SetFloat64(100)),
+		// bt.Net / minor units
+		Amount:   fromStripeAmount(Zero().SetInt64(bt.Net), bt.Currency),
 		Currency: string(bt.Currency),
 	})
+	bankAcctInfo.annotatePosting(&trLines[len(trLines)-1])
 
-	tr, err := NewLedgerTransaction(time.Unix(bt.Created, 0), "Stripe Dispute Charge", trLines)
+	tr, err := NewLedgerTransaction(time.Unix(bt.Created, 0), desc, trLines)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
 	tr.AddComment(fmt.Sprintf("Correlates to Stripe payout %s from %s for amount %s", payout.ID, tr.formatDate(payout.ArrivalDate), tr.formatUnitAmount(payout.Amount, string(payout.Currency))))
+	incomeAcctInfo.annotateTransaction(tr)
+	return tr, nil
+}
 
-	tr.SetDateFormat(r.viper.GetString("date_format_string"))
-	fmt.Fprintln(r.outputWriter, tr.String())
-
-	return nil
+// disputedCharge returns the (expanded) charge of a dispute balance
+// transaction, if there is one
+func disputedCharge(bt *stripe.BalanceTransaction) *stripe.Charge {
+	if bt.Source == nil {
+		return nil
+	}
+	if bt.Source.Dispute != nil && bt.Source.Dispute.Charge != nil {
+		return bt.Source.Dispute.Charge
+	}
+	return bt.Source.Charge
 }
@@ -8,14 +8,15 @@ import (
 )
 
 func (r *StripeRunner) processStripeFee(bt *stripe.BalanceTransaction, payout *stripe.Payout, lookupList *ledgerAccountLookup) error {
+	lookupRec := stripeLookupRecord(bt)
 	var trLines []TransactionPosting
 
-	bankAcctInfo, err := lookupList.getOrAddItem(payout.Destination.ID, "Assets:Bank")
+	bankAcctInfo, err := lookupList.getOrAddItem(payout.Destination.ID, lookupRec, "Assets:Bank")
 	if err != nil {
 		return err
 	}
 
-	stripeFeesAcctInfo, err := lookupList.getOrAddItem(STRIPE_FEES_LOOKUP_KEY, "Expenses:Stripe Fees")
+	stripeFeesAcctInfo, err := lookupList.getOrAddItem(STRIPE_FEES_LOOKUP_KEY, lookupRec, "Expenses:Stripe Fees")
 	if err != nil {
 		return err
 	}
@@ -23,18 +24,20 @@ func (r *StripeRunner) processStripeFee(bt *stripe.BalanceTransaction, payout *s
 	// Stripe fees line
 	trLines = append(trLines, TransactionPosting{
 		Account: stripeFeesAcctInfo.AcctName,
-		// -1 * (bt.Amount / 100)
-		Amount:   Zero().Neg(Zero().Quo(Zero().SetInt64(bt.Amount), Zero().SetFloat64(100))),
+		// -1 * (bt.Amount / minor units)
+		Amount:   Zero().Neg(fromStripeAmount(Zero().SetInt64(bt.Amount), bt.Currency)),
 		Currency: string(bt.Currency),
 	})
+	stripeFeesAcctInfo.annotatePosting(&trLines[len(trLines)-1])
 
 	// Destination line
 	trLines = append(trLines, TransactionPosting{
 		Account: bankAcctInfo.AcctName,
-		// bt.Amount / 100
-		Amount:   Zero().Quo(Zero().SetInt64(bt.Amount), Zero().SetFloat64(100)),
+		// bt.Amount / minor units
+		Amount:   fromStripeAmount(Zero().SetInt64(bt.Amount), bt.Currency),
 		Currency: string(bt.Currency),
 	})
+	bankAcctInfo.annotatePosting(&trLines[len(trLines)-1])
 
 	tr, err := NewLedgerTransaction(time.Unix(bt.Created, 0), "Stripe Account Fees", trLines)
 	if err != nil {
@@ -42,8 +45,60 @@ func (r *StripeRunner) processStripeFee(bt *stripe.BalanceTransaction, payout *s
 	}
 
 	tr.AddComment(fmt.Sprintf("Correlates to Stripe payout %s from %s for amount %s", payout.ID, tr.formatDate(payout.ArrivalDate), tr.formatUnitAmount(payout.Amount, string(payout.Currency))))
+	stripeFeesAcctInfo.annotateTransaction(tr)
 
 	tr.SetDateFormat(r.viper.GetString("date_format_string"))
+	tr.SetPrecision(stripeCurrencyExponent(bt.Currency))
+	fmt.Fprintln(r.outputWriter, tr.String())
+
+	return nil
+}
+
+// processStripePayoutFee books the fee Stripe charges for instant payouts. The
+// fee is taken from the Stripe balance along with the payout, so that much
+// less arrives at the payout destination than the other transactions add up to.
+func (r *StripeRunner) processStripePayoutFee(bt *stripe.BalanceTransaction, payout *stripe.Payout, lookupList *ledgerAccountLookup) error {
+	lookupRec := stripeLookupRecord(bt)
+	var trLines []TransactionPosting
+
+	destAcctInfo, err := lookupList.getOrAddItem(payout.Destination.ID, lookupRec, "Assets:Bank")
+	if err != nil {
+		return err
+	}
+
+	stripeFeesAcctInfo, err := lookupList.getOrAddItem(STRIPE_FEES_LOOKUP_KEY, lookupRec, "Expenses:Stripe Fees")
+	if err != nil {
+		return err
+	}
+
+	// Stripe fees line
+	trLines = append(trLines, TransactionPosting{
+		Account: stripeFeesAcctInfo.AcctName,
+		// bt.Fee / minor units
+		Amount:   fromStripeAmount(Zero().SetInt64(bt.Fee), bt.Currency),
+		Currency: string(bt.Currency),
+	})
+	stripeFeesAcctInfo.annotatePosting(&trLines[len(trLines)-1])
+
+	// Destination line
+	trLines = append(trLines, TransactionPosting{
+		Account: destAcctInfo.AcctName,
+		// -1 * (bt.Fee / minor units)
+		Amount:   Zero().Neg(fromStripeAmount(Zero().SetInt64(bt.Fee), bt.Currency)),
+		Currency: string(bt.Currency),
+	})
+	destAcctInfo.annotatePosting(&trLines[len(trLines)-1])
+
+	tr, err := NewLedgerTransaction(time.Unix(bt.Created, 0), "Stripe Instant Payout Fee", trLines)
+	if err != nil {
+		return err
+	}
+
+	tr.AddComment(fmt.Sprintf("Correlates to Stripe payout %s from %s for amount %s", payout.ID, tr.formatDate(payout.ArrivalDate), tr.formatUnitAmount(payout.Amount, string(payout.Currency))))
+	stripeFeesAcctInfo.annotateTransaction(tr)
+
+	tr.SetDateFormat(r.viper.GetString("date_format_string"))
+	tr.SetPrecision(stripeCurrencyExponent(bt.Currency))
 	fmt.Fprintln(r.outputWriter, tr.String())
 
 	return nil
@@ -1,7 +1,10 @@
 package lib
 
 import (
+	"bytes"
+	"fmt"
 	"io"
+	"strconv"
 	"time"
 
 	log "github.com/sirupsen/logrus"
@@ -19,6 +22,8 @@ type StripeRunner struct {
 	viper        *viperlib.Viper
 	logger       *log.Entry
 	progressBar  ProgressBar
+	lookupList   *ledgerAccountLookup
+	state        *RunState
 }
 
 func NewStripeRunner(sc *stripeClient.API, ow io.Writer, v *viperlib.Viper, l *log.Entry, pb ProgressBar) *StripeRunner {
@@ -28,41 +33,90 @@ func NewStripeRunner(sc *stripeClient.API, ow io.Writer, v *viperlib.Viper, l *l
 		viper:        v,
 		logger:       l,
 		progressBar:  pb,
+		state:        NewRunState(),
 	}
 }
 
+// SetRunState sets where the sync state and learned lookup entries are kept
+// between runs, as the config file is never written to
+func (r *StripeRunner) SetRunState(s *RunState) {
+	r.state = s
+}
+
 func (r *StripeRunner) GenerateStripeLedgerEntries() error {
 	var numPayouts int64 = 0
+	var numSkipped int64 = 0
 
 	defer func() {
-		if err := r.viper.WriteConfig(); err != nil {
-			r.logger.WithError(err).Warn("Unable to update config file. This may result in duplicate transactions in the next run.")
+		// Write back the lookup list with any new found values
+		if r.lookupList != nil {
+			if err := r.lookupList.persistData(); err != nil {
+				r.logger.WithError(err).Errorf("Unable to persist account lookup data key %s", "ledger_account_lookups")
+			}
+		}
+		if err := r.state.Save(); err != nil {
+			r.logger.WithError(err).Warn("Unable to update the state file. This may result in duplicate transactions in the next run.")
 		}
 		r.progressBar.SetTotal(numPayouts, true)
 	}()
 
+	lookupList, err := initializeLookupList(r.logger, r.viper, r.state)
+	if err != nil {
+		return err
+	}
+	r.lookupList = lookupList
+
+	createdAfter, err := r.stripeCreatedAfter()
+	if err != nil {
+		return err
+	}
+
+	sync, err := loadStripeSyncState(r.state)
+	if err != nil {
+		return err
+	}
+
+	// The cursor saved by older versions cannot be used to tell which payouts
+	// were imported, so it is up to the user to say where to start from
+	if sync.syncedUntil == 0 && len(sync.processed) == 0 && createdAfter == 0 {
+		cursor := r.state.lookup(STRIPE_LEGACY_CURSOR_STATE_KEY, r.viper).GetString(STRIPE_LEGACY_CURSOR_STATE_KEY)
+		if cursor != "" {
+			return fmt.Errorf("The Stripe payout cursor %s saved by an older version of slc does not reliably tell which payouts were already imported. Set stripe.created_after in your config file to the date from which payouts should be imported (e.g. the day after the most recent Stripe payout in your journal), and try again.", cursor)
+		}
+	}
+
 	params := &stripe.PayoutListParams{}
 	params.Filters.AddFilter("status", "", "paid")
 	params.AddExpand("data.destination")
 
-	cursor := r.viper.GetString("stripe.most_recently_processed_payout")
-	if cursor != "" {
-		params.Filters.AddFilter("starting_after", "", cursor)
+	if start := sync.windowStart(createdAfter); start > 0 {
+		r.logger.Debugf("Retrieving the Stripe payouts created since %s", time.Unix(start, 0))
+		params.Filters.AddFilter("created", "gte", strconv.FormatInt(start, 10))
 	}
 
-	var mostRecentPayoutDate int64 = 0
 	i := r.stripeClient.Payouts.List(params)
 	for i.Next() {
 		numPayouts += 1
 		r.progressBar.Increment()
 
 		p := i.Payout()
-		if p.Created > mostRecentPayoutDate {
-			r.logger.Debugf("Saving payout ID %s as the most recently seen payout", p.ID)
-			r.viper.Set("stripe.most_recently_processed_payout", p.ID)
+		sync.seen(p)
+		if sync.isProcessed(p) {
+			r.logger.Debugf("Skipping payout %s, which was already processed", p.ID)
+			numSkipped += 1
+			continue
 		}
 
-		if err := r.processStripePayout(p); err != nil {
+		if err := r.processBufferedStripePayout(p); err != nil {
+			return err
+		}
+
+		// Save the progress made so far, in case this run is interrupted
+		sync.markProcessed(p)
+		if err := r.lookupList.persistData(); err != nil {
+			return err
+		}
+		if err := r.state.Checkpoint(); err != nil {
 			return err
 		}
 	}
@@ -72,18 +126,33 @@ func (r *StripeRunner) GenerateStripeLedgerEntries() error {
 		return err
 	}
 
-	r.logger.Infof("Successfully processed %d Stripe payouts", numPayouts)
+	sync.finish()
+	r.logger.Infof("Successfully processed %d Stripe payouts (skipped %d that were already processed)", numPayouts-numSkipped, numSkipped)
 	return nil
 }
 
-func (r *StripeRunner) processStripePayout(payout *stripe.Payout) error {
-	payoutAmt := float64(payout.Amount) / 100.0
-	r.logger.Debugf("Processing stripe payout %s for %s %.2f, issued at %s (paid out to %s %s)", payout.ID, payout.Currency, payoutAmt, time.Unix(payout.Created, 0), payout.Destination.Type, payout.Destination.ID)
+// processBufferedStripePayout only writes out the ledger entries of a payout
+// once all of them were generated, so that a failure halfway through does not
+// leave a partial payout behind
+func (r *StripeRunner) processBufferedStripePayout(payout *stripe.Payout) error {
+	var buf bytes.Buffer
+	out := r.outputWriter
+	r.outputWriter = &buf
+	err := r.processStripePayout(payout)
+	r.outputWriter = out
+	if err != nil {
+		return err
+	}
 
-	if payout.Type == "card" {
-		r.logger.Warnf("This application does not yet support Stripe payouts to cards (vs bank accounts). If you would like to see this supported, open an issue at https://github.com/marvinpinto/slc/issues. Ignoring payout %s for now.", payout.ID)
-		return nil
+	if _, err := out.Write(buf.Bytes()); err != nil {
+		return err
 	}
+	return r.syncOutput()
+}
+
+func (r *StripeRunner) processStripePayout(payout *stripe.Payout) error {
+	payoutAmt := fromStripeAmount(Zero().SetInt64(payout.Amount), payout.Currency)
+	r.logger.Debugf("Processing stripe payout %s for %s %.*f, issued at %s (paid out to %s %s)", payout.ID, payout.Currency, stripeCurrencyExponent(payout.Currency), payoutAmt, time.Unix(payout.Created, 0), payout.Destination.Type, payout.Destination.ID)
 
 	r.logger.Debugf("Retrieving a list of all the balance transactions associated with payout %s", payout.ID)
 	params := &stripe.BalanceTransactionListParams{}
@@ -91,6 +160,7 @@ func (r *StripeRunner) processStripePayout(payout *stripe.Payout) error {
 	params.AddExpand("data.source.invoice")
 	params.AddExpand("data.source.charge")
 	params.AddExpand("data.source.charge.balance_transaction")
+	params.AddExpand("data.source.charge.invoice")
 	i := r.stripeClient.BalanceTransaction.List(params)
 	for i.Next() {
 		bt := i.BalanceTransaction()
@@ -107,6 +177,17 @@ func (r *StripeRunner) processStripePayout(payout *stripe.Payout) error {
 	return nil
 }
 
+// stripeLookupRecord describes a balance transaction, for the purposes of
+// matching the conditions in the account lookup list
+func stripeLookupRecord(bt *stripe.BalanceTransaction) lookupRecord {
+	return lookupRecord{
+		amount:   fromStripeAmount(Zero().SetInt64(bt.Amount), bt.Currency),
+		date:     time.Unix(bt.Created, 0),
+		source:   "stripe",
+		currency: string(bt.Currency),
+	}
+}
+
 func (r *StripeRunner) processStripeBalanceTransaction(bt *stripe.BalanceTransaction, payout *stripe.Payout) error {
 	// Note: This application only deals with a subset of the possible balance
 	// transactions - primarily associated with payments related reporting
@@ -115,18 +196,18 @@ func (r *StripeRunner) processStripeBalanceTransaction(bt *stripe.BalanceTransac
 
 	r.logger.Debugf("Processing stripe balance transaction %s. Details: %s", bt.ID, debugObject(bt))
 	if bt.ReportingCategory == "payout" {
+		// Instant payouts (e.g. to debit cards) come with a fee, which is
+		// the only part not covered by the other categories
+		if bt.Fee != 0 {
+			return r.processStripePayoutFee(bt, payout, r.lookupList)
+		}
 		r.logger.Debugf("Ignoring balance transaction %s as this %s will already be covered in another category", bt.ID, bt.ReportingCategory)
 		return nil
 	}
 
 	r.viper.SetDefault("stripe.add_customer_metadata", true)
+	lookupList := r.lookupList
 
-	lookupList, err := initializeLookupList(r.logger, r.viper)
-	if err != nil {
-		return err
-	}
-
-	// TODO: also handle the dispute_reversal, & refund_failure categories
 	switch bt.ReportingCategory {
 	case "charge":
 		if err := r.processStripeCharge(bt, payout, lookupList); err != nil {
@@ -136,10 +217,18 @@ func (r *StripeRunner) processStripeBalanceTransaction(bt *stripe.BalanceTransac
 		if err := r.processStripeDispute(bt, payout, lookupList); err != nil {
 			return err
 		}
+	case "dispute_reversal":
+		if err := r.processStripeDisputeReversal(bt, payout, lookupList); err != nil {
+			return err
+		}
 	case "refund":
 		if err := r.processStripeRefund(bt, payout, lookupList); err != nil {
 			return err
 		}
+	case "refund_failure":
+		if err := r.processStripeRefundFailure(bt, payout, lookupList); err != nil {
+			return err
+		}
 	case "fee":
 		if err := r.processStripeFee(bt, payout, lookupList); err != nil {
 			return err
@@ -148,11 +237,5 @@ func (r *StripeRunner) processStripeBalanceTransaction(bt *stripe.BalanceTransac
 		r.logger.Warnf("This application primarily supports balance transactions associated with payments, and does not support the %s type at the moment. See https://stripe.com/docs/reports/reporting-categories#group-charge_and_payment_related for more information.", bt.ReportingCategory)
 	}
 
-	// Write back the lookup list with any new found values
-	if err := lookupList.persistData(); err != nil {
-		r.logger.WithError(err).Errorf("Unable to persist account lookup data key %s", "ledger_account_lookups")
-		return err
-	}
-
 	return nil
 }
@@ -38,88 +38,214 @@ func TestGenerateStripeLedgerEntries(t *testing.T) {
 	type test struct {
 		name                      string
 		skipTest                  bool
-		inpIsQueryCursorPresent   bool
+		inpConfig                 string
+		inpState                  string
 		inpPayoutListApiCallErr   bool
 		inpBTListApiCallErr       bool
 		inpPayoutList             string
 		inpBalanceTransactionList string
+		expCreatedAfter           string
 		expOutput                 string
 		expError                  error
-		expSavedCursor            string
+		expSyncedUntil            int64
+		expProcessedPayouts       []string
 	}
 
 	tests := []test{
 		{
-			name:                      "does not use the query cursor when not present",
+			name:                      "lists all the payouts on the first run",
 			skipTest:                  false,
-			inpIsQueryCursorPresent:   false,
+			inpConfig:                 "---",
+			inpState:                  "",
 			inpPayoutListApiCallErr:   false,
 			inpBTListApiCallErr:       false,
 			inpPayoutList:             "testdata/stripe/empty-payload.json",
 			inpBalanceTransactionList: "testdata/stripe/balance-transaction.json",
+			expCreatedAfter:           "",
 			expOutput:                 "testdata/stripe/empty-response.ledger",
 			expError:                  nil,
-			expSavedCursor:            "",
+			expSyncedUntil:            0,
+			expProcessedPayouts:       []string{},
 		},
 		{
-			name:                      "uses the query cursor when present",
+			name:                      "only lists the payouts created since the last sync",
 			skipTest:                  false,
-			inpIsQueryCursorPresent:   true,
+			inpConfig:                 "---",
+			inpState:                  "---\nstripe:\n  synced_until: 1615338020\n",
 			inpPayoutListApiCallErr:   false,
 			inpBTListApiCallErr:       false,
 			inpPayoutList:             "testdata/stripe/empty-payload.json",
 			inpBalanceTransactionList: "testdata/stripe/balance-transaction.json",
+			expCreatedAfter:           "1612746020",
 			expOutput:                 "testdata/stripe/empty-response.ledger",
 			expError:                  nil,
-			expSavedCursor:            "cursor123",
+			expSyncedUntil:            1615338020,
+			expProcessedPayouts:       []string{},
+		},
+		{
+			name:                      "only lists the payouts created after stripe.created_after",
+			skipTest:                  false,
+			inpConfig:                 "---\nstripe:\n  created_after: 2021-03-01\n",
+			inpState:                  "",
+			inpPayoutListApiCallErr:   false,
+			inpBTListApiCallErr:       false,
+			inpPayoutList:             "testdata/stripe/empty-payload.json",
+			inpBalanceTransactionList: "testdata/stripe/balance-transaction.json",
+			expCreatedAfter:           "1614556800",
+			expOutput:                 "testdata/stripe/empty-response.ledger",
+			expError:                  nil,
+			expSyncedUntil:            0,
+			expProcessedPayouts:       []string{},
+		},
+		{
+			name:                      "refuses to use the payout cursor of older versions",
+			skipTest:                  false,
+			inpConfig:                 "---",
+			inpState:                  "---\nstripe:\n  most_recently_processed_payout: cursor123\n",
+			inpPayoutListApiCallErr:   false,
+			inpBTListApiCallErr:       false,
+			inpPayoutList:             "testdata/stripe/bank-payout.json",
+			inpBalanceTransactionList: "testdata/stripe/balance-transaction.json",
+			expCreatedAfter:           "",
+			expOutput:                 "testdata/stripe/empty-response.ledger",
+			expError:                  errors.New("The Stripe payout cursor cursor123 saved by an older version of slc does not reliably tell which payouts were already imported. Set stripe.created_after in your config file to the date from which payouts should be imported (e.g. the day after the most recent Stripe payout in your journal), and try again."),
+			expSyncedUntil:            0,
+			expProcessedPayouts:       []string{},
+		},
+		{
+			name:                      "uses stripe.created_after instead of the payout cursor of older versions",
+			skipTest:                  false,
+			inpConfig:                 "---\nstripe:\n  created_after: 2021-03-01\n",
+			inpState:                  "---\nstripe:\n  most_recently_processed_payout: cursor123\n",
+			inpPayoutListApiCallErr:   false,
+			inpBTListApiCallErr:       false,
+			inpPayoutList:             "testdata/stripe/bank-payout.json",
+			inpBalanceTransactionList: "testdata/stripe/balance-transaction.json",
+			expCreatedAfter:           "1614556800",
+			expOutput:                 "testdata/stripe/simple-report.ledger",
+			expError:                  nil,
+			expSyncedUntil:            1615338020,
+			expProcessedPayouts:       []string{"po_1ITGPQCOCRzw0YkGEIImZLHC"},
 		},
 		{
 			name:                      "gracefully handles stripe payout list API errors",
 			skipTest:                  false,
-			inpIsQueryCursorPresent:   false,
+			inpConfig:                 "---",
+			inpState:                  "",
 			inpPayoutListApiCallErr:   true,
 			inpBTListApiCallErr:       false,
 			inpPayoutList:             "testdata/stripe/empty-payload.json",
 			inpBalanceTransactionList: "testdata/stripe/balance-transaction.json",
+			expCreatedAfter:           "",
 			expOutput:                 "testdata/stripe/empty-response.ledger",
 			expError:                  errors.New("payout API testing error"),
-			expSavedCursor:            "",
+			expSyncedUntil:            0,
+			expProcessedPayouts:       []string{},
 		},
 		{
-			name:                      "ignores stripe payouts to cards",
+			name:                      "is able to process stripe payouts to cards",
 			skipTest:                  false,
-			inpIsQueryCursorPresent:   false,
+			inpConfig:                 "---",
+			inpState:                  "",
 			inpPayoutListApiCallErr:   false,
 			inpBTListApiCallErr:       false,
 			inpPayoutList:             "testdata/stripe/card-payout.json",
 			inpBalanceTransactionList: "testdata/stripe/balance-transaction.json",
-			expOutput:                 "testdata/stripe/empty-response.ledger",
+			expCreatedAfter:           "",
+			expOutput:                 "testdata/stripe/card-payout.ledger",
 			expError:                  nil,
-			expSavedCursor:            "po_1ITGPQCOCRzw0YkGEIImZLHC",
+			expSyncedUntil:            1615338020,
+			expProcessedPayouts:       []string{"po_1ITGPQCOCRzw0YkGEIImZLHC"},
+		},
+		{
+			name:                      "books the fee of instant payouts",
+			skipTest:                  false,
+			inpConfig:                 "---",
+			inpState:                  "",
+			inpPayoutListApiCallErr:   false,
+			inpBTListApiCallErr:       false,
+			inpPayoutList:             "testdata/stripe/card-payout.json",
+			inpBalanceTransactionList: "testdata/stripe/instant-payout-balance-transaction.json",
+			expCreatedAfter:           "",
+			expOutput:                 "testdata/stripe/instant-payout.ledger",
+			expError:                  nil,
+			expSyncedUntil:            1615338020,
+			expProcessedPayouts:       []string{"po_1ITGPQCOCRzw0YkGEIImZLHC"},
 		},
 		{
 			name:                      "gracefully handles stripe balance transaction list API errors",
 			skipTest:                  false,
-			inpIsQueryCursorPresent:   false,
+			inpConfig:                 "---",
+			inpState:                  "",
 			inpPayoutListApiCallErr:   false,
 			inpBTListApiCallErr:       true,
 			inpPayoutList:             "testdata/stripe/bank-payout.json",
 			inpBalanceTransactionList: "testdata/stripe/balance-transaction.json",
+			expCreatedAfter:           "",
 			expOutput:                 "testdata/stripe/empty-response.ledger",
 			expError:                  errors.New("balance transaction API testing error"),
-			expSavedCursor:            "",
+			expSyncedUntil:            0,
+			expProcessedPayouts:       []string{},
 		},
 		{
 			name:                      "is able to produce a basic ledger report",
 			skipTest:                  false,
-			inpIsQueryCursorPresent:   false,
+			inpConfig:                 "---",
+			inpState:                  "",
+			inpPayoutListApiCallErr:   false,
+			inpBTListApiCallErr:       false,
+			inpPayoutList:             "testdata/stripe/bank-payout.json",
+			inpBalanceTransactionList: "testdata/stripe/balance-transaction.json",
+			expCreatedAfter:           "",
+			expOutput:                 "testdata/stripe/simple-report.ledger",
+			expError:                  nil,
+			expSyncedUntil:            1615338020,
+			expProcessedPayouts:       []string{"po_1ITGPQCOCRzw0YkGEIImZLHC"},
+		},
+		{
+			name:                      "skips payouts that were already processed",
+			skipTest:                  false,
+			inpConfig:                 "---",
+			inpState:                  "---\nstripe:\n  synced_until: 1615338020\n  processed_payouts:\n  - id: po_1ITGPQCOCRzw0YkGEIImZLHC\n    created: 1615338020\n",
 			inpPayoutListApiCallErr:   false,
 			inpBTListApiCallErr:       false,
 			inpPayoutList:             "testdata/stripe/bank-payout.json",
 			inpBalanceTransactionList: "testdata/stripe/balance-transaction.json",
+			expCreatedAfter:           "1612746020",
+			expOutput:                 "testdata/stripe/empty-response.ledger",
+			expError:                  nil,
+			expSyncedUntil:            1615338020,
+			expProcessedPayouts:       []string{"po_1ITGPQCOCRzw0YkGEIImZLHC"},
+		},
+		{
+			name:                      "keeps track of the payouts processed before a run is interrupted",
+			skipTest:                  false,
+			inpConfig:                 "---",
+			inpState:                  "",
+			inpPayoutListApiCallErr:   false,
+			inpBTListApiCallErr:       false,
+			inpPayoutList:             "testdata/stripe/two-payouts.json",
+			inpBalanceTransactionList: "testdata/stripe/balance-transaction.json",
+			expCreatedAfter:           "",
 			expOutput:                 "testdata/stripe/simple-report.ledger",
+			expError:                  errors.New("balance transaction API testing error"),
+			expSyncedUntil:            0,
+			expProcessedPayouts:       []string{"po_1ITGPQCOCRzw0YkGEIImZLHC"},
+		},
+		{
+			name:                      "forgets processed payouts that are no longer listed",
+			skipTest:                  false,
+			inpConfig:                 "---",
+			inpState:                  "---\nstripe:\n  synced_until: 1615338020\n  processed_payouts:\n  - id: po_1IEq2LCOCRzw0YkGX8f3aJxU\n    created: 1611874800\n  - id: po_1ITGPQCOCRzw0YkGEIImZLHC\n    created: 1615338020\n",
+			inpPayoutListApiCallErr:   false,
+			inpBTListApiCallErr:       false,
+			inpPayoutList:             "testdata/stripe/empty-payload.json",
+			inpBalanceTransactionList: "testdata/stripe/balance-transaction.json",
+			expCreatedAfter:           "1612746020",
+			expOutput:                 "testdata/stripe/empty-response.ledger",
 			expError:                  nil,
-			expSavedCursor:            "",
+			expSyncedUntil:            1615338020,
+			expProcessedPayouts:       []string{"po_1ITGPQCOCRzw0YkGEIImZLHC"},
 		},
 	}
 
@@ -139,8 +265,8 @@ func TestGenerateStripeLedgerEntries(t *testing.T) {
 			payoutArgs := new(form.Values)
 			payoutArgs.Add("expand[0]", "data.destination")
 			payoutArgs.Add("status", "paid")
-			if tc.inpIsQueryCursorPresent {
-				payoutArgs.Add("starting_after", "cursor123")
+			if tc.expCreatedAfter != "" {
+				payoutArgs.Add("created[gte]", tc.expCreatedAfter)
 			}
 			if tc.inpPayoutListApiCallErr {
 				stripeBackend.
@@ -165,6 +291,7 @@ func TestGenerateStripeLedgerEntries(t *testing.T) {
 			btArgs.Add("expand[0]", "data.source.invoice")
 			btArgs.Add("expand[1]", "data.source.charge")
 			btArgs.Add("expand[2]", "data.source.charge.balance_transaction")
+			btArgs.Add("expand[3]", "data.source.charge.invoice")
 			btArgs.Add("payout", "po_1ITGPQCOCRzw0YkGEIImZLHC")
 			if tc.inpBTListApiCallErr {
 				stripeBackend.
@@ -180,6 +307,11 @@ func TestGenerateStripeLedgerEntries(t *testing.T) {
 					Return(nil)
 			}
 
+			// Listing the balance transactions of any other payout fails
+			stripeBackend.
+				On("CallRaw", "GET", "/v1/balance_transactions", mock.Anything, mock.Anything, mock.Anything, mock.Anything).
+				Return(fmt.Errorf("balance transaction API testing error"))
+
 			sc := &client.API{}
 			sc.Init("", &stripe.Backends{
 				API: stripeBackend,
@@ -191,16 +323,23 @@ func TestGenerateStripeLedgerEntries(t *testing.T) {
 			v.SetDefault("date_format_string", "2006-01-02")
 			v.SetConfigName("slcconfig")
 			v.AddConfigPath("/")
-			afero.WriteFile(appFs, "/slcconfig.yml", []byte("---"), 0644)
-			if tc.inpIsQueryCursorPresent {
-				afero.WriteFile(appFs, "/slcconfig.yml", []byte("---\nstripe:\n  most_recently_processed_payout: cursor123"), 0644)
+			afero.WriteFile(appFs, "/slcconfig.yml", []byte(tc.inpConfig), 0644)
+			if tc.inpState != "" {
+				afero.WriteFile(appFs, "/slcstate.yml", []byte(tc.inpState), 0644)
 			}
 			v.ReadInConfig()
 
+			state, err := OpenRunState(appFs, "/slcstate.yml", "/slcproposals.yml")
+			if err != nil {
+				t.Fatalf("Unable to open the state file: %v", err)
+			}
+			defer state.Close()
+
 			var logger = log.WithFields(log.Fields{"name": "slc-testing"})
 			var output bytes.Buffer
 			bar := &StubProgressBar{}
 			runner := NewStripeRunner(sc, &output, v, logger, bar)
+			runner.SetRunState(state)
 
 			expOutput, err := ioutil.ReadFile(tc.expOutput)
 			if err != nil {
@@ -211,10 +350,18 @@ func TestGenerateStripeLedgerEntries(t *testing.T) {
 			assert.Equal(t, tc.expError, result)
 			assert.Equal(t, string(expOutput), strings.Replace(output.String(), "\t", " ", -1))
 
-			if tc.expSavedCursor != "" {
-				resp, _ := afero.FileContainsBytes(appFs, "/slcconfig.yml", []byte(fmt.Sprintf("most_recently_processed_payout: %s", tc.expSavedCursor)))
-				assert.True(t, resp, "pagination cursor is saved back to the config file")
+			savedState := readSavedState(t, appFs, "/slcstate.yml")
+			assert.Equal(t, tc.expSyncedUntil, savedState.GetInt64(STRIPE_SYNCED_UNTIL_STATE_KEY))
+			var processed []processedPayout
+			assert.Nil(t, savedState.UnmarshalKey(STRIPE_PROCESSED_PAYOUTS_STATE_KEY, &processed))
+			processedIDs := []string{}
+			for _, p := range processed {
+				processedIDs = append(processedIDs, p.ID)
 			}
+			assert.Equal(t, tc.expProcessedPayouts, processedIDs, "processed payouts are saved to the state file")
+
+			cfgData, _ := afero.ReadFile(appFs, "/slcconfig.yml")
+			assert.Equal(t, tc.inpConfig, string(cfgData), "the config file is left alone")
 		})
 	}
 }
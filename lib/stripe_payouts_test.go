@@ -24,15 +24,35 @@ func TestStripePayouts(t *testing.T) {
 		skipTest                  bool
 		inpPayoutList             string
 		inpBalanceTransactionList string
+		inpCreditNoteList         string
+		inpConfig                 string
 		expOutput                 string
 	}
 
+	annotatedLookupsCfg := `---
+ledger_account_lookups:
+  - search: "^stripe_income_source"
+    account_name: "Income:Consulting"
+    payee: "Consulting clients"
+    tags: ["consulting"]
+    metadata: ["Project: acme"]
+    posting_tags: ["revenue"]
+  - search: "^stripe_fees$"
+    account_name: "Expenses:Stripe Fees"
+    tags: ["fees"]
+    posting_metadata: ["Receipt: stripe-2020.pdf"]
+  - search: "^ba_1GudjfCOCRzw0YkG4sLGXb2S$"
+    account_name: "Assets:Checking"
+    posting_tags: ["cleared"]
+`
+
 	tests := []test{
 		{
 			name:                      "is able to handle a basic charge (no invoice)",
 			skipTest:                  false,
 			inpPayoutList:             "testdata/stripe/bank-payout.json",
 			inpBalanceTransactionList: "testdata/stripe/balance-transaction.json",
+			inpCreditNoteList:         "testdata/stripe/empty-payload.json",
 			expOutput:                 "testdata/stripe/simple-report.ledger",
 		},
 		{
@@ -40,6 +60,7 @@ func TestStripePayouts(t *testing.T) {
 			skipTest:                  false,
 			inpPayoutList:             "testdata/stripe/bank-payout.json",
 			inpBalanceTransactionList: "testdata/stripe/charges/with-customer-info.json",
+			inpCreditNoteList:         "testdata/stripe/empty-payload.json",
 			expOutput:                 "testdata/stripe/charges/with-customer-info.ledger",
 		},
 		{
@@ -47,13 +68,39 @@ func TestStripePayouts(t *testing.T) {
 			skipTest:                  false,
 			inpPayoutList:             "testdata/stripe/bank-payout.json",
 			inpBalanceTransactionList: "testdata/stripe/charges/multi-currency.json",
+			inpCreditNoteList:         "testdata/stripe/empty-payload.json",
 			expOutput:                 "testdata/stripe/charges/multi-currency.ledger",
 		},
+		{
+			name:                      "is able to handle multi currency payouts with zero-decimal charges",
+			skipTest:                  false,
+			inpPayoutList:             "testdata/stripe/bank-payout.json",
+			inpBalanceTransactionList: "testdata/stripe/charges/multi-currency-jpy.json",
+			inpCreditNoteList:         "testdata/stripe/empty-payload.json",
+			expOutput:                 "testdata/stripe/charges/multi-currency-jpy.ledger",
+		},
+		{
+			name:                      "is able to handle payouts in zero-decimal currencies",
+			skipTest:                  false,
+			inpPayoutList:             "testdata/stripe/currencies/jpy-payout.json",
+			inpBalanceTransactionList: "testdata/stripe/currencies/jpy.json",
+			inpCreditNoteList:         "testdata/stripe/empty-payload.json",
+			expOutput:                 "testdata/stripe/currencies/jpy.ledger",
+		},
+		{
+			name:                      "is able to handle payouts in three-decimal currencies",
+			skipTest:                  false,
+			inpPayoutList:             "testdata/stripe/currencies/kwd-payout.json",
+			inpBalanceTransactionList: "testdata/stripe/currencies/kwd.json",
+			inpCreditNoteList:         "testdata/stripe/empty-payload.json",
+			expOutput:                 "testdata/stripe/currencies/kwd.ledger",
+		},
 		{
 			name:                      "is able to handle invoices with tax line items",
 			skipTest:                  false,
 			inpPayoutList:             "testdata/stripe/bank-payout.json",
 			inpBalanceTransactionList: "testdata/stripe/charges/taxed-items.json",
+			inpCreditNoteList:         "testdata/stripe/empty-payload.json",
 			expOutput:                 "testdata/stripe/charges/taxed-items.ledger",
 		},
 		{
@@ -61,29 +108,83 @@ func TestStripePayouts(t *testing.T) {
 			skipTest:                  false,
 			inpPayoutList:             "testdata/stripe/bank-payout.json",
 			inpBalanceTransactionList: "testdata/stripe/refunds/basic.json",
+			inpCreditNoteList:         "testdata/stripe/empty-payload.json",
 			expOutput:                 "testdata/stripe/refunds/basic.ledger",
 		},
-		// {
-		// 	name:                      "is able to handle a refund with taxes",
-		// 	skipTest:                  false,
-		// 	inpPayoutList:             "testdata/stripe/bank-payout.json",
-		// 	inpBalanceTransactionList: "testdata/stripe/refunds/with-taxes.json",
-		// 	expOutput:                 "testdata/stripe/refund/with-taxes.ledger",
-		// },
+		{
+			name:                      "is able to handle a failed refund",
+			skipTest:                  false,
+			inpPayoutList:             "testdata/stripe/bank-payout.json",
+			inpBalanceTransactionList: "testdata/stripe/refunds/failed.json",
+			inpCreditNoteList:         "testdata/stripe/empty-payload.json",
+			expOutput:                 "testdata/stripe/refunds/failed.ledger",
+		},
+		{
+			name:                      "is able to handle partial refunds with taxes",
+			skipTest:                  false,
+			inpPayoutList:             "testdata/stripe/bank-payout.json",
+			inpBalanceTransactionList: "testdata/stripe/refunds/with-taxes.json",
+			inpCreditNoteList:         "testdata/stripe/refunds/with-taxes-credit-notes.json",
+			expOutput:                 "testdata/stripe/refunds/with-taxes.ledger",
+		},
+		{
+			name:                      "reverses the tax and income of the charge when refunding it in full",
+			skipTest:                  false,
+			inpPayoutList:             "testdata/stripe/bank-payout.json",
+			inpBalanceTransactionList: "testdata/stripe/refunds/with-taxes-full.json",
+			inpCreditNoteList:         "testdata/stripe/empty-payload.json",
+			expOutput:                 "testdata/stripe/refunds/with-taxes-full.ledger",
+		},
+		{
+			name:                      "subtracts the tax reversed by an earlier credit note from prorated refunds",
+			skipTest:                  false,
+			inpPayoutList:             "testdata/stripe/bank-payout.json",
+			inpBalanceTransactionList: "testdata/stripe/refunds/with-taxes.json",
+			inpCreditNoteList:         "testdata/stripe/refunds/with-taxes-early-credit-note.json",
+			expOutput:                 "testdata/stripe/refunds/with-taxes-early-credit-note.ledger",
+		},
 		{
 			name:                      "is able to handle a lost dispute",
 			skipTest:                  false,
 			inpPayoutList:             "testdata/stripe/bank-payout.json",
 			inpBalanceTransactionList: "testdata/stripe/disputes/lost.json",
+			inpCreditNoteList:         "testdata/stripe/empty-payload.json",
 			expOutput:                 "testdata/stripe/disputes/lost.ledger",
 		},
+		{
+			name:                      "is able to handle a won dispute",
+			skipTest:                  false,
+			inpPayoutList:             "testdata/stripe/bank-payout.json",
+			inpBalanceTransactionList: "testdata/stripe/disputes/won.json",
+			inpCreditNoteList:         "testdata/stripe/empty-payload.json",
+			expOutput:                 "testdata/stripe/disputes/won.ledger",
+		},
 		{
 			name:                      "is able to handle stripe account fees",
 			skipTest:                  false,
 			inpPayoutList:             "testdata/stripe/bank-payout.json",
 			inpBalanceTransactionList: "testdata/stripe/stripe-fee.json",
+			inpCreditNoteList:         "testdata/stripe/empty-payload.json",
 			expOutput:                 "testdata/stripe/stripe-fee.ledger",
 		},
+		{
+			name:                      "adds tags and metadata from the lookup list",
+			skipTest:                  false,
+			inpPayoutList:             "testdata/stripe/bank-payout.json",
+			inpBalanceTransactionList: "testdata/stripe/refunds/basic.json",
+			inpCreditNoteList:         "testdata/stripe/empty-payload.json",
+			inpConfig:                 annotatedLookupsCfg,
+			expOutput:                 "testdata/stripe/lookup-annotations.ledger",
+		},
+		{
+			name:                      "adds tags and metadata from the lookup list to account fees",
+			skipTest:                  false,
+			inpPayoutList:             "testdata/stripe/bank-payout.json",
+			inpBalanceTransactionList: "testdata/stripe/stripe-fee.json",
+			inpCreditNoteList:         "testdata/stripe/empty-payload.json",
+			inpConfig:                 annotatedLookupsCfg,
+			expOutput:                 "testdata/stripe/lookup-annotations-fee.ledger",
+		},
 	}
 
 	for _, tc := range tests {
@@ -119,6 +220,7 @@ func TestStripePayouts(t *testing.T) {
 			btArgs.Add("expand[0]", "data.source.invoice")
 			btArgs.Add("expand[1]", "data.source.charge")
 			btArgs.Add("expand[2]", "data.source.charge.balance_transaction")
+			btArgs.Add("expand[3]", "data.source.charge.invoice")
 			btArgs.Add("payout", "po_1ITGPQCOCRzw0YkGEIImZLHC")
 			stripeBackend.
 				On("CallRaw", "GET", "/v1/balance_transactions", mock.Anything, btArgs, mock.Anything, mock.Anything).
@@ -128,6 +230,19 @@ func TestStripePayouts(t *testing.T) {
 				}).
 				Return(nil)
 
+			cnFixture, err := ioutil.ReadFile(tc.inpCreditNoteList)
+			if err != nil {
+				t.Fatalf("Unable to read fixtures file %s", tc.inpCreditNoteList)
+			}
+
+			stripeBackend.
+				On("CallRaw", "GET", "/v1/credit_notes", mock.Anything, mock.Anything, mock.Anything, mock.Anything).
+				Run(func(args mock.Arguments) {
+					v := args.Get(5).(stripe.LastResponseSetter)
+					SetStripeFixtureResponse(t, v, cnFixture)
+				}).
+				Return(nil)
+
 			sc := &client.API{}
 			sc.Init("", &stripe.Backends{
 				API: stripeBackend,
@@ -139,7 +254,11 @@ func TestStripePayouts(t *testing.T) {
 			v.SetDefault("date_format_string", "2006-01-02")
 			v.SetConfigName("slcconfig")
 			v.AddConfigPath("/")
-			afero.WriteFile(appFs, "/slcconfig.yml", []byte("---"), 0644)
+			config := tc.inpConfig
+			if config == "" {
+				config = "---"
+			}
+			afero.WriteFile(appFs, "/slcconfig.yml", []byte(config), 0644)
 			v.ReadInConfig()
 
 			var logger = log.WithFields(log.Fields{"name": "slc-testing"})
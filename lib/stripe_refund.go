@@ -8,50 +8,144 @@ import (
 )
 
 func (r *StripeRunner) processStripeRefund(bt *stripe.BalanceTransaction, payout *stripe.Payout, lookupList *ledgerAccountLookup) error {
+	trLines, incomeAcctInfo, origStripeFee, err := r.stripeRefundPostings(bt, payout, lookupList)
+	if err != nil {
+		return err
+	}
+
+	tr, err := NewLedgerTransaction(time.Unix(bt.Created, 0), "Stripe Customer Refund", trLines)
+	if err != nil {
+		return err
+	}
+
+	tr.AddComment(fmt.Sprintf("Correlates to Stripe payout %s from %s for amount %s", payout.ID, tr.formatDate(payout.ArrivalDate), tr.formatUnitAmount(payout.Amount, string(payout.Currency))))
+
+	if origStripeFee > 0 {
+		tr.AddKeyValComment("Original Stripe fee", tr.formatUnitAmount(origStripeFee, string(payout.Currency)))
+	}
+	incomeAcctInfo.annotateTransaction(tr)
+
+	tr.SetDateFormat(r.viper.GetString("date_format_string"))
+	tr.SetPrecision(stripeCurrencyExponent(bt.Currency))
+	fmt.Fprintln(r.outputWriter, tr.String())
+
+	return nil
+}
+
+// processStripeRefundFailure handles refunds that could not be completed (e.g.
+// because the customer's card was cancelled), where Stripe returns the
+// refunded amount to the balance. The postings of the original refund are
+// reversed.
+func (r *StripeRunner) processStripeRefundFailure(bt *stripe.BalanceTransaction, payout *stripe.Payout, lookupList *ledgerAccountLookup) error {
+	// The original refund postings are worked out from the mirror image of
+	// this balance transaction, so that they match the same lookup entries
+	refundBt := *bt
+	refundBt.Amount = -bt.Amount
+	refundBt.Fee = -bt.Fee
+	refundBt.Net = -bt.Net
+	refundLines, incomeAcctInfo, origStripeFee, err := r.stripeRefundPostings(&refundBt, payout, lookupList)
+	if err != nil {
+		return err
+	}
+
 	var trLines []TransactionPosting
+	for _, line := range refundLines {
+		if line.Amount.Sign() != 0 {
+			line.Amount = Zero().Neg(line.Amount)
+		}
+		trLines = append(trLines, line)
+	}
 
-	bankAcctInfo, err := lookupList.getOrAddItem(payout.Destination.ID, "Assets:Bank")
+	tr, err := NewLedgerTransaction(time.Unix(bt.Created, 0), "Stripe Refund Failure", trLines)
 	if err != nil {
 		return err
 	}
 
+	tr.AddComment(fmt.Sprintf("Correlates to Stripe payout %s from %s for amount %s", payout.ID, tr.formatDate(payout.ArrivalDate), tr.formatUnitAmount(payout.Amount, string(payout.Currency))))
+
+	if bt.Source != nil && bt.Source.Refund != nil {
+		refund := bt.Source.Refund
+		if refund.Charge != nil {
+			tr.AddComment(fmt.Sprintf("Reverses failed Stripe refund %s on charge %s", refund.ID, refund.Charge.ID))
+		} else {
+			tr.AddComment(fmt.Sprintf("Reverses failed Stripe refund %s", refund.ID))
+		}
+		if refund.FailureReason != "" {
+			tr.AddKeyValComment("Refund failure reason", string(refund.FailureReason))
+		}
+	}
+
+	if origStripeFee > 0 {
+		tr.AddKeyValComment("Original Stripe fee", tr.formatUnitAmount(origStripeFee, string(payout.Currency)))
+	}
+	incomeAcctInfo.annotateTransaction(tr)
+
+	tr.SetDateFormat(r.viper.GetString("date_format_string"))
+	tr.SetPrecision(stripeCurrencyExponent(bt.Currency))
+	fmt.Fprintln(r.outputWriter, tr.String())
+
+	return nil
+}
+
+// stripeRefundPostings returns the postings for a refund, along with the
+// lookup list entry of the income source and the fee of the original charge
+// (which Stripe does not return)
+func (r *StripeRunner) stripeRefundPostings(bt *stripe.BalanceTransaction, payout *stripe.Payout, lookupList *ledgerAccountLookup) ([]TransactionPosting, *lookupItem, int64, error) {
+	lookupRec := stripeLookupRecord(bt)
+	var trLines []TransactionPosting
+
+	bankAcctInfo, err := lookupList.getOrAddItem(payout.Destination.ID, lookupRec, "Assets:Bank")
+	if err != nil {
+		return nil, nil, 0, err
+	}
+
 	accTaxAmt := Zero()
-	if bt.Source != nil && bt.Source.Refund != nil && bt.Source.Refund.Charge != nil && bt.Source.Refund.Charge.Invoice != nil {
-		for _, taxAmt := range bt.Source.Refund.Charge.Invoice.TotalTaxAmounts {
-			taxAcctInfo, err := lookupList.getOrAddItem(taxAmt.TaxRate.ID, "Liabilities:SalesTax")
+	if bt.Source != nil && bt.Source.Refund != nil && bt.Source.Refund.Charge != nil {
+		taxAmounts, err := r.stripeRefundTaxAmounts(bt.Source.Refund)
+		if err != nil {
+			return nil, nil, 0, err
+		}
+		for _, taxAmt := range taxAmounts {
+			if taxAmt.Amount == 0 {
+				continue
+			}
+
+			taxAcctInfo, err := lookupList.getOrAddItem(taxAmt.TaxRate.ID, lookupRec, "Liabilities:SalesTax")
 			if err != nil {
-				return err
+				return nil, nil, 0, err
 			}
 
 			normalizedTaxAmt := Zero().SetInt64(taxAmt.Amount)
 			if bt.Currency != bt.Source.Refund.Charge.Currency {
-				// normalizedTaxAmt *= exchange rate
-				normalizedTaxAmt.Mul(normalizedTaxAmt, Zero().SetFloat64(bt.ExchangeRate))
+				// Convert the tax amount to the minor unit of the balance
+				// transaction currency
+				normalizedTaxAmt = convertStripeAmount(normalizedTaxAmt, bt.Source.Refund.Charge.Currency, bt.Currency, bt.ExchangeRate)
 			}
 			accTaxAmt.Add(accTaxAmt, normalizedTaxAmt)
 
-			// Tax liability line
+			// Tax liability line (the refunded tax is no longer owed)
 			trLines = append(trLines, TransactionPosting{
 				Account: taxAcctInfo.AcctName,
-				// -1 * (normalizedTaxAmt / 100)
-				Amount:   Zero().Neg(Zero().Quo(normalizedTaxAmt, Zero().SetFloat64(100))),
+				// normalizedTaxAmt / minor units
+				Amount:   fromStripeAmount(normalizedTaxAmt, bt.Currency),
 				Currency: string(bt.Currency),
 			})
+			taxAcctInfo.annotatePosting(&trLines[len(trLines)-1])
 		}
 	}
 
 	incomeSrcKey := STRIPE_INCOME_SRC_LOOKUP_KEY
-	if bt.Source != nil && bt.Source.Refund.Charge != nil && bt.Source.Refund.Charge.Customer != nil {
+	if bt.Source != nil && bt.Source.Refund != nil && bt.Source.Refund.Charge != nil && bt.Source.Refund.Charge.Customer != nil {
 		incomeSrcKey = fmt.Sprintf("%s_%s", incomeSrcKey, bt.Source.Refund.Charge.Customer.ID)
 	}
-	incomeAcctInfo, err := lookupList.getOrAddItem(incomeSrcKey, "Income:Stripe")
+	incomeAcctInfo, err := lookupList.getOrAddItem(incomeSrcKey, lookupRec, "Income:Stripe")
 	if err != nil {
-		return err
+		return nil, nil, 0, err
 	}
 
-	stripeFeesAcctInfo, err := lookupList.getOrAddItem(STRIPE_FEES_LOOKUP_KEY, "Expenses:Stripe Fees")
+	stripeFeesAcctInfo, err := lookupList.getOrAddItem(STRIPE_FEES_LOOKUP_KEY, lookupRec, "Expenses:Stripe Fees")
 	if err != nil {
-		return err
+		return nil, nil, 0, err
 	}
 
 	// Account for the original Stripe fee when calculating the net income (loss)
@@ -63,40 +157,29 @@ func (r *StripeRunner) processStripeRefund(bt *stripe.BalanceTransaction, payout
 	// Income source line
 	trLines = append(trLines, TransactionPosting{
 		Account: incomeAcctInfo.AcctName,
-		// -1 * ((bt.Amount - accTaxAmt + origStripeFee)/100)
-		Amount:   Zero().Neg(Zero().Quo(Zero().Add(Zero().Sub(Zero().SetInt64(bt.Amount), accTaxAmt), Zero().SetInt64(origStripeFee)), Zero().SetFloat64(100))),
+		// -1 * ((bt.Amount + accTaxAmt + origStripeFee) / minor units)
+		Amount:   Zero().Neg(fromStripeAmount(Zero().Add(Zero().Add(Zero().SetInt64(bt.Amount), accTaxAmt), Zero().SetInt64(origStripeFee)), bt.Currency)),
 		Currency: string(bt.Currency),
 	})
+	incomeAcctInfo.annotatePosting(&trLines[len(trLines)-1])
 
 	// Stripe fees line
 	trLines = append(trLines, TransactionPosting{
 		Account: stripeFeesAcctInfo.AcctName,
-		// bt.Fee / 100
-		Amount:   Zero().Quo(Zero().SetInt64(bt.Fee), Zero().SetFloat64(100)),
+		// bt.Fee / minor units
+		Amount:   fromStripeAmount(Zero().SetInt64(bt.Fee), bt.Currency),
 		Currency: string(bt.Currency),
 	})
+	stripeFeesAcctInfo.annotatePosting(&trLines[len(trLines)-1])
 
 	// Destination line
 	trLines = append(trLines, TransactionPosting{
 		Account: bankAcctInfo.AcctName,
-		// (bt.Net + origStripeFee)/100
-		Amount:   Zero().Quo(Zero().Add(Zero().SetInt64(bt.Net), Zero().SetInt64(origStripeFee)), Zero().SetFloat64(100)),
+		// (bt.Net + origStripeFee) / minor units
+		Amount:   fromStripeAmount(Zero().Add(Zero().SetInt64(bt.Net), Zero().SetInt64(origStripeFee)), bt.Currency),
 		Currency: string(bt.Currency),
 	})
+	bankAcctInfo.annotatePosting(&trLines[len(trLines)-1])
 
-	tr, err := NewLedgerTransaction(time.Unix(bt.Created, 0), "Stripe Customer Refund", trLines)
-	if err != nil {
-		return err
-	}
-
-	tr.AddComment(fmt.Sprintf("Correlates to Stripe payout %s from %s for amount %s", payout.ID, tr.formatDate(payout.ArrivalDate), tr.formatUnitAmount(payout.Amount, string(payout.Currency))))
-
-	if origStripeFee > 0 {
-		tr.AddKeyValComment("Original Stripe fee", tr.formatUnitAmount(origStripeFee, string(payout.Currency)))
-	}
-
-	tr.SetDateFormat(r.viper.GetString("date_format_string"))
-	fmt.Fprintln(r.outputWriter, tr.String())
-
-	return nil
+	return trLines, incomeAcctInfo, origStripeFee, nil
 }
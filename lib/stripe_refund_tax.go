@@ -0,0 +1,151 @@
+package lib
+
+import (
+	"sort"
+
+	stripe "github.com/stripe/stripe-go/v72"
+)
+
+// stripeRefundTaxAmounts returns the tax amounts (in the minor unit of the
+// charge currency) reversed by a refund. The tax amounts of the credit note
+// issued for the refund are used if there is one. Otherwise the tax collected
+// on the invoice is prorated by the refunded amount over the charge amount.
+func (r *StripeRunner) stripeRefundTaxAmounts(refund *stripe.Refund) ([]*stripe.InvoiceTaxAmount, error) {
+	if refund == nil || refund.Charge == nil || refund.Charge.Invoice == nil || len(refund.Charge.Invoice.TotalTaxAmounts) == 0 {
+		return nil, nil
+	}
+	charge := refund.Charge
+
+	creditNotes, err := r.stripeRefundCreditNotes(charge.Invoice.ID)
+	if err != nil {
+		return nil, err
+	}
+	if creditNote, ok := creditNotes[refund.ID]; ok {
+		r.logger.Debugf("Using the tax amounts from credit note %s for refund %s", creditNote.ID, refund.ID)
+		var res []*stripe.InvoiceTaxAmount
+		for _, taxAmt := range creditNote.TaxAmounts {
+			res = append(res, &stripe.InvoiceTaxAmount{
+				Amount:    taxAmt.Amount,
+				Inclusive: taxAmt.Inclusive,
+				TaxRate:   taxAmt.TaxRate,
+			})
+		}
+		return res, nil
+	}
+
+	if charge.Amount <= 0 {
+		return nil, nil
+	}
+	if charge.Refunds != nil && charge.Refunds.HasMore {
+		r.logger.Warnf("Charge %s has more refunds than Stripe returned, the tax reversed by refund %s might not account for all of them", charge.ID, refund.ID)
+	}
+
+	var res []*stripe.InvoiceTaxAmount
+	for _, taxAmt := range charge.Invoice.TotalTaxAmounts {
+		// The tax reversed by all the refunds up to (and including) this one
+		// is prorated, and the tax actually reversed by the earlier refunds is
+		// subtracted from that. This way the rounding differences do not add
+		// up, and refunding the full charge amount reverses all of the tax.
+		refunded, reversed := stripePreviousRefunds(refund, taxAmt, creditNotes)
+		amount := prorateStripeAmount(taxAmt.Amount, refunded+refund.Amount, charge.Amount) - reversed
+		if amount < 0 {
+			amount = 0
+		}
+		res = append(res, &stripe.InvoiceTaxAmount{
+			Amount:    amount,
+			Inclusive: taxAmt.Inclusive,
+			TaxRate:   taxAmt.TaxRate,
+		})
+	}
+	return res, nil
+}
+
+// stripeRefundCreditNotes returns the (non-void) credit notes issued for an
+// invoice, keyed by the ID of the refund they were issued for
+func (r *StripeRunner) stripeRefundCreditNotes(invoiceID string) (map[string]*stripe.CreditNote, error) {
+	res := make(map[string]*stripe.CreditNote)
+	params := &stripe.CreditNoteListParams{}
+	params.Invoice = stripe.String(invoiceID)
+	i := r.stripeClient.CreditNotes.List(params)
+	for i.Next() {
+		creditNote := i.CreditNote()
+		if creditNote.Refund != nil && creditNote.Status != stripe.CreditNoteStatusVoid {
+			res[creditNote.Refund.ID] = creditNote
+		}
+	}
+
+	if err := i.Err(); err != nil {
+		r.logger.WithError(err).Errorf("Unable to retrieve the credit notes for invoice %s", invoiceID)
+		return nil, err
+	}
+	return res, nil
+}
+
+// stripePreviousRefunds returns the amount refunded on the same charge before
+// this refund, along with the amount of the supplied tax that those refunds
+// reversed. Failed and canceled refunds are not taken into account.
+func stripePreviousRefunds(refund *stripe.Refund, taxAmt *stripe.InvoiceTaxAmount, creditNotes map[string]*stripe.CreditNote) (int64, int64) {
+	if refund.Charge.Refunds == nil {
+		return 0, 0
+	}
+
+	var previous []*stripe.Refund
+	for _, other := range refund.Charge.Refunds.Data {
+		if other.ID == refund.ID || other.Status == stripe.RefundStatusFailed || other.Status == stripe.RefundStatusCanceled {
+			continue
+		}
+		if other.Created < refund.Created || (other.Created == refund.Created && other.ID < refund.ID) {
+			previous = append(previous, other)
+		}
+	}
+	sort.Slice(previous, func(i, j int) bool {
+		if previous[i].Created != previous[j].Created {
+			return previous[i].Created < previous[j].Created
+		}
+		return previous[i].ID < previous[j].ID
+	})
+
+	// Refunds with a credit note reversed the tax amount on the credit note,
+	// the others reversed the prorated tax up to and including themselves
+	// minus whatever was reversed before them
+	var refunded, reversed int64
+	for _, other := range previous {
+		refunded += other.Amount
+		if creditNote, ok := creditNotes[other.ID]; ok {
+			reversed += stripeCreditNoteTaxAmount(creditNote, taxAmt.TaxRate)
+		} else if prorated := prorateStripeAmount(taxAmt.Amount, refunded, refund.Charge.Amount); prorated > reversed {
+			reversed = prorated
+		}
+	}
+	return refunded, reversed
+}
+
+// stripeCreditNoteTaxAmount returns the amount of a tax rate on a credit note
+func stripeCreditNoteTaxAmount(creditNote *stripe.CreditNote, taxRate *stripe.TaxRate) int64 {
+	var res int64 = 0
+	for _, taxAmt := range creditNote.TaxAmounts {
+		if stripeTaxRateID(taxAmt.TaxRate) == stripeTaxRateID(taxRate) {
+			res += taxAmt.Amount
+		}
+	}
+	return res
+}
+
+func stripeTaxRateID(taxRate *stripe.TaxRate) string {
+	if taxRate == nil {
+		return ""
+	}
+	return taxRate.ID
+}
+
+// prorateStripeAmount returns amount * part / total, rounded half up to a
+// whole minor unit. The part is capped at the total.
+func prorateStripeAmount(amount int64, part int64, total int64) int64 {
+	if part > total {
+		part = total
+	}
+	if part <= 0 {
+		return 0
+	}
+	return (2*amount*part + total) / (2 * total)
+}
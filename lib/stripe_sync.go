@@ -0,0 +1,141 @@
+package lib
+
+import (
+	"fmt"
+	"os"
+	"time"
+
+	stripe "github.com/stripe/stripe-go/v72"
+)
+
+const STRIPE_SYNCED_UNTIL_STATE_KEY = "stripe.synced_until"
+const STRIPE_PROCESSED_PAYOUTS_STATE_KEY = "stripe.processed_payouts"
+
+// Older versions of slc kept a Stripe pagination cursor, which did not
+// reliably tell which payouts were already imported
+const STRIPE_LEGACY_CURSOR_STATE_KEY = "stripe.most_recently_processed_payout"
+
+// Payouts only show up in the (paid) payout list once they arrive, which can
+// be a while after they were created. Payouts created this long before the
+// most recently synced payout are listed again, and the ones that were already
+// processed are skipped.
+const STRIPE_SYNC_LOOKBACK = 30 * 24 * time.Hour
+
+type processedPayout struct {
+	ID      string `mapstructure:"id" yaml:"id"`
+	Created int64  `mapstructure:"created" yaml:"created"`
+}
+
+// stripeSyncState keeps track of the Stripe payouts that were imported. The
+// payouts are listed from the creation time of the most recently synced payout
+// (minus STRIPE_SYNC_LOOKBACK), and the ones in the set of processed payouts
+// are skipped. A payout is added to the set as soon as its ledger entries are
+// written out, so that an interrupted run can be picked up where it left off.
+type stripeSyncState struct {
+	state       *RunState
+	syncedUntil int64
+	processed   []processedPayout
+	index       map[string]bool
+
+	// Creation time of the most recent payout listed in this run
+	newest int64
+}
+
+func loadStripeSyncState(state *RunState) (*stripeSyncState, error) {
+	s := &stripeSyncState{
+		state:       state,
+		syncedUntil: state.values.GetInt64(STRIPE_SYNCED_UNTIL_STATE_KEY),
+		index:       make(map[string]bool),
+	}
+
+	if err := state.values.UnmarshalKey(STRIPE_PROCESSED_PAYOUTS_STATE_KEY, &s.processed); err != nil {
+		return nil, fmt.Errorf("Unable to read the processed Stripe payouts from the state file: %v", err)
+	}
+	for _, p := range s.processed {
+		s.index[p.ID] = true
+	}
+	return s, nil
+}
+
+// windowStart returns the creation time from which payouts need to be listed,
+// or 0 to list all of them. Payouts created before createdAfter are never
+// listed.
+func (s *stripeSyncState) windowStart(createdAfter int64) int64 {
+	start := createdAfter
+	if s.syncedUntil > 0 {
+		if w := s.syncedUntil - int64(STRIPE_SYNC_LOOKBACK.Seconds()); w > start {
+			start = w
+		}
+	}
+	return start
+}
+
+func (s *stripeSyncState) isProcessed(payout *stripe.Payout) bool {
+	return s.index[payout.ID]
+}
+
+func (s *stripeSyncState) seen(payout *stripe.Payout) {
+	if payout.Created > s.newest {
+		s.newest = payout.Created
+	}
+}
+
+func (s *stripeSyncState) markProcessed(payout *stripe.Payout) {
+	s.processed = append(s.processed, processedPayout{ID: payout.ID, Created: payout.Created})
+	s.index[payout.ID] = true
+	s.state.set(STRIPE_PROCESSED_PAYOUTS_STATE_KEY, s.processed)
+}
+
+// finish moves the sync window forward once all the listed payouts were
+// processed. Processed payouts that are too old to be listed again are no
+// longer needed.
+func (s *stripeSyncState) finish() {
+	if s.newest > s.syncedUntil {
+		s.syncedUntil = s.newest
+	}
+
+	start := s.windowStart(0)
+	processed := []processedPayout{}
+	for _, p := range s.processed {
+		if p.Created >= start {
+			processed = append(processed, p)
+		}
+	}
+	s.processed = processed
+
+	if s.syncedUntil > 0 {
+		s.state.set(STRIPE_SYNCED_UNTIL_STATE_KEY, s.syncedUntil)
+	}
+	s.state.set(STRIPE_PROCESSED_PAYOUTS_STATE_KEY, s.processed)
+}
+
+// stripeCreatedAfter returns the (optional) "stripe.created_after" date from
+// the config file, before which no payouts are imported
+func (r *StripeRunner) stripeCreatedAfter() (int64, error) {
+	val := r.viper.GetString("stripe.created_after")
+	if val == "" {
+		return 0, nil
+	}
+
+	date, err := time.Parse("2006-01-02", val)
+	if err != nil {
+		return 0, fmt.Errorf("Invalid stripe.created_after date '%s', expected a date such as 2021-03-01: %v", val, err)
+	}
+	return date.Unix(), nil
+}
+
+// syncOutput makes sure that everything written so far has made it to disk,
+// before the payouts are marked as processed
+func (r *StripeRunner) syncOutput() error {
+	f, ok := r.outputWriter.(*os.File)
+	if !ok {
+		return nil
+	}
+
+	// Only regular files can be synced (and not e.g. stdout)
+	info, err := f.Stat()
+	if err != nil || !info.Mode().IsRegular() {
+		return nil
+	}
+	return f.Sync()
+}